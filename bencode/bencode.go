@@ -0,0 +1,98 @@
+//Package bencode encodes and decodes bencode, the serialization format of torrent files and tracker responses (BEP 3).
+//
+//Values map to Go types the way encoding/json does: integers to integer types, byte strings to strings, byte slices
+//and byte arrays, lists to slices and arrays, and dictionaries to maps with string keys and to structs.
+//Struct fields are named by the bencode tag, such as `bencode:"piece length,omitempty"`, and skipped with `bencode:"-"`.
+//Decoding into an empty interface gives int64, string, []interface{} and map[string]interface{} values.
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+)
+
+const (
+	// DefaultMaxDepth is the deepest nesting of lists and dictionaries a Decoder accepts when its MaxDepth is 0
+	DefaultMaxDepth = 64
+	// DefaultMaxSize is the largest number of bytes a Decoder reads for one value when its MaxSize is 0
+	DefaultMaxSize = 64 << 20
+)
+
+// RawMessage is a raw encoded value. Decoding into it keeps the exact bytes of the value, which are written as they are when encoding.
+type RawMessage []byte
+
+// Marshal returns the canonical encoding of v: dictionary keys are sorted, and nil pointers and interfaces are left out of dictionaries
+func Marshal(v interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	err := NewEncoder(&b).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// Unmarshal decodes data into v, which must be a non-nil pointer. Non-canonical input is accepted,
+// use a Decoder with Strict set to reject it. Data left after the value is an error.
+func Unmarshal(data []byte, v interface{}) error {
+	d := NewDecoder(bytes.NewReader(data))
+	d.MaxSize = int64(len(data))
+	err := d.Decode(v)
+	if err != nil {
+		return err
+	}
+	if d.offset != int64(len(data)) {
+		return &SyntaxError{Offset: d.offset, msg: "data after the value"}
+	}
+	return nil
+}
+
+// SyntaxError is returned for input which is not valid bencode, Offset being where the problem is.
+// Input ending in the middle of a value gives a SyntaxError wrapping io.ErrUnexpectedEOF.
+type SyntaxError struct {
+	Offset int64
+	msg    string
+	err    error
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("Invalid bencode at offset %d: %s", e.Offset, e.msg)
+}
+
+// Unwrap returns io.ErrUnexpectedEOF if the input ended in the middle of a value, nil otherwise
+func (e *SyntaxError) Unwrap() error {
+	return e.err
+}
+
+// UnmarshalTypeError is returned when a value does not fit in the Go type it is decoded into
+type UnmarshalTypeError struct {
+	// Value describes the bencode value, such as "list" or "integer 300"
+	Value  string
+	Type   reflect.Type
+	Offset int64
+}
+
+func (e *UnmarshalTypeError) Error() string {
+	return fmt.Sprintf("Cannot decode bencode %s at offset %d into Go value of type %s", e.Value, e.Offset, e.Type)
+}
+
+// UnsupportedTypeError is returned when encoding a value whose type has no bencode representation, such as a float
+type UnsupportedTypeError struct {
+	Type reflect.Type
+}
+
+func (e *UnsupportedTypeError) Error() string {
+	return fmt.Sprintf("Cannot encode Go value of type %s in bencode", e.Type)
+}
+
+// InvalidUnmarshalError is returned when decoding into something which is not a non-nil pointer
+type InvalidUnmarshalError struct {
+	Type reflect.Type
+}
+
+func (e *InvalidUnmarshalError) Error() string {
+	if e.Type == nil {
+		return "Cannot decode bencode into nil"
+	}
+	return fmt.Sprintf("Cannot decode bencode into non pointer or nil %s", e.Type)
+}
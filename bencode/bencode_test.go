@@ -0,0 +1,222 @@
+package bencode
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStrict(t *testing.T) {
+	tests := []struct {
+		data   string
+		strict bool
+	}{
+		{"i0e", true},
+		{"i42e", true},
+		{"i-42e", true},
+		{"i03e", false},
+		{"i-0e", false},
+		{"i-03e", false},
+		{"i00e", false},
+		{"0:", true},
+		{"4:spam", true},
+		{"04:spam", false},
+		{"d1:ai1e1:bi2ee", true},
+		{"d1:bi2e1:ai1ee", false},
+		{"d1:ai1e1:ai2ee", false},
+		{"d1:ad1:bi1e1:ai2eee", false},
+		{"ld1:bi2e1:ai1eee", false},
+	}
+	for _, tt := range tests {
+		var lax interface{}
+		if err := Unmarshal([]byte(tt.data), &lax); err != nil {
+			t.Errorf("Decoding %q: %v", tt.data, err)
+		}
+
+		var v interface{}
+		d := NewDecoder(strings.NewReader(tt.data))
+		d.Strict = true
+		err := d.Decode(&v)
+		if tt.strict && err != nil {
+			t.Errorf("Strictly decoding %q: %v", tt.data, err)
+		}
+		if !tt.strict {
+			if _, ok := err.(*SyntaxError); !ok {
+				t.Errorf("Strictly decoding %q: got %v, want a *SyntaxError", tt.data, err)
+			}
+		}
+	}
+}
+
+func TestEncodeCanonical(t *testing.T) {
+	type info struct {
+		Name   string `bencode:"name"`
+		Length int    `bencode:"length"`
+		Pieces []byte `bencode:"pieces"`
+		Zebra  int
+		Alpha  int
+	}
+	tests := []struct {
+		v    interface{}
+		want string
+	}{
+		{map[string]int{"b": 2, "a": 1, "c": 3, "B": 4}, "d1:Bi4e1:ai1e1:bi2e1:ci3ee"},
+		{info{Name: "a", Length: 1, Pieces: []byte("xy"), Zebra: 2, Alpha: 3}, "d5:Alphai3e5:Zebrai2e6:lengthi1e4:name1:a6:pieces2:xye"},
+		{map[string]interface{}{"z": []int{1, 2}, "a": map[string]string{"y": "1", "x": "2"}}, "d1:ad1:x1:21:y1:1e1:zli1ei2eee"},
+		{map[string]interface{}{"a": nil, "b": (*int)(nil), "c": 0}, "d1:ci0ee"},
+		{[20]byte{}, "20:" + strings.Repeat("\x00", 20)},
+		{true, "i1e"},
+		{int64(-7), "i-7e"},
+		{uint8(255), "i255e"},
+	}
+	for _, tt := range tests {
+		got, err := Marshal(tt.v)
+		if err != nil {
+			t.Errorf("Encoding %#v: %v", tt.v, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("Encoding %#v: got %q, want %q", tt.v, got, tt.want)
+		}
+	}
+
+	for _, v := range []interface{}{1.5, map[int]int{1: 1}, make(chan int)} {
+		_, err := Marshal(v)
+		if _, ok := err.(*UnsupportedTypeError); !ok {
+			t.Errorf("Encoding %T: got %v, want an *UnsupportedTypeError", v, err)
+		}
+	}
+}
+
+func TestRawMessage(t *testing.T) {
+	type torrent struct {
+		Announce string     `bencode:"announce"`
+		Info     RawMessage `bencode:"info"`
+		Nodes    []RawMessage
+	}
+	// the info dictionary is not canonical, its keys being out of order, and must be kept as it is for the infohash
+	info := "d4:name1:a6:lengthi03ee"
+	data := "d5:Nodesl2:abi1eld1:xi2eeee8:announce3:url4:info" + info + "e"
+
+	var tor torrent
+	if err := Unmarshal([]byte(data), &tor); err != nil {
+		t.Fatal(err)
+	}
+	if string(tor.Info) != info {
+		t.Errorf("Got raw info %q, want %q", tor.Info, info)
+	}
+	nodes := []string{"2:ab", "i1e", "ld1:xi2eee"}
+	if len(tor.Nodes) != len(nodes) {
+		t.Fatalf("Got %d raw nodes, want %d", len(tor.Nodes), len(nodes))
+	}
+	for i, n := range nodes {
+		if string(tor.Nodes[i]) != n {
+			t.Errorf("Got raw node %q, want %q", tor.Nodes[i], n)
+		}
+	}
+
+	got, err := Marshal(tor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != data {
+		t.Errorf("Encoding raw messages: got %q, want %q", got, data)
+	}
+
+	if _, err := Marshal(RawMessage{}); err == nil {
+		t.Error("Encoded an empty RawMessage")
+	}
+}
+
+func TestStructTags(t *testing.T) {
+	type file struct {
+		Length int      `bencode:"length"`
+		Path   []string `bencode:"path"`
+		MD5    string   `bencode:"md5sum,omitempty"`
+		Attr   []byte   `bencode:"attr,omitempty"`
+		Skip   string   `bencode:"-"`
+		Ptr    *int     `bencode:"ptr"`
+		secret string
+	}
+	two := 2
+	tests := []struct {
+		v    file
+		want string
+	}{
+		{file{Length: 1, Path: []string{"a", "b"}}, "d6:lengthi1e4:pathl1:a1:bee"},
+		{file{Length: 1, MD5: "x", Attr: []byte("p"), Skip: "y", secret: "z"}, "d4:attr1:p6:lengthi1e6:md5sum1:x4:pathlee"},
+		{file{Ptr: &two}, "d6:lengthi0e4:pathle3:ptri2ee"},
+	}
+	for _, tt := range tests {
+		got, err := Marshal(tt.v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != tt.want {
+			t.Errorf("Encoding %+v: got %q, want %q", tt.v, got, tt.want)
+		}
+
+		var back file
+		if err := Unmarshal(got, &back); err != nil {
+			t.Fatal(err)
+		}
+		want := tt.v
+		want.Skip, want.secret = "", ""
+		if want.Path == nil {
+			want.Path = []string{}
+		}
+		if !reflect.DeepEqual(back, want) {
+			t.Errorf("Decoding %q: got %+v, want %+v", got, back, want)
+		}
+	}
+
+	// unknown keys and the ones of skipped fields are ignored
+	var f file
+	if err := Unmarshal([]byte("d1:-1:x7:unknownli1ee6:lengthi5e4:Skip1:ye"), &f); err != nil {
+		t.Fatal(err)
+	}
+	if f.Length != 5 || f.Skip != "" {
+		t.Errorf("Got %+v, want only the length set", f)
+	}
+
+	var mismatch file
+	err := Unmarshal([]byte("d6:length4:spame"), &mismatch)
+	if _, ok := err.(*UnmarshalTypeError); !ok {
+		t.Errorf("Decoding a string into an integer field: got %v, want an *UnmarshalTypeError", err)
+	}
+}
+
+func TestMaxDepth(t *testing.T) {
+	nested := func(n int) string {
+		return strings.Repeat("l", n) + "i1e" + strings.Repeat("e", n)
+	}
+	for _, max := range []int{1, 2, 10} {
+		// the integer is nested max levels below the top
+		var v interface{}
+		d := NewDecoder(strings.NewReader(nested(max)))
+		d.MaxDepth = max
+		if err := d.Decode(&v); err != nil {
+			t.Errorf("Decoding %d nested lists with MaxDepth %d: %v", max, max, err)
+		}
+
+		d = NewDecoder(strings.NewReader(nested(max + 1)))
+		d.MaxDepth = max
+		err := d.Decode(&v)
+		if _, ok := err.(*SyntaxError); !ok {
+			t.Errorf("Decoding %d nested lists with MaxDepth %d: got %v, want a *SyntaxError", max+1, max, err)
+		}
+	}
+
+	// dictionaries count as well, and the default applies when MaxDepth is 0
+	deep := bytes.Repeat([]byte("d1:a"), DefaultMaxDepth+1)
+	deep = append(deep, "i1e"...)
+	deep = append(deep, bytes.Repeat([]byte("e"), DefaultMaxDepth+1)...)
+	var v interface{}
+	if _, ok := Unmarshal(deep, &v).(*SyntaxError); !ok {
+		t.Errorf("Decoded dictionaries nested deeper than %d", DefaultMaxDepth)
+	}
+	if err := Unmarshal(deep[4:len(deep)-1], &v); err != nil {
+		t.Errorf("Decoding dictionaries nested %d deep: %v", DefaultMaxDepth, err)
+	}
+}
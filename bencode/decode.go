@@ -0,0 +1,427 @@
+package bencode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// maxIntLength is the longest integer accepted, enough for any 64 bit value
+const maxIntLength = 20
+
+// Decoder reads bencoded values from a stream. It may read ahead of the value it decodes.
+type Decoder struct {
+	// Strict rejects input which is not canonical: integers with leading zeros or -0,
+	// string lengths with leading zeros, and dictionaries whose keys are not sorted or repeat
+	Strict bool
+	// MaxDepth is the deepest nesting of lists and dictionaries accepted, DefaultMaxDepth is used if 0
+	MaxDepth int
+	// MaxSize is the largest number of bytes read for one value, DefaultMaxSize is used if 0
+	MaxSize int64
+
+	r      *bufio.Reader
+	offset int64
+	limit  int64
+	raw    []byte
+	record bool
+}
+
+// NewDecoder returns a decoder reading from r
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReader(r)}
+}
+
+// Decode reads the next value into v, which must be a non-nil pointer
+func (d *Decoder) Decode(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return &InvalidUnmarshalError{reflect.TypeOf(v)}
+	}
+	maxSize := d.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	d.limit = d.offset + maxSize
+	return d.value(rv.Elem(), 0)
+}
+
+// InputOffset returns the number of bytes decoded so far
+func (d *Decoder) InputOffset() int64 {
+	return d.offset
+}
+
+func (d *Decoder) maxDepth() int {
+	if d.MaxDepth <= 0 {
+		return DefaultMaxDepth
+	}
+	return d.MaxDepth
+}
+
+func (d *Decoder) syntaxError(offset int64, format string, args ...interface{}) error {
+	return &SyntaxError{Offset: offset, msg: fmt.Sprintf(format, args...)}
+}
+
+//unexpectedEOF returns the error for input ending at offset in the middle of a value
+func (d *Decoder) unexpectedEOF(offset int64) error {
+	return &SyntaxError{Offset: offset, msg: "unexpected end of input", err: io.ErrUnexpectedEOF}
+}
+
+func (d *Decoder) peek() (byte, error) {
+	b, err := d.r.Peek(1)
+	if err == io.EOF {
+		return 0, d.unexpectedEOF(d.offset)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+func (d *Decoder) readByte() (byte, error) {
+	if d.offset >= d.limit {
+		if _, err := d.r.Peek(1); err == io.EOF {
+			return 0, d.unexpectedEOF(d.offset)
+		}
+		return 0, d.syntaxError(d.offset, "value larger than the size limit")
+	}
+	c, err := d.r.ReadByte()
+	if err == io.EOF {
+		return 0, d.unexpectedEOF(d.offset)
+	}
+	if err != nil {
+		return 0, err
+	}
+	d.offset++
+	if d.record {
+		d.raw = append(d.raw, c)
+	}
+	return c, nil
+}
+
+//readInt reads the digits of an integer up to end, which is consumed
+func (d *Decoder) readInt(end byte) (string, error) {
+	start := d.offset
+	var digits []byte
+	for {
+		c, err := d.readByte()
+		if err != nil {
+			return "", err
+		}
+		if c == end {
+			break
+		}
+		if !(c >= '0' && c <= '9' || c == '-' && len(digits) == 0) || len(digits) == maxIntLength {
+			return "", d.syntaxError(d.offset-1, "invalid integer")
+		}
+		digits = append(digits, c)
+	}
+	s := string(digits)
+	if s == "" || s == "-" {
+		return "", d.syntaxError(start, "invalid integer")
+	}
+	if d.Strict && (s == "-0" || s[0] == '0' && len(s) > 1 || len(s) > 1 && s[0] == '-' && s[1] == '0') {
+		return "", d.syntaxError(start, "non canonical integer %s", s)
+	}
+	return s, nil
+}
+
+func (d *Decoder) readString() ([]byte, error) {
+	start := d.offset
+	s, err := d.readInt(':')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return nil, d.syntaxError(start, "invalid string length %s", s)
+	}
+	if n > d.limit-d.offset {
+		return nil, d.syntaxError(start, "string of %d bytes is larger than the %d bytes left", n, d.limit-d.offset)
+	}
+	buf := make([]byte, n)
+	_, err = io.ReadFull(d.r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, d.unexpectedEOF(d.offset)
+	}
+	if err != nil {
+		return nil, err
+	}
+	d.offset += n
+	if d.record {
+		d.raw = append(d.raw, buf...)
+	}
+	return buf, nil
+}
+
+//value decodes the next value into v, depth being the nesting of the value
+func (d *Decoder) value(v reflect.Value, depth int) error {
+	if depth > d.maxDepth() {
+		return d.syntaxError(d.offset, "nested deeper than %d", d.maxDepth())
+	}
+
+	if v.IsValid() && v.Type() == rawMessageType {
+		start := len(d.raw)
+		record := d.record
+		d.record = true
+		err := d.value(reflect.Value{}, depth)
+		d.record = record
+		if err != nil {
+			return err
+		}
+		raw := make([]byte, len(d.raw)-start)
+		copy(raw, d.raw[start:])
+		if !record {
+			d.raw = d.raw[:0]
+		}
+		v.SetBytes(raw)
+		return nil
+	}
+
+	// pointers are allocated, and interfaces holding a pointer are decoded through it
+	if v.IsValid() && v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.value(v.Elem(), depth)
+	}
+	if v.IsValid() && v.Kind() == reflect.Interface && v.NumMethod() == 0 && !v.IsNil() && v.Elem().Kind() == reflect.Ptr {
+		return d.value(v.Elem(), depth)
+	}
+
+	c, err := d.peek()
+	if err != nil {
+		return err
+	}
+	switch {
+	case c == 'i':
+		return d.integer(v)
+	case c >= '0' && c <= '9':
+		return d.str(v)
+	case c == 'l':
+		return d.list(v, depth)
+	case c == 'd':
+		return d.dict(v, depth)
+	default:
+		return d.syntaxError(d.offset, "unexpected %q", c)
+	}
+}
+
+//generic tells if a value is decoded as interface{}, a zero v meaning the value is skipped
+func generic(v reflect.Value) bool {
+	return v.IsValid() && v.Kind() == reflect.Interface && v.NumMethod() == 0
+}
+
+func (d *Decoder) integer(v reflect.Value) error {
+	start := d.offset
+	if _, err := d.readByte(); err != nil {
+		return err
+	}
+	s, err := d.readInt('e')
+	if err != nil {
+		return err
+	}
+	if !v.IsValid() {
+		return nil
+	}
+	typeError := &UnmarshalTypeError{Value: "integer " + s, Type: v.Type(), Offset: start}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return typeError
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return typeError
+		}
+		v.Set(reflect.ValueOf(n))
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || v.OverflowInt(n) {
+			return typeError
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil || v.OverflowUint(n) {
+			return typeError
+		}
+		v.SetUint(n)
+	case reflect.Bool:
+		if s != "0" && s != "1" {
+			return typeError
+		}
+		v.SetBool(s == "1")
+	default:
+		return typeError
+	}
+	return nil
+}
+
+func (d *Decoder) str(v reflect.Value) error {
+	start := d.offset
+	b, err := d.readString()
+	if err != nil {
+		return err
+	}
+	if !v.IsValid() {
+		return nil
+	}
+	typeError := &UnmarshalTypeError{Value: "string", Type: v.Type(), Offset: start}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return typeError
+		}
+		v.Set(reflect.ValueOf(string(b)))
+	case reflect.String:
+		v.SetString(string(b))
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			return typeError
+		}
+		v.SetBytes(b)
+	case reflect.Array:
+		// byte arrays such as infohashes take strings of exactly their length
+		if v.Type().Elem().Kind() != reflect.Uint8 || v.Len() != len(b) {
+			return typeError
+		}
+		reflect.Copy(v, reflect.ValueOf(b))
+	default:
+		return typeError
+	}
+	return nil
+}
+
+func (d *Decoder) list(v reflect.Value, depth int) error {
+	start := d.offset
+	if _, err := d.readByte(); err != nil {
+		return err
+	}
+
+	var elem func(i int) (reflect.Value, error)
+	switch {
+	case !v.IsValid():
+		elem = func(i int) (reflect.Value, error) { return reflect.Value{}, nil }
+	case generic(v):
+		l := []interface{}{}
+		defer func() {
+			v.Set(reflect.ValueOf(l))
+		}()
+		elem = func(i int) (reflect.Value, error) {
+			l = append(l, nil)
+			return reflect.ValueOf(l).Index(i), nil
+		}
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() != reflect.Uint8:
+		v.Set(reflect.MakeSlice(v.Type(), 0, 0))
+		elem = func(i int) (reflect.Value, error) {
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			return v.Index(i), nil
+		}
+	case v.Kind() == reflect.Array && v.Type().Elem().Kind() != reflect.Uint8:
+		v.Set(reflect.Zero(v.Type()))
+		elem = func(i int) (reflect.Value, error) {
+			if i >= v.Len() {
+				return reflect.Value{}, &UnmarshalTypeError{Value: "list longer than " + strconv.Itoa(v.Len()), Type: v.Type(), Offset: start}
+			}
+			return v.Index(i), nil
+		}
+	default:
+		return &UnmarshalTypeError{Value: "list", Type: v.Type(), Offset: start}
+	}
+
+	for i := 0; ; i++ {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			_, err = d.readByte()
+			return err
+		}
+		ev, err := elem(i)
+		if err != nil {
+			return err
+		}
+		err = d.value(ev, depth+1)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (d *Decoder) dict(v reflect.Value, depth int) error {
+	start := d.offset
+	if _, err := d.readByte(); err != nil {
+		return err
+	}
+
+	// elem returns the value the element key is decoded into, and store, if set, puts it in a map once decoded
+	var elem func(key string) reflect.Value
+	var store func(key string, ev reflect.Value)
+	switch {
+	case !v.IsValid():
+		elem = func(key string) reflect.Value { return reflect.Value{} }
+	case generic(v) || v.Kind() == reflect.Map && v.Type().Key().Kind() == reflect.String:
+		m := v
+		if generic(v) {
+			m = reflect.ValueOf(map[string]interface{}{})
+			v.Set(m)
+		} else if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		elem = func(key string) reflect.Value {
+			return reflect.New(m.Type().Elem()).Elem()
+		}
+		store = func(key string, ev reflect.Value) {
+			m.SetMapIndex(reflect.ValueOf(key).Convert(m.Type().Key()), ev)
+		}
+	case v.Kind() == reflect.Struct:
+		elem = func(key string) reflect.Value {
+			f, ok := fieldByKey(v.Type(), key)
+			if !ok {
+				return reflect.Value{} // unknown keys are skipped
+			}
+			return v.Field(f.index)
+		}
+	default:
+		return &UnmarshalTypeError{Value: "dictionary", Type: v.Type(), Offset: start}
+	}
+
+	var prev string
+	for i := 0; ; i++ {
+		c, err := d.peek()
+		if err != nil {
+			return err
+		}
+		if c == 'e' {
+			_, err = d.readByte()
+			return err
+		}
+		keyStart := d.offset
+		if c < '0' || c > '9' {
+			return d.syntaxError(keyStart, "dictionary key is not a string")
+		}
+		b, err := d.readString()
+		if err != nil {
+			return err
+		}
+		key := string(b)
+		if d.Strict && i > 0 && key <= prev {
+			return d.syntaxError(keyStart, "dictionary key %q is not sorted or repeats", key)
+		}
+		prev = key
+
+		ev := elem(key)
+		err = d.value(ev, depth+1)
+		if err != nil {
+			return err
+		}
+		if store != nil {
+			store(key, ev)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package bencode
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+type errReader struct {
+	data string
+	err  error
+}
+
+func (r *errReader) Read(b []byte) (int, error) {
+	if r.data == "" {
+		return 0, r.err
+	}
+	n := copy(b, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestDecodeTruncated(t *testing.T) {
+	for _, data := range []string{"i42e", "4:spam", "l4:spami1ee", "d3:cowi1e4:spaml1:aee", "lli1eee"} {
+		for n := 0; n < len(data); n++ {
+			var v interface{}
+			err := NewDecoder(strings.NewReader(data[:n])).Decode(&v)
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("Decoding %q: got %v, want %v", data[:n], err, io.ErrUnexpectedEOF)
+			}
+			if _, ok := err.(*SyntaxError); !ok {
+				t.Errorf("Decoding %q: got %T, want a *SyntaxError", data[:n], err)
+			}
+		}
+	}
+}
+
+func TestDecodeSizeLimit(t *testing.T) {
+	// every byte but the last fits, the closing bytes of integers, lists and dictionaries included
+	for _, data := range []string{"i42e", "li1ee", "d1:ai1ee"} {
+		d := NewDecoder(strings.NewReader(data))
+		d.MaxSize = int64(len(data) - 1)
+		var v interface{}
+		err := d.Decode(&v)
+		if _, ok := err.(*SyntaxError); !ok || errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("Decoding %q over the size limit: got %v", data, err)
+		}
+	}
+}
+
+func TestDecodeReadError(t *testing.T) {
+	readErr := errors.New("read failed")
+	for _, data := range []string{"", "i4", "4:sp", "l", "d1:a"} {
+		var v interface{}
+		err := NewDecoder(&errReader{data, readErr}).Decode(&v)
+		if err != readErr {
+			t.Errorf("Decoding %q: got %v, want %v", data, err, readErr)
+		}
+	}
+}
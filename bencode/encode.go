@@ -0,0 +1,138 @@
+package bencode
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+var rawMessageType = reflect.TypeOf(RawMessage(nil))
+
+// Encoder writes bencoded values to a stream
+type Encoder struct {
+	w io.Writer
+}
+
+// NewEncoder returns an encoder writing to w
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{w: w}
+}
+
+// Encode writes the canonical encoding of v, the whole value being written at once or not at all
+func (e *Encoder) Encode(v interface{}) error {
+	var b bytes.Buffer
+	err := encode(&b, reflect.ValueOf(v))
+	if err != nil {
+		return err
+	}
+	_, err = e.w.Write(b.Bytes())
+	return err
+}
+
+func encode(b *bytes.Buffer, v reflect.Value) error {
+	if !v.IsValid() {
+		return fmt.Errorf("Cannot encode nil in bencode")
+	}
+	if v.Type() == rawMessageType {
+		if v.Len() == 0 {
+			return fmt.Errorf("Cannot encode empty RawMessage in bencode")
+		}
+		b.Write(v.Bytes())
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return fmt.Errorf("Cannot encode nil %s in bencode", v.Type())
+		}
+		return encode(b, v.Elem())
+	case reflect.String:
+		writeString(b, v.String())
+	case reflect.Bool:
+		if v.Bool() {
+			b.WriteString("i1e")
+		} else {
+			b.WriteString("i0e")
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		b.WriteByte('i')
+		b.WriteString(strconv.FormatInt(v.Int(), 10))
+		b.WriteByte('e')
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		b.WriteByte('i')
+		b.WriteString(strconv.FormatUint(v.Uint(), 10))
+		b.WriteByte('e')
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			// byte slices and arrays are strings
+			b.WriteString(strconv.Itoa(v.Len()))
+			b.WriteByte(':')
+			for i := 0; i < v.Len(); i++ {
+				b.WriteByte(byte(v.Index(i).Uint()))
+			}
+			return nil
+		}
+		b.WriteByte('l')
+		for i := 0; i < v.Len(); i++ {
+			err := encode(b, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+		b.WriteByte('e')
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return &UnsupportedTypeError{v.Type()}
+		}
+		keys := v.MapKeys()
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+		b.WriteByte('d')
+		for _, k := range keys {
+			ev := v.MapIndex(k)
+			if isNil(ev) {
+				continue
+			}
+			writeString(b, k.String())
+			err := encode(b, ev)
+			if err != nil {
+				return err
+			}
+		}
+		b.WriteByte('e')
+	case reflect.Struct:
+		b.WriteByte('d')
+		for _, f := range fields(v.Type()) {
+			fv := v.Field(f.index)
+			if isNil(fv) || (f.omitEmpty && isEmpty(fv)) {
+				continue
+			}
+			writeString(b, f.key)
+			err := encode(b, fv)
+			if err != nil {
+				return err
+			}
+		}
+		b.WriteByte('e')
+	default:
+		return &UnsupportedTypeError{v.Type()}
+	}
+	return nil
+}
+
+//isNil tells if v is a nil pointer or interface, or an interface holding a nil pointer, which are left out of dictionaries
+func isNil(v reflect.Value) bool {
+	if v.Kind() == reflect.Interface && !v.IsNil() {
+		v = v.Elem()
+	}
+	return (v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface) && v.IsNil()
+}
+
+func writeString(b *bytes.Buffer, s string) {
+	b.WriteString(strconv.Itoa(len(s)))
+	b.WriteByte(':')
+	b.WriteString(s)
+}
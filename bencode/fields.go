@@ -0,0 +1,74 @@
+package bencode
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type field struct {
+	key       string
+	index     int
+	omitEmpty bool
+}
+
+var fieldCache sync.Map // map[reflect.Type][]field
+
+//fields returns the encoded fields of a struct type sorted by key, as they are written
+func fields(t reflect.Type) []field {
+	if f, ok := fieldCache.Load(t); ok {
+		return f.([]field)
+	}
+	var res []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue // unexported
+		}
+		tag := sf.Tag.Get("bencode")
+		if tag == "-" {
+			continue
+		}
+		f := field{key: sf.Name, index: i}
+		parts := strings.Split(tag, ",")
+		if parts[0] != "" {
+			f.key = parts[0]
+		}
+		for _, opt := range parts[1:] {
+			if opt == "omitempty" {
+				f.omitEmpty = true
+			}
+		}
+		res = append(res, f)
+	}
+	sort.SliceStable(res, func(i, j int) bool { return res[i].key < res[j].key })
+	fieldCache.Store(t, res)
+	return res
+}
+
+//fieldByKey finds the field of a struct type a dictionary key is decoded into
+func fieldByKey(t reflect.Type, key string) (field, bool) {
+	fs := fields(t)
+	i := sort.Search(len(fs), func(i int) bool { return fs[i].key >= key })
+	if i < len(fs) && fs[i].key == key {
+		return fs[i], true
+	}
+	return field{}, false
+}
+
+func isEmpty(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	}
+	return false
+}
@@ -0,0 +1,116 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package commands
+
+import (
+	"context"
+	file "github.com/adityameharia/gotor/file"
+	webseed "github.com/adityameharia/gotor/webseed"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// httpSeedCmd serves the content of a torrent as a BEP 17 HTTP seed
+var httpSeedCmd = &cobra.Command{
+	Use:   "httpseed <torrent> <path>",
+	Short: "Serve the pieces of a torrent to clients supporting httpseeds",
+	Long: `Serve the pieces of a torrent over HTTP, the way the seed scripts listed in the httpseeds key
+of a torrent do (BEP 17). path is the downloaded file, or the directory of a multi file torrent.
+Add the URL of this server to the httpseeds of the torrent for clients to use it.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		serveHTTPSeed(args[0], args[1])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(httpSeedCmd)
+
+	httpSeedCmd.Flags().String("listen", ":8080", "address to serve on")
+	httpSeedCmd.Flags().Int("max-requests", 16, "number of requests served at once, 0 for no limit")
+	httpSeedCmd.Flags().Duration("retry-after", webseed.DefaultRetryAfter, "how long busy clients are told to wait")
+	viper.BindPFlag("httpseed.listen", httpSeedCmd.Flags().Lookup("listen"))
+	viper.BindPFlag("httpseed.max-requests", httpSeedCmd.Flags().Lookup("max-requests"))
+	viper.BindPFlag("httpseed.retry-after", httpSeedCmd.Flags().Lookup("retry-after"))
+}
+
+func serveHTTPSeed(path string, content string) {
+	f, err := file.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if f.PiecesV2 != nil {
+		// BEP 17 seeds serve the pieces of the v1 swarm
+		log.Fatal("HTTP seeding is not supported for v2 only torrents")
+	}
+	logger, err := newLogger()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var data io.ReaderAt
+	if len(f.Files) == 0 {
+		osf, err := os.Open(content)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer osf.Close()
+		data = osf
+	} else {
+		files := make([]webseed.File, len(f.Files))
+		for i, tf := range f.Files {
+			files[i] = webseed.File{Path: webseed.Path(tf.Path), Length: int64(tf.Length), Padding: tf.Padding}
+		}
+		fs, err := webseed.OpenFiles(content, files)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fs.Close()
+		data = fs
+	}
+
+	h := &webseed.Handler{
+		MaxRequests: viper.GetInt("httpseed.max-requests"),
+		RetryAfter:  viper.GetDuration("httpseed.retry-after"),
+	}
+	h.Add(f.InfoHash, f.PieceLength, int64(f.Length), data)
+	srv := &http.Server{Addr: viper.GetString("httpseed.listen"), Handler: h}
+
+	// Shut down cleanly on Ctrl+C
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	}()
+
+	logger.Infof("Serving %s (%x) on %s", f.Name, f.InfoHash, srv.Addr)
+	err = srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,48 @@
+package commands
+
+import (
+	peer "github.com/adityameharia/gotor/peer"
+	ratelimit "github.com/adityameharia/gotor/ratelimit"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// rate limit settings, all in bytes per second where 0 means unlimited
+const (
+	downloadRateKey        = "download-rate"
+	uploadRateKey          = "upload-rate"
+	torrentDownloadRateKey = "torrent-download-rate"
+	torrentUploadRateKey   = "torrent-upload-rate"
+	peerDownloadRateKey    = "peer-download-rate"
+	peerUploadRateKey      = "peer-upload-rate"
+)
+
+// newLimits creates the rate limiters configured through flags and the config file.
+// When a config file is used, changing it adjusts the rates of the running download.
+func newLimits() peer.Limits {
+	l := peer.Limits{
+		GlobalDownload: ratelimit.New(0),
+		GlobalUpload:   ratelimit.New(0),
+		Download:       ratelimit.New(0),
+		Upload:         ratelimit.New(0),
+		PeerDownload:   ratelimit.New(0),
+		PeerUpload:     ratelimit.New(0),
+	}
+	applyLimits(l)
+
+	if viper.ConfigFileUsed() != "" {
+		viper.OnConfigChange(func(fsnotify.Event) { applyLimits(l) })
+		viper.WatchConfig()
+	}
+	return l
+}
+
+// applyLimits sets the rates of l from the current configuration
+func applyLimits(l peer.Limits) {
+	l.GlobalDownload.SetRate(viper.GetInt(downloadRateKey))
+	l.GlobalUpload.SetRate(viper.GetInt(uploadRateKey))
+	l.Download.SetRate(viper.GetInt(torrentDownloadRateKey))
+	l.Upload.SetRate(viper.GetInt(torrentUploadRateKey))
+	l.PeerDownload.SetRate(viper.GetInt(peerDownloadRateKey))
+	l.PeerUpload.SetRate(viper.GetInt(peerUploadRateKey))
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"os"
 
+	logger "github.com/adityameharia/gotor/logger"
 	"github.com/spf13/cobra"
 
 	homedir "github.com/mitchellh/go-homedir"
@@ -56,6 +57,10 @@ func init() {
 	// will be global for your application.
 
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.gotor.yaml)")
+	rootCmd.PersistentFlags().String("log-level", "warn", "log level: debug, info, warn or error")
+	rootCmd.PersistentFlags().String("log-format", "text", "log format: text or json")
+	viper.BindPFlag("log-level", rootCmd.PersistentFlags().Lookup("log-level"))
+	viper.BindPFlag("log-format", rootCmd.PersistentFlags().Lookup("log-format"))
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
@@ -84,3 +89,16 @@ func initConfig() {
 		fmt.Fprintln(os.Stderr, "Using config file:", viper.ConfigFileUsed())
 	}
 }
+
+// newLogger creates the logger configured by --log-level and --log-format, writing to stderr
+func newLogger() (*logger.Logger, error) {
+	level, err := logger.ParseLevel(viper.GetString("log-level"))
+	if err != nil {
+		return nil, err
+	}
+	format, err := logger.ParseFormat(viper.GetString("log-format"))
+	if err != nil {
+		return nil, err
+	}
+	return logger.New(os.Stderr, level, format), nil
+}
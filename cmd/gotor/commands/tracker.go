@@ -0,0 +1,156 @@
+/*
+Copyright © 2021 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package commands
+
+import (
+	"context"
+	file "github.com/adityameharia/gotor/file"
+	tracker "github.com/adityameharia/gotor/tracker"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// trackerCmd runs a BitTorrent tracker
+var trackerCmd = &cobra.Command{
+	Use:   "tracker [torrent...]",
+	Short: "Run a BitTorrent tracker over HTTP and UDP",
+	Long: `Run a BitTorrent tracker answering announces and scrapes over HTTP, on the /announce and /scrape paths,
+and over the UDP tracker protocol. Swarms are kept in memory.
+If torrents or an allow-list file are given only those torrents are tracked, otherwise every torrent announced is.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		runTracker(args)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(trackerCmd)
+
+	trackerCmd.Flags().String("listen", ":6969", "address to serve HTTP on, empty to disable")
+	trackerCmd.Flags().String("udp", ":6969", "address to serve the UDP tracker protocol on, empty to disable")
+	trackerCmd.Flags().Duration("interval", tracker.DefaultInterval, "announce interval told to clients")
+	trackerCmd.Flags().Duration("peer-ttl", 0, "how long peers are kept after their last announce, twice the interval if 0")
+	trackerCmd.Flags().String("allow", "", "file of hex encoded infohashes to track, one per line")
+	viper.BindPFlag("tracker.listen", trackerCmd.Flags().Lookup("listen"))
+	viper.BindPFlag("tracker.udp", trackerCmd.Flags().Lookup("udp"))
+	viper.BindPFlag("tracker.interval", trackerCmd.Flags().Lookup("interval"))
+	viper.BindPFlag("tracker.peer-ttl", trackerCmd.Flags().Lookup("peer-ttl"))
+	viper.BindPFlag("tracker.allow", trackerCmd.Flags().Lookup("allow"))
+}
+
+func runTracker(torrents []string) {
+	logger, err := newLogger()
+	if err != nil {
+		log.Fatal(err)
+	}
+	tr := &tracker.Tracker{
+		Interval: viper.GetDuration("tracker.interval"),
+		PeerTTL:  viper.GetDuration("tracker.peer-ttl"),
+		Logger:   logger,
+	}
+
+	if path := viper.GetString("tracker.allow"); path != "" {
+		tr.AllowList, err = tracker.LoadAllowList(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(torrents) > 0 && tr.AllowList == nil {
+		tr.AllowList = tracker.NewAllowList()
+	}
+	for _, path := range torrents {
+		f, err := file.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// hybrid torrents are announced in their v2 swarm too
+		tr.AllowList.Add(f.InfoHashes()...)
+		logger.Infof("Tracking %s (%x)", f.Name, f.InfoHash)
+	}
+
+	httpAddr, udpAddr := viper.GetString("tracker.listen"), viper.GetString("tracker.udp")
+	if httpAddr == "" && udpAddr == "" {
+		log.Fatal("Nothing to serve, both --listen and --udp are empty")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errc := make(chan error, 2)
+
+	var srv *http.Server
+	if httpAddr != "" {
+		srv = &http.Server{Addr: httpAddr, Handler: tr}
+		go func() {
+			errc <- srv.ListenAndServe()
+		}()
+		logger.Infof("Serving HTTP announces on %s", httpAddr)
+	}
+	if udpAddr != "" {
+		pc, err := net.ListenPacket("udp", udpAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer pc.Close()
+		go func() {
+			err := tr.ServeUDP(pc)
+			if ctx.Err() == nil {
+				errc <- err
+			}
+		}()
+		logger.Infof("Serving UDP announces on %s", pc.LocalAddr())
+	}
+
+	// Forget the peers which stopped announcing
+	prune := tr.Interval
+	if prune <= 0 {
+		prune = tracker.DefaultInterval
+	}
+	go func() {
+		ticker := time.NewTicker(prune)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				tr.Prune()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Shut down cleanly on Ctrl+C
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	select {
+	case <-sig:
+	case err = <-errc:
+		log.Fatal(err)
+	}
+	cancel()
+	if srv != nil {
+		shutdownCtx, stop := context.WithTimeout(context.Background(), 5*time.Second)
+		defer stop()
+		srv.Shutdown(shutdownCtx)
+	}
+}
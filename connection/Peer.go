@@ -2,38 +2,152 @@ package connection
 
 import (
 	message "github.com/adityameharia/gotor/message"
+	"time"
 )
 
 // SendUnchoke sends an Unchoke message to the peer
 func (c *Client) SendUnchoke() error {
-	msg := message.Message{ID: message.Unchoke}
-	_, err := c.Conn.Write(msg.Serialize())
+	err := c.send(outgoing{msg: message.Message{ID: message.Unchoke}})
+	if err == nil {
+		c.mu.Lock()
+		c.amChoking = false
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// SendChoke sends a Choke message to the peer
+func (c *Client) SendChoke() error {
+	err := c.send(outgoing{msg: message.Message{ID: message.Choke}})
+	if err == nil {
+		c.mu.Lock()
+		c.amChoking = true
+		c.mu.Unlock()
+	}
 	return err
 }
 
 // SendInterested sends an Interested message to the peer
 func (c *Client) SendInterested() error {
-	msg := message.Message{ID: message.Interested}
-	_, err := c.Conn.Write(msg.Serialize())
+	err := c.send(outgoing{msg: message.Message{ID: message.Interested}})
+	if err == nil {
+		c.mu.Lock()
+		c.amInterested = true
+		c.mu.Unlock()
+	}
 	return err
 }
 
-// SendRequest sends a Request message to the peer
-func (c *Client) SendRequest(index, begin, length int) error {
-	req := message.FormatRequest(index, begin, length)
-	_, err := c.Conn.Write(req.Serialize())
+// SendNotInterested sends a NotInterested message to the peer
+func (c *Client) SendNotInterested() error {
+	err := c.send(outgoing{msg: message.Message{ID: message.NotInterested}})
+	if err == nil {
+		c.mu.Lock()
+		c.amInterested = false
+		c.mu.Unlock()
+	}
 	return err
 }
 
-//ReadMessageFromPeer read the peers response after handshake,i.e interprets have,choked,unchoked,and Piece messages
-func (c *Client) ReadMessageFromPeer() (*message.Message, error) {
-	msg, err := message.Read(c.Conn)
-	return msg, err
+// SendRequest sends a Request message to the peer
+func (c *Client) SendRequest(index, begin, length int) error {
+	return c.send(outgoing{msg: message.Message{ID: message.Request}, index: index, begin: begin, length: length})
 }
 
 // SendHave sends a Have message to the peer
 func (c *Client) SendHave(index int) error {
-	msg := message.FormatHave(index)
-	_, err := c.Conn.Write(msg.Serialize())
+	return c.send(outgoing{msg: message.Message{ID: message.Have}, index: index})
+}
+
+// SendBitfield tells the peer which pieces we have, which must be done before sending anything else
+func (c *Client) SendBitfield(bf Bitfield) error {
+	return c.send(outgoing{msg: message.Message{ID: message.Bitfield, Payload: bf}})
+}
+
+// SendPiece sends a block of a piece the peer requested
+func (c *Client) SendPiece(index, begin int, block []byte) error {
+	err := c.send(outgoing{msg: *message.FormatPiece(index, begin, block)})
+	if err == nil {
+		c.mu.Lock()
+		c.lastPiece = time.Now()
+		c.mu.Unlock()
+	}
 	return err
 }
+
+// SendHashRequest asks the peer for the hashes of a merkle tree described by h (BEP 52)
+func (c *Client) SendHashRequest(h message.HashSpec) error {
+	return c.send(outgoing{msg: *message.FormatHashRequest(h)})
+}
+
+// SendHashReject refuses the hash request h of the peer
+func (c *Client) SendHashReject(h message.HashSpec) error {
+	return c.send(outgoing{msg: *message.FormatHashReject(h)})
+}
+
+// SupportsV2 tells if both sides announced BitTorrent v2 support in the handshake, which requires the WithV2 option
+func (c *Client) SupportsV2() bool {
+	return c.v2
+}
+
+// RemoteID returns the peer ID the peer sent in its handshake
+func (c *Client) RemoteID() []byte {
+	return c.remoteID
+}
+
+// SetBlockFunc sets where the data of the Piece messages of the peer goes, see message.Reader.
+// The reader goroutine calls f, which must be safe to call concurrently with the goroutine setting it.
+func (c *Client) SetBlockFunc(f message.BlockFunc) {
+	c.mu.Lock()
+	c.block = f
+	c.mu.Unlock()
+}
+
+// HasPiece tells if the peer has told us it has a piece, with its Bitfield or a Have message
+func (c *Client) HasPiece(index int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bitfield.CheckPiece(index)
+}
+
+// Bitfield returns a copy of the pieces the peer has told us it has
+func (c *Client) Bitfield() Bitfield {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append(Bitfield(nil), c.bitfield...)
+}
+
+// AmChoking tells if we are choking the peer, which is the case until SendUnchoke is called
+func (c *Client) AmChoking() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.amChoking
+}
+
+// AmInterested tells if we have told the peer we are interested in its pieces
+func (c *Client) AmInterested() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.amInterested
+}
+
+// PeerChoking tells if the peer is choking us, which is the case until it sends Unchoke
+func (c *Client) PeerChoking() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerChoking
+}
+
+// PeerInterested tells if the peer has told us it is interested in our pieces
+func (c *Client) PeerInterested() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peerInterested
+}
+
+// LastPiece returns when a block was last received from or sent to the peer, or when the connection was made if none was
+func (c *Client) LastPiece() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lastPiece
+}
@@ -1,11 +1,18 @@
 package connection
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	message "github.com/adityameharia/gotor/message"
+	mse "github.com/adityameharia/gotor/mse"
+	proxy "github.com/adityameharia/gotor/proxy"
+	ratelimit "github.com/adityameharia/gotor/ratelimit"
 	"io"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -16,21 +23,59 @@ type peer struct {
 
 type handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   []byte
 }
 
+//reservedV2 is the bit of the reserved bytes of the handshake telling that the client supports BitTorrent v2 (BEP 52)
+const reservedV2 = 0x10
+
+// ErrBlocked is returned by New when the address of the peer is blocked by the IP filter
+var ErrBlocked = errors.New("Address blocked by IP filter")
+
 //Bitfield is byte array which stores the index of the parts available with a particular client
 type Bitfield []byte
 
-// A Client is a TCP connection with a peer
+// A Client is a TCP connection with a peer.
+// Once connected, a reader goroutine reads the messages of the peer and delivers them as Events,
+// and a writer goroutine writes the messages queued by the Send methods, which are safe to call concurrently.
 type Client struct {
 	Conn     net.Conn
-	Choked   bool
-	Bitfield Bitfield
 	peer     string
 	infoHash [20]byte
 	peerID   []byte
+	remoteID []byte
+	v2       bool
+	// numPieces sizes the largest Bitfield the peer may send
+	numPieces int
+	// keepAlive and idle are the timeouts of the writer and reader goroutines, see WithKeepAlive and WithIdleTimeout
+	keepAlive time.Duration
+	idle      time.Duration
+	done      chan struct{}
+	once      sync.Once
+	stats     *countingConn
+
+	// r, received and blockFn belong to the reader goroutine
+	r        *message.Reader
+	received int
+	blockFn  message.BlockFunc
+	events   chan Event
+
+	// w belongs to the writer goroutine, which takes the messages from queue
+	w     *message.Writer
+	queue chan outgoing
+
+	// mu guards the fields below
+	mu             sync.Mutex
+	err            error
+	block          message.BlockFunc
+	lastPiece      time.Time
+	bitfield       Bitfield
+	amChoking      bool
+	amInterested   bool
+	peerChoking    bool
+	peerInterested bool
 }
 
 // CheckPiece tells if a bitfield has a particular index set
@@ -57,40 +102,236 @@ func (bf Bitfield) PutPiece(index int) {
 
 // New connects with a peer, completes a handshake, and receives a handshake
 // returns an err if any of those fail.
-func New(peer string, pid []byte, infoHash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer, 3*time.Second)
+// The connection is closed as soon as ctx is cancelled.
+func New(ctx context.Context, peer string, pid []byte, infoHash [20]byte, opts ...Option) (*Client, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	if o.filter != nil {
+		host, _, err := net.SplitHostPort(peer)
+		if err != nil {
+			return nil, err
+		}
+		if o.filter.Blocked(net.ParseIP(host)) {
+			return nil, fmt.Errorf("%w: %s", ErrBlocked, peer)
+		}
+	}
+
+	conn, stats, err := o.dial(ctx, peer)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
-	_, err = peerHandshake(conn, infoHash, pid)
+	if o.encryption != mse.Disable {
+		ec, err := encrypt(conn, infoHash, o.encryption)
+		switch {
+		case err == nil:
+			conn = ec
+		case o.encryption == mse.Prefer && ctx.Err() == nil:
+			// the peer most likely doesn't support encryption, try again in plaintext
+			conn.Close()
+			conn, stats, err = o.dial(ctx, peer)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	c := newClient(ctx, conn, stats, peer, pid, infoHash, &o)
+
+	res, err := peerHandshake(conn, infoHash, pid, o.reserved())
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.v2 = o.v2 && res.Reserved[7]&reservedV2 != 0
+	c.remoteID = res.PeerID
+
+	bitf, err := manipulateBitfield(conn, o.numPieces)
+
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	c.bitfield = bitf
+	c.start()
+
+	return c, nil
+}
+
+// Accept completes the handshake of a connection made to us by a peer, for one of the torrents in infoHashes.
+// Encrypted and plaintext handshakes are both recognized and accepted according to the encryption policy.
+// Unlike New, Accept does not wait for the bitfield of the peer.
+func Accept(ctx context.Context, conn net.Conn, pid []byte, infoHashes [][20]byte, opts ...Option) (*Client, error) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	peer := conn.RemoteAddr().String()
+	if ip := remoteIP(conn); ip != nil && o.filter.Blocked(ip) {
+		conn.Close()
+		return nil, fmt.Errorf("%w: %s", ErrBlocked, peer)
+	}
+
+	stats := &countingConn{Conn: conn}
+	conn = ratelimit.Conn(stats, o.download, o.upload)
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	br := bufio.NewReader(conn)
+	first, err := br.Peek(20)
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
+	conn = &peekedConn{Conn: conn, r: br}
 
-	bitf, err := manipulateBitfield(conn)
+	if mse.IsPlaintext(first) {
+		if o.encryption == mse.Require {
+			conn.Close()
+			return nil, mse.ErrPlaintextRefused
+		}
+	} else {
+		mc, skey, err := mse.Receive(conn, infoHashes, o.encryption)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = mc
+		infoHashes = [][20]byte{skey}
+	}
 
+	res, err := receiveHandshake(conn, infoHashes, pid, o.reserved())
 	if err != nil {
 		conn.Close()
 		return nil, err
 	}
+	conn.SetDeadline(time.Time{})
 
-	return &Client{
-		Conn:     conn,
-		Choked:   true,
-		Bitfield: bitf,
-		peer:     peer,
-		infoHash: infoHash,
-		peerID:   pid,
-	}, nil
+	c := newClient(ctx, conn, stats, peer, pid, res.InfoHash, &o)
+	c.v2 = o.v2 && res.Reserved[7]&reservedV2 != 0
+	c.remoteID = res.PeerID
+	c.start()
+	return c, nil
+}
+
+//remoteIP returns the address of the peer on a TCP or uTP connection
+func remoteIP(conn net.Conn) net.IP {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	}
+	return nil
+}
+
+//dial connects to peer, over uTP if enabled and TCP otherwise, and wraps the connection for counting and rate limiting
+func (o *options) dial(ctx context.Context, peer string) (net.Conn, *countingConn, error) {
+	var conn net.Conn
+	var err error
+	if o.utp != nil {
+		conn, err = o.dialUTP(ctx, peer)
+	}
+	if o.utp == nil || (err != nil && ctx.Err() == nil) {
+		conn, err = o.dialTCP(ctx, peer)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	stats := &countingConn{Conn: conn}
+	return ratelimit.Conn(stats, o.download, o.upload), stats, nil
+}
+
+//dialUTP connects to peer over uTP, giving up after two SYNs go unanswered
+func (o *options) dialUTP(ctx context.Context, peer string) (net.Conn, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	c, err := o.utp.Dial(dialCtx, peer)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (o *options) dialTCP(ctx context.Context, peer string) (net.Conn, error) {
+	d := o.dialer
+	if d == nil {
+		d = proxy.Direct
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+	return d.DialContext(dialCtx, "tcp", peer)
 }
 
-func peerHandshake(conn net.Conn, infohash [20]byte, Pid []byte) (*handshake, error) {
+//encrypt runs the MSE handshake on a new connection
+func encrypt(conn net.Conn, infoHash [20]byte, policy mse.Policy) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+	return mse.Initiate(conn, infoHash, policy)
+}
+
+//newClient creates the client for a connection which has just been made and closes it once ctx is cancelled.
+//The messages of the peer are read through a buffer, so nothing but the client must read from conn once the handshake is done.
+func newClient(ctx context.Context, conn net.Conn, stats *countingConn, peer string, pid []byte, infoHash [20]byte, o *options) *Client {
+	c := &Client{
+		Conn:        conn,
+		peer:        peer,
+		infoHash:    infoHash,
+		peerID:      pid,
+		numPieces:   o.numPieces,
+		keepAlive:   o.keepAlive,
+		idle:        o.idle,
+		done:        make(chan struct{}),
+		stats:       stats,
+		r:           message.NewReader(conn, o.numPieces),
+		events:      make(chan Event, eventBacklog),
+		w:           message.NewWriter(conn),
+		queue:       make(chan outgoing, queueLength),
+		lastPiece:   time.Now(),
+		amChoking:   true,
+		peerChoking: true,
+	}
+	if c.keepAlive <= 0 {
+		c.keepAlive = DefaultKeepAlive
+	}
+	if c.idle <= 0 {
+		c.idle = DefaultIdleTimeout
+	}
+	go c.closeOnDone(ctx)
+	return c
+}
+
+// Close closes the connection with the peer, dropping the messages which were not flushed yet.
+// It is safe to call Close more than once.
+func (c *Client) Close() error {
+	var err error
+	c.once.Do(func() {
+		close(c.done)
+		err = c.Conn.Close()
+	})
+	return err
+}
+
+//closeOnDone closes the connection when ctx is cancelled so that any blocked read or write returns
+func (c *Client) closeOnDone(ctx context.Context) {
+	select {
+	case <-ctx.Done():
+		c.Conn.Close()
+	case <-c.done:
+	}
+}
+
+func peerHandshake(conn net.Conn, infohash [20]byte, Pid []byte, reserved [8]byte) (*handshake, error) {
 	conn.SetDeadline(time.Now().Add(3 * time.Second))
 	defer conn.SetDeadline(time.Time{})
 	req := handshake{
 		Pstr:     "BitTorrent protocol",
+		Reserved: reserved,
 		InfoHash: infohash,
 		PeerID:   Pid,
 	}
@@ -110,12 +351,54 @@ func peerHandshake(conn net.Conn, infohash [20]byte, Pid []byte) (*handshake, er
 	return res, nil
 }
 
+//receiveHandshake reads the handshake of a peer which connected to us and answers it if it is for one of infoHashes
+func receiveHandshake(conn net.Conn, infoHashes [][20]byte, Pid []byte, reserved [8]byte) (*handshake, error) {
+	var h handshake
+	res, err := h.Read(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	known := false
+	for _, ih := range infoHashes {
+		if ih == res.InfoHash {
+			known = true
+			break
+		}
+	}
+	if !known {
+		return nil, fmt.Errorf("Peer asked for unknown infohash %x", res.InfoHash)
+	}
+
+	req := handshake{
+		Pstr:     "BitTorrent protocol",
+		Reserved: reserved,
+		InfoHash: res.InfoHash,
+		PeerID:   Pid,
+	}
+	_, err = conn.Write(req.Serialize())
+	if err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+//peekedConn is a connection whose first bytes were peeked at through a bufio.Reader
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
 func (h *handshake) Serialize() []byte {
 	buf := make([]byte, len(h.Pstr)+49)
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8)) // 8 reserved bytes
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
@@ -141,27 +424,30 @@ func (h *handshake) Read(r io.Reader) (*handshake, error) {
 		return nil, err
 	}
 
+	var reserved [8]byte
 	var infoHash [20]byte
-	var peerID []byte
 
+	copy(reserved[:], buffer[resLen:resLen+8])
 	copy(infoHash[:], buffer[resLen+8:resLen+8+20])
-	copy(peerID[:], buffer[resLen+8+20:])
+	peerID := append([]byte(nil), buffer[resLen+8+20:]...)
 
 	return &handshake{
 		Pstr:     string(buffer[0:resLen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}, nil
 
 }
 
-func manipulateBitfield(c net.Conn) (Bitfield, error) {
+//manipulateBitfield reads the Bitfield the peer must send first, which must have a bit for each of numPieces pieces if it is known
+func manipulateBitfield(c net.Conn, numPieces int) (Bitfield, error) {
 	c.SetDeadline(time.Now().Add(5 * time.Second))
 
 	//we disbale the deadline if we get a valid resp
 	defer c.SetDeadline(time.Time{})
 
-	msg, err := message.Read(c)
+	msg, err := message.ReadLimit(c, numPieces)
 
 	if err != nil {
 		return nil, err
@@ -175,6 +461,10 @@ func manipulateBitfield(c net.Conn) (Bitfield, error) {
 		err := fmt.Errorf("Expected bitfield but got ID %d", msg.ID)
 		return nil, err
 	}
+	if numPieces > 0 && len(msg.Payload) != (numPieces+7)/8 {
+		err := fmt.Errorf("Expected bitfield of %d bytes but got %d", (numPieces+7)/8, len(msg.Payload))
+		return nil, err
+	}
 
 	return msg.Payload, nil
 }
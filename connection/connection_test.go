@@ -0,0 +1,87 @@
+package connection
+
+import (
+	"bytes"
+	"context"
+	mse "github.com/adityameharia/gotor/mse"
+	"net"
+	"testing"
+	"time"
+)
+
+//encrypted tells if the messages over c are RC4 encrypted
+func encrypted(c *Client) bool {
+	mc, ok := c.Conn.(*mse.Conn)
+	return ok && mc.Encrypted()
+}
+
+func TestAcceptEncryption(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	other := [20]byte{4, 5, 6}
+	tests := []struct {
+		client, server mse.Policy
+		ok, encrypted  bool
+	}{
+		{mse.Require, mse.Require, true, true},
+		{mse.Require, mse.Prefer, true, true},
+		{mse.Prefer, mse.Require, true, true},
+		{mse.Prefer, mse.Prefer, true, true},
+		{mse.Prefer, mse.Disable, true, false},
+		{mse.Disable, mse.Prefer, true, false},
+		{mse.Disable, mse.Disable, true, false},
+		{mse.Require, mse.Disable, false, false},
+		{mse.Disable, mse.Require, false, false},
+	}
+	for _, tt := range tests {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+
+		accepted := make(chan *Client, 1)
+		go func(server mse.Policy) {
+			// a client preferring encryption connects again in plaintext when refused
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					close(accepted)
+					return
+				}
+				c, err := Accept(ctx, conn, []byte("-SV0001-000000000000"), [][20]byte{other, infoHash},
+					WithEncryption(server), WithPieces(8))
+				if err != nil {
+					continue
+				}
+				c.SendBitfield(Bitfield{0xf0})
+				accepted <- c
+				return
+			}
+		}(tt.server)
+
+		c, err := New(ctx, l.Addr().String(), []byte("-CL0001-000000000000"), infoHash,
+			WithEncryption(tt.client), WithPieces(8))
+		if (err == nil) != tt.ok {
+			t.Errorf("Client %v, server %v: got error %v, want success %v", tt.client, tt.server, err, tt.ok)
+		}
+		if err == nil {
+			s := <-accepted
+			if s.infoHash != infoHash {
+				t.Errorf("Client %v, server %v: accepted for infohash %x", tt.client, tt.server, s.infoHash)
+			}
+			if encrypted(c) != tt.encrypted || encrypted(s) != tt.encrypted {
+				t.Errorf("Client %v, server %v: got encrypted %v and %v, want %v", tt.client, tt.server, encrypted(c), encrypted(s), tt.encrypted)
+			}
+			if !bytes.Equal(c.Bitfield(), Bitfield{0xf0}) {
+				t.Errorf("Client %v, server %v: got bitfield %x", tt.client, tt.server, c.Bitfield())
+			}
+			if !bytes.Equal(c.RemoteID(), []byte("-SV0001-000000000000")) || !bytes.Equal(s.RemoteID(), []byte("-CL0001-000000000000")) {
+				t.Errorf("Client %v, server %v: got peer IDs %q and %q", tt.client, tt.server, c.RemoteID(), s.RemoteID())
+			}
+			c.Close()
+			s.Close()
+		}
+		cancel()
+		l.Close()
+	}
+}
@@ -0,0 +1,42 @@
+package connection
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+)
+
+//maxHandshakeAlloc is how many bytes reading a handshake may allocate, the longest being 49+255 bytes
+const maxHandshakeAlloc = 2048
+
+func FuzzHandshakeRead(f *testing.F) {
+	h := handshake{Pstr: "BitTorrent protocol", Reserved: [8]byte{5: reservedV2}, InfoHash: [20]byte{1, 2, 3}, PeerID: []byte("-GT0001-abcdefghijkl")}
+	valid := h.Serialize()
+	f.Add(valid)
+	f.Add(valid[:30])
+	f.Add([]byte{0})
+	f.Add([]byte{255})
+	f.Add(append([]byte{255}, bytes.Repeat([]byte{'a'}, 303)...))
+	f.Add(append(valid, valid...))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var h handshake
+		var res *handshake
+		var err error
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		res, err = h.Read(bytes.NewReader(data))
+		runtime.ReadMemStats(&after)
+		if n := after.TotalAlloc - before.TotalAlloc; n > maxHandshakeAlloc {
+			t.Fatalf("Reading a handshake allocated %d bytes, more than %d", n, maxHandshakeAlloc)
+		}
+		if err != nil {
+			return
+		}
+		// a handshake read is serialized back to the bytes it was read from
+		n := 49 + len(res.Pstr)
+		if len(res.Pstr) == 0 || len(res.PeerID) != 20 || !bytes.Equal(res.Serialize(), data[:n]) {
+			t.Fatalf("Read handshake %+v from %x", res, data[:n])
+		}
+	})
+}
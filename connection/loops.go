@@ -0,0 +1,262 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	message "github.com/adityameharia/gotor/message"
+	"net"
+	"time"
+)
+
+// FlushInterval is how long the messages sent to a peer are held, so that the ones sent meanwhile are written along with them
+const FlushInterval = 2 * time.Millisecond
+
+// DefaultKeepAlive is how long a connection goes without sending anything before a keep-alive is sent,
+// well within the two minutes after which peers usually drop silent connections
+const DefaultKeepAlive = time.Minute
+
+// DefaultIdleTimeout is how long a peer may send nothing before its connection is closed.
+// It must exceed the two minutes peers usually wait before sending a keep-alive, or idle but healthy peers would be dropped.
+const DefaultIdleTimeout = 3 * time.Minute
+
+// ErrClosed is returned when sending to a peer whose connection is closed
+var ErrClosed = errors.New("Connection closed")
+
+// ErrIdle breaks the connection of a peer which sent nothing, not even a keep-alive, for longer than the idle timeout
+var ErrIdle = errors.New("Peer sent nothing before the idle timeout")
+
+const (
+	//queueLength is the number of messages which can wait for the writer goroutine before sending blocks
+	queueLength = 256
+	//eventBacklog is the number of events which can wait to be handled before the reader goroutine stops reading
+	eventBacklog = 64
+)
+
+// Event is a message of the peer, delivered by the reader goroutine in the order the peer sent them
+type Event struct {
+	// Message is the message, nil for a keep-alive. Its payload belongs to the receiver, who may keep it
+	// or give it back with Release, and is without the data of a Piece message which went where the BlockFunc of the client said.
+	Message *message.Message
+	// Received is the length of the data of a Piece message which went where the BlockFunc said, -1 if it didn't
+	Received int
+	// Err is set on the last event, once the connection is broken
+	Err error
+}
+
+// Release gives back the payload of the message of the event to be reused for the next messages.
+// The message must not be used anymore.
+func (ev Event) Release() {
+	if ev.Message != nil {
+		message.Free(ev.Message.Payload)
+		ev.Message.Payload = nil
+	}
+}
+
+//outgoing is a message waiting for the writer goroutine.
+//Requests and Haves have no payload but their index, begin and length, so that sending them doesn't allocate.
+type outgoing struct {
+	msg                  message.Message
+	index, begin, length int
+	keepAlive            bool
+}
+
+//start starts the reader and writer goroutines, once the handshake is done
+func (c *Client) start() {
+	c.blockFn = c.blockFor
+	go c.readLoop()
+	go c.writeLoop()
+}
+
+// Events returns the messages of the peer, the channel being closed once the connection is broken, after an event carrying the error if there is room for it.
+// The reader goroutine waits for events to be received, so they must be received for as long as the connection is used.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Err returns the error which broke the connection, nil while it works
+func (c *Client) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+//fail records the error which broke the connection and closes it
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.mu.Unlock()
+	c.Close()
+}
+
+//send queues a message for the writer goroutine
+func (c *Client) send(out outgoing) error {
+	select {
+	case c.queue <- out:
+		return nil
+	case <-c.done:
+		if err := c.Err(); err != nil {
+			return err
+		}
+		return ErrClosed
+	}
+}
+
+//writeLoop writes the queued messages, flushing them FlushInterval after they start queueing up, until the client is closed.
+//A keep-alive is written whenever nothing was written for the keep-alive interval.
+func (c *Client) writeLoop() {
+	timer := time.NewTimer(FlushInterval)
+	timer.Stop()
+	idle := time.NewTimer(c.keepAlive)
+	defer idle.Stop()
+	for {
+		var out outgoing
+		select {
+		case out = <-c.queue:
+		case <-idle.C:
+			out = outgoing{keepAlive: true}
+		case <-c.done:
+			return
+		}
+		err := c.write(out)
+
+		timer.Reset(FlushInterval)
+	batch:
+		for err == nil {
+			select {
+			case out = <-c.queue:
+				err = c.write(out)
+			case <-timer.C:
+				break batch
+			case <-c.done:
+				timer.Stop()
+				return
+			}
+		}
+		if err == nil {
+			err = c.w.Flush()
+		} else {
+			timer.Stop()
+		}
+		if err != nil {
+			c.fail(err)
+			return
+		}
+
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(c.keepAlive)
+	}
+}
+
+func (c *Client) write(out outgoing) error {
+	switch {
+	case out.keepAlive:
+		return c.w.WriteMessage(nil)
+	case out.msg.ID == message.Request && out.msg.Payload == nil:
+		return c.w.WriteRequest(out.index, out.begin, out.length)
+	case out.msg.ID == message.Have && out.msg.Payload == nil:
+		return c.w.WriteHave(out.index)
+	}
+	return c.w.WriteMessage(&out.msg)
+}
+
+//readLoop reads the messages of the peer, keeps track of what they say about it and delivers them as events until the connection breaks
+//or the peer sends nothing for the idle timeout
+func (c *Client) readLoop() {
+	defer close(c.events)
+	for {
+		c.received = -1
+		c.Conn.SetReadDeadline(time.Now().Add(c.idle))
+		msg, err := c.r.ReadPooled(c.blockFn)
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			err = fmt.Errorf("%w (%v)", ErrIdle, c.idle)
+		}
+		if err == nil {
+			err = c.update(msg)
+		}
+		if err != nil {
+			c.fail(err)
+			c.closeEvents()
+			return
+		}
+
+		ev := Event{Message: msg, Received: c.received}
+		select {
+		case c.events <- ev:
+		case <-c.done:
+			ev.Release()
+			c.closeEvents()
+			return
+		}
+	}
+}
+
+//closeEvents delivers the error which broke the connection if there is room for it, the channel being closed anyway.
+//A receiver finding the channel closed without it gets the error from Err.
+func (c *Client) closeEvents() {
+	err := c.Err()
+	if err == nil {
+		err = ErrClosed
+	}
+	select {
+	case c.events <- Event{Received: -1, Err: err}:
+	default:
+	}
+}
+
+//blockFor asks the BlockFunc of the client where the data of a Piece message goes, recording that it went there
+func (c *Client) blockFor(index, begin, length int) []byte {
+	c.mu.Lock()
+	f := c.block
+	c.mu.Unlock()
+	if f == nil {
+		return nil
+	}
+	dst := f(index, begin, length)
+	if dst != nil {
+		c.received = length
+	}
+	return dst
+}
+
+//update records the state of the peer carried by msg
+func (c *Client) update(msg *message.Message) error {
+	if msg == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch msg.ID {
+	case message.Piece:
+		c.lastPiece = time.Now()
+	case message.Choke:
+		c.peerChoking = true
+	case message.Unchoke:
+		c.peerChoking = false
+	case message.Interested:
+		c.peerInterested = true
+	case message.NotInterested:
+		c.peerInterested = false
+	case message.Have:
+		index, err := message.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		if c.bitfield == nil && c.numPieces > 0 {
+			c.bitfield = make(Bitfield, (c.numPieces+7)/8)
+		}
+		c.bitfield.PutPiece(index)
+	case message.Bitfield:
+		if c.numPieces > 0 && len(msg.Payload) != (c.numPieces+7)/8 {
+			return fmt.Errorf("Expected bitfield of %d bytes but got %d", (c.numPieces+7)/8, len(msg.Payload))
+		}
+		c.bitfield = append(Bitfield(nil), msg.Payload...)
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package connection
+
+import (
+	ipfilter "github.com/adityameharia/gotor/ipfilter"
+	mse "github.com/adityameharia/gotor/mse"
+	proxy "github.com/adityameharia/gotor/proxy"
+	ratelimit "github.com/adityameharia/gotor/ratelimit"
+	utp "github.com/adityameharia/gotor/utp"
+	"time"
+)
+
+// Option changes how New connects to a peer
+type Option func(*options)
+
+type options struct {
+	download   []*ratelimit.Limiter
+	upload     []*ratelimit.Limiter
+	filter     *ipfilter.Filter
+	dialer     proxy.Dialer
+	encryption mse.Policy
+	utp        *utp.Socket
+	v2         bool
+	numPieces  int
+	keepAlive  time.Duration
+	idle       time.Duration
+}
+
+// WithRateLimit throttles what we read from the peer with every limiter in download
+// and what we write to the peer with every limiter in upload
+func WithRateLimit(download, upload []*ratelimit.Limiter) Option {
+	return func(o *options) {
+		o.download = append(o.download, download...)
+		o.upload = append(o.upload, upload...)
+	}
+}
+
+// WithIPFilter makes New refuse to dial addresses blocked by f
+func WithIPFilter(f *ipfilter.Filter) Option {
+	return func(o *options) {
+		o.filter = f
+	}
+}
+
+// WithDialer makes New connect through d instead of dialing directly
+func WithDialer(d proxy.Dialer) Option {
+	return func(o *options) {
+		o.dialer = d
+	}
+}
+
+// WithEncryption sets whether the connection uses Message Stream Encryption, mse.Disable being the default
+func WithEncryption(p mse.Policy) Option {
+	return func(o *options) {
+		o.encryption = p
+	}
+}
+
+// WithUTP makes New try uTP over s first, falling back to TCP when the peer doesn't answer
+func WithUTP(s *utp.Socket) Option {
+	return func(o *options) {
+		o.utp = s
+	}
+}
+
+// WithPieces gives the number of pieces of the torrent, so that a Bitfield of any other size is refused
+func WithPieces(n int) Option {
+	return func(o *options) {
+		o.numPieces = n
+	}
+}
+
+// WithV2 tells the peer in the handshake that we support BitTorrent v2 (BEP 52), for connections made with the truncated v2 infohash
+func WithV2() Option {
+	return func(o *options) {
+		o.v2 = true
+	}
+}
+
+// WithKeepAlive sets how long the connection may go without sending anything before a keep-alive is sent, DefaultKeepAlive if 0
+func WithKeepAlive(d time.Duration) Option {
+	return func(o *options) {
+		o.keepAlive = d
+	}
+}
+
+// WithIdleTimeout sets how long the peer may send nothing, not even a keep-alive, before the connection is closed, DefaultIdleTimeout if 0
+func WithIdleTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.idle = d
+	}
+}
+
+//reserved returns the reserved bytes of our handshake
+func (o *options) reserved() [8]byte {
+	var r [8]byte
+	if o.v2 {
+		r[7] |= reservedV2
+	}
+	return r
+}
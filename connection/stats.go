@@ -0,0 +1,45 @@
+package connection
+
+import (
+	utp "github.com/adityameharia/gotor/utp"
+	"net"
+	"sync/atomic"
+)
+
+//countingConn counts the bytes read from and written to a connection
+type countingConn struct {
+	// read and written are accessed atomically and kept first for 64 bit alignment
+	read    int64
+	written int64
+	net.Conn
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.read, int64(n))
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// BytesRead returns the number of bytes received from the peer, including protocol overhead
+func (c *Client) BytesRead() int64 {
+	return atomic.LoadInt64(&c.stats.read)
+}
+
+// BytesWritten returns the number of bytes sent to the peer, including protocol overhead
+func (c *Client) BytesWritten() int64 {
+	return atomic.LoadInt64(&c.stats.written)
+}
+
+// Transport returns "utp" or "tcp", whichever the peer is connected with
+func (c *Client) Transport() string {
+	if _, ok := c.stats.Conn.(*utp.Conn); ok {
+		return "utp"
+	}
+	return "tcp"
+}
@@ -1,14 +1,26 @@
 package file
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"fmt"
+	bencode "github.com/adityameharia/gotor/bencode"
+	ipfilter "github.com/adityameharia/gotor/ipfilter"
+	merkle "github.com/adityameharia/gotor/merkle"
 	peer "github.com/adityameharia/gotor/peer"
+	proxy "github.com/adityameharia/gotor/proxy"
+	"io"
+	"io/ioutil"
+	"net"
 	"os"
-
-	"github.com/jackpal/bencode-go"
+	"path/filepath"
+	"sync"
 )
 
+//Port is the port we accept connections from peers on, unless it is taken
+const Port = 7000
+
 //TorrentFile struct of the torrent file
 type TorrentFile struct {
 	Announce    string
@@ -17,52 +29,146 @@ type TorrentFile struct {
 	PieceLength int
 	Length      int
 	Name        string
+
+	// Files is the layout of a multi file torrent, nil for a single file torrent
+	Files []peer.File
+	// Executable and Hidden are the attributes of the file of a single file torrent (BEP 47)
+	Executable bool
+	Hidden     bool
+	// URLList are the web seeds of the torrent (BEP 19)
+	URLList []string
+	// HTTPSeeds are the seed scripts of the torrent (BEP 17)
+	HTTPSeeds []string
+	// Private torrents (BEP 27) get their peers from their own tracker only
+	Private bool
+	// RawInfo is the info dictionary exactly as it is in the torrent file, InfoHash being its SHA-1
+	RawInfo []byte
+
+	// InfoHashV2 is the SHA-256 of RawInfo for BitTorrent v2 and hybrid torrents (BEP 52), zero for v1 torrents.
+	// A v2 only torrent has no PieceHashes, its InfoHash is the truncated InfoHashV2 and its pieces are verified with PiecesV2.
+	InfoHashV2 [32]byte
+	PiecesV2   []peer.PieceV2
+	// PieceLayers are the piece hashes of the files of a v2 torrent, keyed by their pieces root
+	PieceLayers map[merkle.Hash][]merkle.Hash
 }
 
-//Tracker has the peers string and the time interval after which to send another request
+//Tracker has the peers and the time interval after which to send another request
 type Tracker struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+	FailureReason string `bencode:"failure reason"`
+	Interval      int    `bencode:"interval"`
+	// Peers is a compact string of IPv4 peers (BEP 23) or a list of dictionaries with their ip and port
+	Peers interface{} `bencode:"peers"`
+	// Peers6 is a compact string of IPv6 peers (BEP 7)
+	Peers6 string `bencode:"peers6"`
 }
 
 //Open is used to open the file,unmarshall the contents of the file and convert it to the form of a torrentFile
 func Open(path string) (TorrentFile, error) {
-	f, err := os.Open(path)
+	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return TorrentFile{}, err
 	}
 
-	defer f.Close()
+	// data after the torrent is ignored, as some tools add a newline
 	b := bencodeTorrent{}
-	err = bencode.Unmarshal(f, &b)
+	d := bencode.NewDecoder(bytes.NewReader(data))
+	d.MaxSize = int64(len(data))
+	err = d.Decode(&b)
 	if err != nil {
 		return TorrentFile{}, err
 	}
 	return b.toTorrentFile()
 }
 
-//DownloadFile is used generate a random id for us to be identified with and get a list of all the peer swith their ips and ports
-func (t *TorrentFile) DownloadFile(path string) error {
+//Marshal writes t as a torrent file. The info dictionary is written exactly as it was read, so the infohash
+//stays the same, while of the other keys of the original file only the ones TorrentFile holds are kept.
+func (t *TorrentFile) Marshal(w io.Writer) error {
+	if t.RawInfo == nil {
+		return fmt.Errorf("Torrent File has no info dictionary")
+	}
+
+	b := bencodeTorrent{
+		Announce:    t.Announce,
+		Info:        t.RawInfo,
+		HTTPSeeds:   t.HTTPSeeds,
+		PieceLayers: encodePieceLayers(t.PieceLayers),
+	}
+	if len(t.URLList) > 0 {
+		b.URLList = t.URLList
+	}
+	return bencode.NewEncoder(w).Encode(b)
+}
+
+//NewTorrent is used generate a random id for us to be identified with and build a torrent which gets a list of all the peers with their ips and ports from the tracker every time it starts downloading
+func (t *TorrentFile) NewTorrent() (*peer.Torrent, error) {
 	Pid := make([]byte, 20)
 	_, err := rand.Read(Pid)
 	if err != nil {
-		return err
-	}
-	peers, err := t.requestPeers(Pid, 7000)
-	if err != nil {
-		return err
+		return nil, err
 	}
 
-	fmt.Println(peers)
-
-	torrent := peer.Torrent{
-		Peers:       peers,
+	torrent := &peer.Torrent{
 		PeerID:      Pid,
 		InfoHash:    t.InfoHash,
 		PieceHashes: t.PieceHashes,
 		PieceLength: t.PieceLength,
 		Length:      t.Length,
 		Name:        t.Name,
+		Files:       t.Files,
+		WebSeeds:    t.URLList,
+		HTTPSeeds:   t.HTTPSeeds,
+		Private:     t.Private,
+		InfoHashV2:  t.InfoHashV2,
+		PiecesV2:    t.PiecesV2,
+	}
+	torrent.Announce = func(ctx context.Context) ([]peer.Peer, error) {
+		return t.requestPeers(ctx, torrent.Dialer, t.InfoHash, Pid, announcePort(torrent))
+	}
+	if t.InfoHashV2 != [32]byte{} && t.PiecesV2 == nil {
+		// a hybrid torrent joins the v2 swarm too
+		var ih [20]byte
+		copy(ih[:], t.InfoHashV2[:])
+		torrent.AnnounceV2 = func(ctx context.Context) ([]peer.Peer, error) {
+			return t.requestPeers(ctx, torrent.Dialer, ih, Pid, announcePort(torrent))
+		}
+	}
+	return torrent, nil
+}
+
+//InfoHashes returns the infohashes the torrent is announced with, the truncated v2 infohash being one of them for a hybrid torrent
+func (t *TorrentFile) InfoHashes() [][20]byte {
+	hashes := [][20]byte{t.InfoHash}
+	if t.InfoHashV2 != [32]byte{} && t.PiecesV2 == nil {
+		var ih [20]byte
+		copy(ih[:], t.InfoHashV2[:])
+		hashes = append(hashes, ih)
+	}
+	return hashes
+}
+
+//DownloadFile downloads the torrent and writes it to path.
+//It stops and returns ctx.Err() as soon as ctx is cancelled.
+func (t *TorrentFile) DownloadFile(ctx context.Context, path string) error {
+	torrent, err := t.NewTorrent()
+	if err != nil {
+		return err
+	}
+	return t.DownloadTorrent(ctx, torrent, path)
+}
+
+//DownloadTorrent downloads a torrent created with NewTorrent and writes it to path.
+//The files of a multi file torrent are written in the directory path.
+//Use it instead of DownloadFile to set up event handlers or to pause and resume the torrent.
+func (t *TorrentFile) DownloadTorrent(ctx context.Context, torrent *peer.Torrent, path string) (err error) {
+	stop := listen(torrent)
+	defer stop()
+
+	if len(t.Files) > 0 {
+		buf, err := torrent.Download(ctx)
+		if err != nil {
+			return err
+		}
+		return t.writeFiles(buf, path)
 	}
 
 	outFile, err := os.Create(path)
@@ -70,13 +176,13 @@ func (t *TorrentFile) DownloadFile(path string) error {
 		return err
 	}
 	defer func(outFile *os.File) {
-		err := outFile.Close()
-		if err != nil {
-			fmt.Println(err)
+		cerr := outFile.Close()
+		if err == nil {
+			err = cerr
 		}
 	}(outFile)
 
-	buf, err := torrent.Download()
+	buf, err := torrent.Download(ctx)
 
 	if err != nil {
 		return err
@@ -86,5 +192,138 @@ func (t *TorrentFile) DownloadFile(path string) error {
 	if err != nil {
 		return err
 	}
+	return setAttributes(path, t.Executable, t.Hidden)
+}
+
+//SeedTorrent uploads a torrent which DownloadTorrent downloaded to the peers, accepting their connections, until ctx is cancelled
+func (t *TorrentFile) SeedTorrent(ctx context.Context, torrent *peer.Torrent) error {
+	stop := listen(torrent)
+	defer stop()
+	return torrent.Seed(ctx)
+}
+
+//listen accepts the connections of peers to the torrent on Port, or on any port if it is taken, until stop is called.
+//With uTP, TCP listens on the port of the uTP socket if it can, so that peers reach us over both at the port we announce.
+//Nothing is listened on through a proxy, which peers could not connect to us through.
+func listen(torrent *peer.Torrent) (stop func()) {
+	if torrent.Dialer != nil && torrent.Dialer != proxy.Direct {
+		return func() {}
+	}
+	port := Port
+	if addr, ok := utpAddr(torrent); ok {
+		port = addr.Port
+	}
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		l, err = net.Listen("tcp", ":0")
+	}
+	if err != nil {
+		torrent.Logger.Warnf("Not accepting connections from peers: %v", err)
+		return func() {}
+	}
+	listeners := []net.Listener{ipfilter.Listener(l, torrent.Filter)}
+	if torrent.UTP != nil {
+		ul, err := torrent.UTP.Listener()
+		if err != nil {
+			torrent.Logger.Warnf("Not accepting uTP connections from peers: %v", err)
+		} else {
+			// uTP connections are checked against the filter by connection.Accept
+			listeners = append(listeners, ul)
+		}
+	}
+
+	torrent.SetPort(uint16(l.Addr().(*net.TCPAddr).Port))
+
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l net.Listener) {
+			defer wg.Done()
+			torrent.Serve(l)
+		}(l)
+	}
+	return func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+		wg.Wait()
+		torrent.SetPort(0)
+	}
+}
+
+//utpAddr returns the local address of the uTP socket of the torrent, if it has one on a UDP socket
+func utpAddr(torrent *peer.Torrent) (*net.UDPAddr, bool) {
+	if torrent.UTP == nil {
+		return nil, false
+	}
+	addr, ok := torrent.UTP.Addr().(*net.UDPAddr)
+	return addr, ok
+}
+
+//announcePort returns the port we tell trackers we accept connections on
+func announcePort(torrent *peer.Torrent) uint16 {
+	if port := torrent.Port(); port != 0 {
+		return port
+	}
+	return Port
+}
+
+//writeFiles splits the data of a multi file torrent into its files, under dir.
+//Padding files are left out, and symlinks are made to point at their target in dir.
+func (t *TorrentFile) writeFiles(buf []byte, dir string) error {
+	for _, f := range t.Files {
+		data := buf[:f.Length]
+		buf = buf[f.Length:]
+		if f.Padding {
+			continue
+		}
+		path := filepath.Join(append([]string{dir}, f.Path...)...)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			return err
+		}
+		if f.Symlink != nil {
+			err = symlink(path, filepath.Join(append([]string{dir}, f.Symlink...)...))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		err = ioutil.WriteFile(path, data, 0644)
+		if err != nil {
+			return err
+		}
+		err = setAttributes(path, f.Executable, f.Hidden)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//symlink makes path a relative symlink to target, replacing whatever path was
+func symlink(path string, target string) error {
+	rel, err := filepath.Rel(filepath.Dir(path), target)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Symlink(rel, path)
+}
+
+//setAttributes applies the executable and hidden attributes of a file (BEP 47) to path
+func setAttributes(path string, executable, hidden bool) error {
+	if executable {
+		err := os.Chmod(path, 0755)
+		if err != nil {
+			return err
+		}
+	}
+	if hidden {
+		return hide(path)
+	}
 	return nil
 }
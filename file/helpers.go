@@ -1,36 +1,60 @@
 package file
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha1"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
+	bencode "github.com/adityameharia/gotor/bencode"
 	peer "github.com/adityameharia/gotor/peer"
-
-	"github.com/jackpal/bencode-go"
+	proxy "github.com/adityameharia/gotor/proxy"
 )
 
+type bencodeFile struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+	// Attr holds the attributes of the file (BEP 47), p for padding, x for executable, h for hidden and l for symlink
+	Attr        string   `bencode:"attr,omitempty"`
+	SymlinkPath []string `bencode:"symlink path,omitempty"`
+}
+
 type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length,omitempty"`
+	Name        string        `bencode:"name"`
+	Files       []bencodeFile `bencode:"files,omitempty"`
+	Private     int           `bencode:"private,omitempty"`
+	// Attr holds the attributes of the file of a single file torrent
+	Attr string `bencode:"attr,omitempty"`
+
+	// MetaVersion is 2 for BitTorrent v2 and hybrid torrents (BEP 52), which describe their files in FileTree
+	MetaVersion int                `bencode:"meta version,omitempty"`
+	FileTree    bencode.RawMessage `bencode:"file tree,omitempty"`
 }
 
 type bencodeTorrent struct {
-	Announce string      `bencode:"announce"`
-	Info     bencodeInfo `bencode:"info"`
+	Announce  string             `bencode:"announce,omitempty"`
+	Info      bencode.RawMessage `bencode:"info"`
+	HTTPSeeds []string           `bencode:"httpseeds,omitempty"`
+	// URLList is either a single string or a list of them
+	URLList interface{} `bencode:"url-list,omitempty"`
+	// PieceLayers are the piece hashes of the files of a v2 torrent, keyed by their pieces root
+	PieceLayers map[string]string `bencode:"piece layers,omitempty"`
 }
 
 //request peers takes the announce url in the torrent file and adds a few url encoded parameters to it.
 //It then decodes the peers binary blob recieved as a response to an array of Peer structs
-func (t *TorrentFile) requestPeers(Pid []byte, port uint16) ([]peer.Peer, error) {
+//The infohash is a parameter so that both swarms of a hybrid torrent can be joined.
+func (t *TorrentFile) requestPeers(ctx context.Context, d proxy.Dialer, infoHash [20]byte, Pid []byte, port uint16) ([]peer.Peer, error) {
 	params := url.Values{
-		"info_hash":  []string{string(t.InfoHash[:])},
+		"info_hash":  []string{string(infoHash[:])},
 		"peer_id":    []string{string(Pid[:])},
 		"port":       []string{strconv.Itoa(int(port))},
 		"uploaded":   []string{"0"},
@@ -40,60 +64,90 @@ func (t *TorrentFile) requestPeers(Pid []byte, port uint16) ([]peer.Peer, error)
 	}
 	Requrl := t.Announce + "?" + params.Encode()
 
-	c := &http.Client{Timeout: 15 * time.Second}
-	resp, err := c.Get(Requrl)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, Requrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	c := proxy.HTTPClient(d, 15*time.Second)
+	resp, err := c.Do(req)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 	defer resp.Body.Close()
 
 	tracker := Tracker{}
-	err = bencode.Unmarshal(resp.Body, &tracker)
+	err = bencode.NewDecoder(resp.Body).Decode(&tracker)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
+	if tracker.FailureReason != "" {
+		return nil, fmt.Errorf("Tracker failure: %s", tracker.FailureReason)
+	}
 
-	// base, err := url.Parse(t.Announce)
-	// if err != nil {
-	// 	return nil, err
-	// }
-
-	// CONNECT := base.Host
-
-	// s, err := net.ResolveUDPAddr("udp4", CONNECT)
-	// c, err := net.DialUDP("udp4", nil, s)
-	// if err != nil {
-	// 	fmt.Println(err)
-	// 	return nil, err
-	// }
-	// fmt.Println("hi")
-	// var buf []byte
-	// fmt.Println("bye")
-	// n, _, err := c.ReadFromUDP(buf)
-	// if err != nil {
-	// 	fmt.Println(err)
-	// 	return nil, err
-	// }
-	// fmt.Println("hel")
-	// fmt.Printf("Reply: %s\n", string(buf[0:n]))
-	return peer.DecodePeer([]byte(tracker.Peers))
-	// fmt.Println(c.RemoteAddr().String())
-	// return nil, nil
+	return tracker.peers()
 }
 
-//toTorrentFile converts the bencode torrent to a torrentFile struct
+//peers returns the peers of an announce response, compact or as dictionaries, along with the IPv6 peers of peers6.
+//Peers given by host name are left out, as they would have to be resolved around the proxy.
+func (tr *Tracker) peers() ([]peer.Peer, error) {
+	var peers []peer.Peer
+	switch p := tr.Peers.(type) {
+	case nil:
+	case string:
+		var err error
+		peers, err = peer.DecodePeer([]byte(p))
+		if err != nil {
+			return nil, err
+		}
+	case []interface{}:
+		for _, v := range p {
+			d, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("Tracker returned an invalid peer")
+			}
+			ip, _ := d["ip"].(string)
+			port, _ := d["port"].(int64)
+			if port <= 0 || port > 65535 {
+				return nil, fmt.Errorf("Tracker returned a peer with invalid port %v", d["port"])
+			}
+			if addr := net.ParseIP(ip); addr != nil {
+				peers = append(peers, peer.Peer{IP: addr, Port: uint16(port)})
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Tracker returned peers of unexpected type %T", tr.Peers)
+	}
+
+	peers6, err := peer.DecodePeer6([]byte(tr.Peers6))
+	if err != nil {
+		return nil, err
+	}
+	return append(peers, peers6...), nil
+}
+
+//toTorrentFile converts the bencode torrent to a torrentFile struct.
+//The info dictionary is hashed as it was read, since bencodeInfo only holds the keys we use.
 func (b *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, b.Info)
+	if b.Info == nil {
+		return TorrentFile{}, fmt.Errorf("Torrent File has no info dictionary")
+	}
+	info := bencodeInfo{}
+	err := bencode.Unmarshal(b.Info, &info)
 	if err != nil {
 		return TorrentFile{}, err
 	}
 
-	h := sha1.Sum(buf.Bytes())
+	if info.PieceLength <= 0 {
+		return TorrentFile{}, fmt.Errorf("Torrent File has an invalid piece length %d", info.PieceLength)
+	}
+	if info.Length < 0 {
+		return TorrentFile{}, fmt.Errorf("Torrent File has an invalid length %d", info.Length)
+	}
+
+	h := sha1.Sum(b.Info)
 	leng := 20
-	piece := []byte(b.Info.Pieces)
+	piece := []byte(info.Pieces)
 	if len(piece)%leng != 0 {
 		err := fmt.Errorf("Torrent File is corrupted")
 		return TorrentFile{}, err
@@ -109,10 +163,112 @@ func (b *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
 		Announce:    b.Announce,
 		InfoHash:    h,
 		PieceHashes: hashes,
-		PieceLength: b.Info.PieceLength,
-		Length:      b.Info.Length,
-		Name:        b.Info.Name,
+		PieceLength: info.PieceLength,
+		Length:      info.Length,
+		Name:        info.Name,
+		HTTPSeeds:   b.HTTPSeeds,
+		URLList:     urlList(b.URLList),
+		Private:     info.Private == 1,
+		RawInfo:     b.Info,
+	}
+
+	if info.MetaVersion != 0 || info.FileTree != nil {
+		err = t.setV2(&info, b.PieceLayers)
+		if err != nil {
+			return TorrentFile{}, err
+		}
+	}
+
+	// a multi file torrent is the concatenation of its files
+	for _, f := range info.Files {
+		err = checkPath(f.Path)
+		if err != nil {
+			return TorrentFile{}, err
+		}
+		if f.Length < 0 || t.Length+f.Length < t.Length {
+			return TorrentFile{}, fmt.Errorf("Torrent File has an invalid length %d for %q", f.Length, strings.Join(f.Path, "/"))
+		}
+		pf, err := newFile(f.Path, f.Length, f.Attr, f.SymlinkPath)
+		if err != nil {
+			return TorrentFile{}, err
+		}
+		t.Files = append(t.Files, pf)
+		t.Length += f.Length
+	}
+	if len(info.Files) == 0 {
+		t.Executable = strings.Contains(info.Attr, "x")
+		t.Hidden = strings.Contains(info.Attr, "h")
+	}
+
+	// v1 pieces must cover the data exactly, the last one being the only one shorter than the piece length
+	if t.PiecesV2 == nil {
+		n := t.Length / t.PieceLength
+		if t.Length%t.PieceLength != 0 {
+			n++
+		}
+		if len(t.PieceHashes) != n {
+			return TorrentFile{}, fmt.Errorf("Torrent File has %d piece hashes for %d pieces", len(t.PieceHashes), n)
+		}
 	}
 
 	return t, nil
 }
+
+//checkPath makes sure the path of a file stays inside the download directory
+func checkPath(path []string) error {
+	if len(path) == 0 {
+		return fmt.Errorf("Torrent File has a file without a path")
+	}
+	for _, p := range path {
+		if p == "" || p == "." || p == ".." || strings.ContainsAny(p, "/\\") {
+			return fmt.Errorf("Torrent File has an invalid path %q", strings.Join(path, "/"))
+		}
+	}
+	return nil
+}
+
+//newFile returns a file of a torrent with the attributes of attr (BEP 47), unknown attributes being ignored.
+//A symlink must point inside the torrent and a padding file can't be anything else.
+func newFile(path []string, length int, attr string, symlink []string) (peer.File, error) {
+	f := peer.File{
+		Path:       path,
+		Length:     length,
+		Padding:    strings.Contains(attr, "p"),
+		Executable: strings.Contains(attr, "x"),
+		Hidden:     strings.Contains(attr, "h"),
+	}
+	if strings.Contains(attr, "l") {
+		err := checkPath(symlink)
+		if err != nil {
+			return peer.File{}, err
+		}
+		f.Symlink = symlink
+	}
+	if f.Padding && (f.Executable || f.Hidden || f.Symlink != nil) {
+		return peer.File{}, fmt.Errorf("Torrent File has a padding file with attributes %q", attr)
+	}
+	return f, nil
+}
+
+//urlList returns the HTTP URLs of the url-list key of a torrent, which is either a single string or a list of them
+func urlList(list interface{}) []string {
+	var urls []string
+	switch v := list.(type) {
+	case string:
+		urls = []string{v}
+	case []interface{}:
+		for _, u := range v {
+			if s, ok := u.(string); ok {
+				urls = append(urls, s)
+			}
+		}
+	}
+
+	res := urls[:0]
+	for _, u := range urls {
+		if strings.HasPrefix(u, "http://") || strings.HasPrefix(u, "https://") {
+			res = append(res, u)
+		}
+	}
+	return res
+}
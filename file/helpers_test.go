@@ -0,0 +1,139 @@
+package file
+
+import (
+	"context"
+	bencode "github.com/adityameharia/gotor/bencode"
+	peer "github.com/adityameharia/gotor/peer"
+	proxy "github.com/adityameharia/gotor/proxy"
+	tracker "github.com/adityameharia/gotor/tracker"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+//newTracker serves tr over HTTP, with compact=0 forced on every announce if dict is set
+func newTracker(tr *tracker.Tracker, dict bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dict {
+			q := r.URL.Query()
+			q.Set("compact", "0")
+			r.URL.RawQuery = q.Encode()
+		}
+		tr.ServeHTTP(w, r)
+	}))
+}
+
+//join adds a peer to the swarm of infoHash on tr
+func join(t *testing.T, tr *tracker.Tracker, infoHash [20]byte, id byte, ip string, port uint16) {
+	_, err := tr.Announce(&tracker.AnnounceRequest{InfoHash: infoHash, PeerID: [20]byte{id}, IP: net.ParseIP(ip), Port: port, Left: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func peerStrings(peers []peer.Peer) []string {
+	s := make([]string, len(peers))
+	for i, p := range peers {
+		s[i] = p.String()
+	}
+	sort.Strings(s)
+	return s
+}
+
+func TestRequestPeers(t *testing.T) {
+	infoHash := [20]byte{1, 2, 3}
+	want := []string{"10.0.0.1:6881", "[2001:db8::1]:6882"}
+	for _, dict := range []bool{false, true} {
+		tr := &tracker.Tracker{}
+		join(t, tr, infoHash, 1, "10.0.0.1", 6881)
+		join(t, tr, infoHash, 2, "2001:db8::1", 6882)
+		srv := newTracker(tr, dict)
+
+		tf := &TorrentFile{Announce: srv.URL + "/announce", InfoHash: infoHash, Length: 100}
+		peers, err := tf.requestPeers(context.Background(), proxy.Direct, infoHash, []byte("-GT0001-abcdefghijkl"), 7000)
+		srv.Close()
+		if err != nil {
+			t.Fatalf("dict %v: %v", dict, err)
+		}
+		got := peerStrings(peers)
+		if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+			t.Errorf("dict %v: got peers %v, want %v", dict, got, want)
+		}
+	}
+}
+
+func TestRequestPeersHybrid(t *testing.T) {
+	tf := &TorrentFile{InfoHash: [20]byte{1}, InfoHashV2: [32]byte{2, 2, 2}, Length: 100}
+	tr := &tracker.Tracker{AllowList: tracker.NewAllowList(tf.InfoHashes()...)}
+	var v2 [20]byte
+	copy(v2[:], tf.InfoHashV2[:])
+	join(t, tr, v2, 1, "10.0.0.2", 6881)
+	srv := newTracker(tr, false)
+	defer srv.Close()
+	tf.Announce = srv.URL + "/announce"
+
+	peers, err := tf.requestPeers(context.Background(), proxy.Direct, v2, []byte("-GT0001-abcdefghijkl"), 7000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := peerStrings(peers); len(got) != 1 || got[0] != "10.0.0.2:6881" {
+		t.Errorf("Got peers %v of the v2 swarm, want 10.0.0.2:6881", got)
+	}
+	_, err = tf.requestPeers(context.Background(), proxy.Direct, [20]byte{3}, []byte("-GT0001-abcdefghijkl"), 7000)
+	if err == nil {
+		t.Error("Tracker accepted an infohash which is not on its allow-list")
+	}
+}
+
+func TestTrackerPeersInvalid(t *testing.T) {
+	for _, tr := range []Tracker{
+		{Peers: "12345"},
+		{Peers6: "123"},
+		{Peers: []interface{}{"10.0.0.1"}},
+		{Peers: []interface{}{map[string]interface{}{"ip": "10.0.0.1", "port": int64(70000)}}},
+		{Peers: int64(1)},
+	} {
+		if _, err := tr.peers(); err == nil {
+			t.Errorf("Got no error for peers %#v and peers6 %q", tr.Peers, tr.Peers6)
+		}
+	}
+}
+
+func TestToTorrentFile(t *testing.T) {
+	hashes := func(n int) string {
+		return strings.Repeat("h", 20*n)
+	}
+	file := func(length int) map[string]interface{} {
+		return map[string]interface{}{"length": length, "path": []string{"f"}}
+	}
+	tests := []struct {
+		info map[string]interface{}
+		ok   bool
+	}{
+		{map[string]interface{}{"name": "a", "piece length": 16, "length": 33, "pieces": hashes(3)}, true},
+		{map[string]interface{}{"name": "a", "piece length": 16, "length": 32, "pieces": hashes(2)}, true},
+		{map[string]interface{}{"name": "a", "piece length": 16, "length": 0, "pieces": ""}, true},
+		{map[string]interface{}{"name": "a", "piece length": 16, "files": []interface{}{file(10), file(0), file(7)}, "pieces": hashes(2)}, true},
+		{map[string]interface{}{"name": "a", "piece length": 0, "length": 33, "pieces": hashes(3)}, false},
+		{map[string]interface{}{"name": "a", "piece length": -16, "length": 33, "pieces": hashes(3)}, false},
+		{map[string]interface{}{"name": "a", "piece length": 16, "length": -1, "pieces": ""}, false},
+		{map[string]interface{}{"name": "a", "piece length": 16, "length": 33, "pieces": hashes(2)}, false},
+		{map[string]interface{}{"name": "a", "piece length": 16, "length": 33, "pieces": hashes(4)}, false},
+		{map[string]interface{}{"name": "a", "piece length": 16, "files": []interface{}{file(20), file(-4)}, "pieces": hashes(1)}, false},
+		{map[string]interface{}{"name": "a", "piece length": 16, "files": []interface{}{file(10), file(7)}, "pieces": hashes(1)}, false},
+	}
+	for _, tt := range tests {
+		info, err := bencode.Marshal(tt.info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b := bencodeTorrent{Info: info}
+		_, err = b.toTorrentFile()
+		if (err == nil) != tt.ok {
+			t.Errorf("Info %s: got error %v, want success %v", info, err, tt.ok)
+		}
+	}
+}
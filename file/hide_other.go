@@ -0,0 +1,9 @@
+//go:build !windows
+// +build !windows
+
+package file
+
+//hide does nothing outside Windows, where hidden files are the ones whose name starts with a dot
+func hide(path string) error {
+	return nil
+}
@@ -0,0 +1,242 @@
+package file
+
+import (
+	"crypto/sha256"
+	"fmt"
+	bencode "github.com/adityameharia/gotor/bencode"
+	merkle "github.com/adityameharia/gotor/merkle"
+	peer "github.com/adityameharia/gotor/peer"
+	"sort"
+	"strings"
+)
+
+//fileV2 is a file of the file tree of a v2 torrent
+type fileV2 struct {
+	path       []string
+	length     int
+	piecesRoot merkle.Hash
+	attr       string
+	symlink    []string
+}
+
+//fileTree lists the files of the file tree of a v2 torrent (BEP 52) in the order of their paths.
+//A file is a dictionary with an empty key holding its length and pieces root, anything else is a directory.
+func fileTree(raw bencode.RawMessage) ([]fileV2, error) {
+	var tree map[string]interface{}
+	err := bencode.Unmarshal(raw, &tree)
+	if err != nil {
+		return nil, err
+	}
+	var files []fileV2
+	err = walkTree(tree, nil, &files)
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("Torrent File has an empty file tree")
+	}
+	return files, nil
+}
+
+func walkTree(dir map[string]interface{}, path []string, files *[]fileV2) error {
+	names := make([]string, 0, len(dir))
+	for name := range dir {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		node, ok := dir[name].(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Torrent File has an invalid file tree entry %q", name)
+		}
+		p := append(append([]string(nil), path...), name)
+		err := checkPath(p)
+		if err != nil {
+			return err
+		}
+
+		f, ok := node[""].(map[string]interface{})
+		if !ok {
+			err = walkTree(node, p, files)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		length, ok := f["length"].(int64)
+		if !ok || length < 0 {
+			return fmt.Errorf("Torrent File has an invalid length for %q", name)
+		}
+		file := fileV2{path: p, length: int(length)}
+		file.attr, _ = f["attr"].(string)
+		if sp, ok := f["symlink path"].([]interface{}); ok {
+			for _, part := range sp {
+				s, _ := part.(string)
+				file.symlink = append(file.symlink, s)
+			}
+		}
+		if length > 0 {
+			root, ok := f["pieces root"].(string)
+			if !ok || len(root) != len(file.piecesRoot) {
+				return fmt.Errorf("Torrent File has an invalid pieces root for %q", name)
+			}
+			copy(file.piecesRoot[:], root)
+		}
+		*files = append(*files, file)
+	}
+	return nil
+}
+
+//pieceLayers decodes the piece layers of a v2 torrent, keyed by the pieces roots of the files
+func pieceLayers(layers map[string]string) (map[merkle.Hash][]merkle.Hash, error) {
+	res := make(map[merkle.Hash][]merkle.Hash, len(layers))
+	for root, layer := range layers {
+		if len(root) != 32 || len(layer)%32 != 0 {
+			return nil, fmt.Errorf("Torrent File has corrupted piece layers")
+		}
+		var r merkle.Hash
+		copy(r[:], root)
+		hashes := make([]merkle.Hash, len(layer)/32)
+		for i := range hashes {
+			copy(hashes[i][:], layer[i*32:])
+		}
+		res[r] = hashes
+	}
+	return res, nil
+}
+
+//encodePieceLayers is the inverse of pieceLayers
+func encodePieceLayers(layers map[merkle.Hash][]merkle.Hash) map[string]string {
+	if len(layers) == 0 {
+		return nil
+	}
+	res := make(map[string]string, len(layers))
+	for root, hashes := range layers {
+		layer := make([]byte, 0, 32*len(hashes))
+		for _, h := range hashes {
+			layer = append(layer, h[:]...)
+		}
+		res[string(root[:])] = string(layer)
+	}
+	return res
+}
+
+//piecesV2 works out the pieces of the files of a v2 torrent, each file starting on a piece boundary,
+//and checks the piece layer of every file spanning more than one piece against its pieces root
+func piecesV2(files []fileV2, pieceLength int, layers map[merkle.Hash][]merkle.Hash) ([]peer.PieceV2, error) {
+	if pieceLength < merkle.BlockSize || pieceLength&(pieceLength-1) != 0 {
+		return nil, fmt.Errorf("Torrent File has an invalid piece length %d", pieceLength)
+	}
+	pieceBlocks := pieceLength / merkle.BlockSize
+
+	var pieces []peer.PieceV2
+	for _, f := range files {
+		if f.length == 0 {
+			continue
+		}
+		blocks := merkle.Blocks(int64(f.length))
+		fileWidth := merkle.Width(blocks)
+
+		// a file of one piece has no piece layer, its piece hash is the pieces root
+		if f.length <= pieceLength {
+			pieces = append(pieces, peer.PieceV2{
+				Hash:      f.piecesRoot,
+				Root:      f.piecesRoot,
+				FileWidth: fileWidth,
+				Width:     fileWidth,
+				Length:    f.length,
+			})
+			continue
+		}
+
+		n := (f.length + pieceLength - 1) / pieceLength
+		layer, ok := layers[f.piecesRoot]
+		if !ok {
+			return nil, fmt.Errorf("Torrent File has no piece layer for %q", strings.Join(f.path, "/"))
+		}
+		if len(layer) != n {
+			return nil, fmt.Errorf("Torrent File has a piece layer not matching the pieces root of %q", strings.Join(f.path, "/"))
+		}
+		tree := merkle.NewTree(layer, merkle.Width(n), merkle.Height(pieceBlocks))
+		if tree.Root() != f.piecesRoot {
+			return nil, fmt.Errorf("Torrent File has a piece layer not matching the pieces root of %q", strings.Join(f.path, "/"))
+		}
+		for i, h := range layer {
+			length := pieceLength
+			if i == n-1 {
+				length = f.length - i*pieceLength
+			}
+			pieces = append(pieces, peer.PieceV2{
+				Hash:      h,
+				Root:      f.piecesRoot,
+				FileWidth: fileWidth,
+				Block:     i * pieceBlocks,
+				Width:     pieceBlocks,
+				Length:    length,
+				Layer:     tree,
+			})
+		}
+	}
+	return pieces, nil
+}
+
+//layoutV2 returns the files of a v2 torrent as they are laid out in the data of the torrent, with padding after
+//every file which doesn't end on a piece boundary but the last, and the length of the data
+func layoutV2(files []fileV2, pieceLength int) ([]peer.File, int, error) {
+	var res []peer.File
+	length := 0
+	for i, f := range files {
+		pf, err := newFile(f.path, f.length, f.attr, f.symlink)
+		if err != nil {
+			return nil, 0, err
+		}
+		if pf.Padding {
+			return nil, 0, fmt.Errorf("Torrent File has a padding file in its file tree")
+		}
+		res = append(res, pf)
+		length += f.length
+		if pad := (pieceLength - f.length%pieceLength) % pieceLength; pad > 0 && i < len(files)-1 {
+			res = append(res, peer.File{Length: pad, Padding: true})
+			length += pad
+		}
+	}
+	return res, length, nil
+}
+
+//setV2 fills in the v2 part of a torrent from its info dictionary and piece layers.
+//A hybrid torrent keeps its v1 layout and pieces, so only its v2 infohash is set.
+func (t *TorrentFile) setV2(info *bencodeInfo, layers map[string]string) error {
+	if info.MetaVersion != 2 {
+		return fmt.Errorf("Torrent File has unsupported meta version %d", info.MetaVersion)
+	}
+	t.InfoHashV2 = sha256.Sum256(t.RawInfo)
+
+	files, err := fileTree(info.FileTree)
+	if err != nil {
+		return err
+	}
+	t.PieceLayers, err = pieceLayers(layers)
+	if err != nil {
+		return err
+	}
+	pieces, err := piecesV2(files, info.PieceLength, t.PieceLayers)
+	if err != nil {
+		return err
+	}
+	if info.Pieces != "" {
+		return nil
+	}
+
+	copy(t.InfoHash[:], t.InfoHashV2[:])
+	t.PieceHashes = nil
+	t.PiecesV2 = pieces
+	if len(files) == 1 && len(files[0].path) == 1 && files[0].path[0] == t.Name {
+		t.Length = files[0].length
+		t.Executable = strings.Contains(files[0].attr, "x")
+		t.Hidden = strings.Contains(files[0].attr, "h")
+		return nil
+	}
+	t.Files, t.Length, err = layoutV2(files, info.PieceLength)
+	return err
+}
@@ -0,0 +1,315 @@
+//Package ipfilter blocks address ranges loaded from PeerGuardian (P2P) and eMule (DAT) lists
+package ipfilter
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DATMaxBlockedLevel is the highest access level of a DAT entry which is blocked, as in eMule
+const DATMaxBlockedLevel = 127
+
+// Range is an inclusive range of blocked addresses
+type Range struct {
+	Start       net.IP
+	End         net.IP
+	Description string
+}
+
+// Filter tells if an address is in one of its blocked ranges.
+// It is safe for concurrent use and can be reloaded while in use.
+type Filter struct {
+	// blocked is accessed atomically and kept first for 64 bit alignment
+	blocked uint64
+
+	mu     sync.RWMutex
+	ranges []Range
+}
+
+// New creates a filter blocking every address in ranges
+func New(ranges []Range) *Filter {
+	f := &Filter{}
+	f.Set(ranges)
+	return f
+}
+
+// Load creates a filter from a P2P or DAT list
+func Load(path string) (*Filter, error) {
+	f := &Filter{}
+	err := f.Reload(path)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Reload replaces the ranges of the filter with the ones in the list at path.
+// The filter is left unchanged if the list can't be read.
+func (f *Filter) Reload(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ranges, err := Parse(file)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	f.Set(ranges)
+	return nil
+}
+
+// Set replaces the ranges of the filter
+func (f *Filter) Set(ranges []Range) {
+	sorted := make([]Range, 0, len(ranges))
+	for _, r := range ranges {
+		r.Start, r.End = normalize(r.Start), normalize(r.End)
+		if r.Start == nil || r.End == nil || len(r.Start) != len(r.End) || bytes.Compare(r.Start, r.End) > 0 {
+			continue
+		}
+		sorted = append(sorted, r)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i].Start) != len(sorted[j].Start) {
+			return len(sorted[i].Start) < len(sorted[j].Start)
+		}
+		return bytes.Compare(sorted[i].Start, sorted[j].Start) < 0
+	})
+
+	// merge overlapping ranges so that a binary search on the start is enough
+	merged := sorted[:0]
+	for _, r := range sorted {
+		if n := len(merged); n > 0 {
+			last := &merged[n-1]
+			if len(last.End) == len(r.Start) && bytes.Compare(r.Start, last.End) <= 0 {
+				if bytes.Compare(r.End, last.End) > 0 {
+					last.End = r.End
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ranges = merged
+}
+
+// Len returns the number of ranges in the filter, after merging overlapping ones
+func (f *Filter) Len() int {
+	if f == nil {
+		return 0
+	}
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return len(f.ranges)
+}
+
+// Blocked tells if ip is in a blocked range and counts it if so.
+// A nil filter blocks nothing.
+func (f *Filter) Blocked(ip net.IP) bool {
+	_, ok := f.Find(ip)
+	if ok {
+		atomic.AddUint64(&f.blocked, 1)
+	}
+	return ok
+}
+
+// Find returns the blocked range containing ip, if any, without counting it
+func (f *Filter) Find(ip net.IP) (Range, bool) {
+	if f == nil {
+		return Range{}, false
+	}
+	ip = normalize(ip)
+	if ip == nil {
+		return Range{}, false
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	// first range starting after ip, the one before it is the only candidate
+	i := sort.Search(len(f.ranges), func(i int) bool {
+		s := f.ranges[i].Start
+		if len(s) != len(ip) {
+			return len(s) > len(ip)
+		}
+		return bytes.Compare(s, ip) > 0
+	})
+	if i == 0 {
+		return Range{}, false
+	}
+	r := f.ranges[i-1]
+	if len(r.End) != len(ip) || bytes.Compare(ip, r.End) > 0 {
+		return Range{}, false
+	}
+	return r, true
+}
+
+// BlockedCount returns the number of connections refused by the filter so far
+func (f *Filter) BlockedCount() uint64 {
+	if f == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&f.blocked)
+}
+
+//normalize returns the 4 byte form of IPv4 addresses and the 16 byte form of the others
+func normalize(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip.To16()
+}
+
+// Parse reads a list of ranges in the P2P format
+//
+//	description:1.2.3.0-1.2.3.255
+//
+// or the DAT format
+//
+//	001.002.003.000 - 001.002.003.255 , 000 , description
+//
+// where only entries with an access level up to DATMaxBlockedLevel are kept. The P2P description may be left out.
+// Empty lines and lines starting with # or // are skipped. The format is detected on every line.
+func Parse(r io.Reader) ([]Range, error) {
+	var ranges []Range
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	for s.Scan() {
+		line++
+		text := strings.TrimSpace(s.Text())
+		if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "//") {
+			continue
+		}
+
+		var (
+			rg      Range
+			blocked bool
+			err     error
+		)
+		if isDAT(text) {
+			rg, blocked, err = parseDAT(text)
+		} else {
+			rg, err = parseP2P(text)
+			blocked = true
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if blocked {
+			ranges = append(ranges, rg)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return ranges, nil
+}
+
+//isDAT tells if line is in the DAT format, its first comma separated field being a range.
+//P2P descriptions may contain commas too, but come before the range.
+func isDAT(line string) bool {
+	i := strings.IndexByte(line, ',')
+	if i < 0 {
+		return false
+	}
+	_, _, err := parseRange(line[:i])
+	return err == nil
+}
+
+//parseP2P parses "description:start-end", the description itself may contain colons and may be left out.
+//The range of IPv4 addresses starts after the last colon. As IPv6 addresses contain colons too,
+//their range starts after the first colon followed by a valid range.
+func parseP2P(line string) (Range, error) {
+	sep := strings.LastIndexByte(line, ':')
+	start, end, err := parseRange(line[sep+1:])
+	if err == nil {
+		rg := Range{Start: start, End: end}
+		if sep >= 0 {
+			rg.Description = strings.TrimSpace(line[:sep])
+		}
+		return rg, nil
+	}
+	if start, end, rerr := parseRange(line); rerr == nil {
+		return Range{Start: start, End: end}, nil
+	}
+	for sep := 0; sep < len(line); sep++ {
+		if line[sep] != ':' {
+			continue
+		}
+		start, end, rerr := parseRange(line[sep+1:])
+		if rerr == nil {
+			return Range{Description: strings.TrimSpace(line[:sep]), Start: start, End: end}, nil
+		}
+	}
+	return Range{}, err
+}
+
+//parseDAT parses "start - end , level , description" and tells if the level means the range is blocked
+func parseDAT(line string) (Range, bool, error) {
+	fields := strings.SplitN(line, ",", 3)
+	if len(fields) < 2 {
+		return Range{}, false, fmt.Errorf("Expected start - end , level , description but got %q", line)
+	}
+	start, end, err := parseRange(fields[0])
+	if err != nil {
+		return Range{}, false, err
+	}
+	level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+	if err != nil {
+		return Range{}, false, fmt.Errorf("Invalid access level %q", fields[1])
+	}
+	rg := Range{Start: start, End: end}
+	if len(fields) == 3 {
+		rg.Description = strings.TrimSpace(fields[2])
+	}
+	return rg, level <= DATMaxBlockedLevel, nil
+}
+
+func parseRange(s string) (net.IP, net.IP, error) {
+	// IPv6 addresses never contain "-", so the first one splits the range
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("Expected start-end but got %q", s)
+	}
+	start := parseIP(parts[0])
+	end := parseIP(parts[1])
+	if start == nil || end == nil {
+		return nil, nil, fmt.Errorf("Invalid address range %q", s)
+	}
+	return start, end, nil
+}
+
+//parseIP parses an address, allowing the zero padded IPv4 form of DAT lists such as 001.002.003.000
+func parseIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return nil
+	}
+	ip := make(net.IP, 4)
+	for i, o := range octets {
+		n, err := strconv.Atoi(o)
+		if err != nil || n < 0 || n > 255 {
+			return nil
+		}
+		ip[i] = byte(n)
+	}
+	return ip
+}
@@ -0,0 +1,123 @@
+package ipfilter
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name  string
+		line  string
+		want  []Range
+		fails bool
+	}{
+		{"P2P", "Some ISP:1.2.3.0-1.2.3.255", []Range{{net.ParseIP("1.2.3.0"), net.ParseIP("1.2.3.255"), "Some ISP"}}, false},
+		{"P2P without description", "1.2.3.0-1.2.3.255", []Range{{net.ParseIP("1.2.3.0"), net.ParseIP("1.2.3.255"), ""}}, false},
+		{"P2P with a comma", "Some ISP, Inc:1.2.3.0-1.2.3.255", []Range{{net.ParseIP("1.2.3.0"), net.ParseIP("1.2.3.255"), "Some ISP, Inc"}}, false},
+		{"P2P with colons", "Some ISP: a:b:c:1.2.3.0-1.2.3.255", []Range{{net.ParseIP("1.2.3.0"), net.ParseIP("1.2.3.255"), "Some ISP: a:b:c"}}, false},
+		{"P2P IPv6", "Some ISP:2001:db8::-2001:db8::ffff", []Range{{net.ParseIP("2001:db8::"), net.ParseIP("2001:db8::ffff"), "Some ISP"}}, false},
+		{"P2P IPv6 without description", "2001:db8::-2001:db8::ffff", []Range{{net.ParseIP("2001:db8::"), net.ParseIP("2001:db8::ffff"), ""}}, false},
+		{"DAT", "001.002.003.000 - 001.002.003.255 , 000 , Some ISP", []Range{{net.ParseIP("1.2.3.0"), net.ParseIP("1.2.3.255"), "Some ISP"}}, false},
+		{"DAT without description", "001.002.003.000 - 001.002.003.255 , 127", []Range{{net.ParseIP("1.2.3.0"), net.ParseIP("1.2.3.255"), ""}}, false},
+		{"DAT with a comma", "001.002.003.000 - 001.002.003.255 , 100 , Some ISP, Inc", []Range{{net.ParseIP("1.2.3.0"), net.ParseIP("1.2.3.255"), "Some ISP, Inc"}}, false},
+		{"DAT allowed", "001.002.003.000 - 001.002.003.255 , 200 , Some ISP", nil, false},
+		{"DAT IPv6", "2001:db8:: - 2001:db8::ffff , 0 , Some ISP", []Range{{net.ParseIP("2001:db8::"), net.ParseIP("2001:db8::ffff"), "Some ISP"}}, false},
+		{"comments", "# comment\n// comment\n\n", nil, false},
+		{"invalid range", "Some ISP:1.2.3.0-1.2.3", nil, true},
+		{"invalid level", "001.002.003.000 - 001.002.003.255 , high , Some ISP", nil, true},
+		{"no range", "Some ISP", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse(strings.NewReader(tt.line))
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("Parsed %q as %v", tt.line, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("Got %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				g, w := got[i], tt.want[i]
+				if !g.Start.Equal(w.Start) || !g.End.Equal(w.End) || g.Description != w.Description {
+					t.Errorf("Got %v, want %v", g, w)
+				}
+			}
+		})
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	_, err := Parse(strings.NewReader("a:1.2.3.0-1.2.3.255\n\nb:1.2.3\n"))
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3:") {
+		t.Fatalf("Got error %v, want one on line 3", err)
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f := New([]Range{
+		{Start: net.ParseIP("10.0.0.0"), End: net.ParseIP("10.0.0.255"), Description: "a"},
+		// overlaps the first one
+		{Start: net.ParseIP("10.0.0.128"), End: net.ParseIP("10.0.1.255"), Description: "b"},
+		{Start: net.ParseIP("192.168.0.1"), End: net.ParseIP("192.168.0.1"), Description: "c"},
+		{Start: net.ParseIP("2001:db8::"), End: net.ParseIP("2001:db8::ffff"), Description: "d"},
+		// start after end
+		{Start: net.ParseIP("172.16.0.255"), End: net.ParseIP("172.16.0.0"), Description: "e"},
+		// IPv4 start and IPv6 end
+		{Start: net.ParseIP("172.16.0.0"), End: net.ParseIP("2001:db8::"), Description: "f"},
+	})
+	if f.Len() != 3 {
+		t.Errorf("Got %d ranges, want 3", f.Len())
+	}
+
+	tests := []struct {
+		ip      string
+		blocked bool
+		desc    string
+	}{
+		{"9.255.255.255", false, ""},
+		{"10.0.0.0", true, "a"},
+		{"10.0.0.200", true, "a"},
+		{"10.0.1.255", true, "a"},
+		{"10.0.2.0", false, ""},
+		{"192.168.0.0", false, ""},
+		{"192.168.0.1", true, "c"},
+		{"192.168.0.2", false, ""},
+		{"::ffff:10.0.0.1", true, "a"},
+		{"2001:db8::1", true, "d"},
+		{"2001:db8::1:0", false, ""},
+		{"::1", false, ""},
+		{"172.16.0.10", false, ""},
+	}
+	count := uint64(0)
+	for _, tt := range tests {
+		ip := net.ParseIP(tt.ip)
+		r, ok := f.Find(ip)
+		if ok != tt.blocked || r.Description != tt.desc {
+			t.Errorf("Find(%s) = %v, %v, want %v in %q", tt.ip, r, ok, tt.blocked, tt.desc)
+		}
+		if f.Blocked(ip) != tt.blocked {
+			t.Errorf("Blocked(%s) = %v, want %v", tt.ip, !tt.blocked, tt.blocked)
+		}
+		if tt.blocked {
+			count++
+		}
+	}
+	if f.BlockedCount() != count {
+		t.Errorf("Counted %d blocked addresses, want %d", f.BlockedCount(), count)
+	}
+}
+
+func TestNilFilter(t *testing.T) {
+	var f *Filter
+	if f.Blocked(net.ParseIP("10.0.0.1")) || f.Len() != 0 || f.BlockedCount() != 0 {
+		t.Fatal("A nil filter blocks addresses")
+	}
+}
@@ -0,0 +1,29 @@
+package ipfilter
+
+import (
+	"net"
+)
+
+type listener struct {
+	net.Listener
+	filter *Filter
+}
+
+// Listener wraps l so that connections from blocked addresses are closed as soon as they are accepted
+func Listener(l net.Listener, f *Filter) net.Listener {
+	return &listener{Listener: l, filter: f}
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok && l.filter.Blocked(addr.IP) {
+			c.Close()
+			continue
+		}
+		return c, nil
+	}
+}
@@ -0,0 +1,54 @@
+package ipfilter
+
+import (
+	"context"
+	"path/filepath"
+
+	logger "github.com/adityameharia/gotor/logger"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Watch reloads the filter from path whenever the file changes, until ctx is done.
+// The directory is watched rather than the file so that lists replaced by a rename are picked up too.
+// Reload errors are logged and the previous ranges are kept.
+func (f *Filter) Watch(ctx context.Context, path string, log *logger.Logger) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	err = w.Add(filepath.Dir(path))
+	if err != nil {
+		w.Close()
+		return err
+	}
+
+	go func() {
+		defer w.Close()
+		clean := filepath.Clean(path)
+		for {
+			select {
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(e.Name) != clean || e.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				err := f.Reload(path)
+				if err != nil {
+					log.Warnf("Could not reload IP filter: %v", err)
+					continue
+				}
+				log.Infof("Reloaded IP filter with %d ranges", f.Len())
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Warnf("Watching IP filter: %v", err)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,194 @@
+//Package logger is a small leveled logger with fields and text or JSON output
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log entry
+type Level int
+
+const (
+	// Debug is for detailed information which is only useful while debugging
+	Debug Level = iota
+	// Info is for normal events such as a completed handshake
+	Info
+	// Warn is for things that went wrong but which the download recovers from
+	Warn
+	// Error is for failures which stop a download
+	Error
+)
+
+// Format is the output format of a Logger
+type Format int
+
+const (
+	// Text writes entries as a line of key=value pairs
+	Text Format = iota
+	// JSON writes entries as one JSON object per line
+	JSON
+)
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// Logger writes leveled entries with fields to an io.Writer.
+// A nil *Logger discards everything, so libraries can log unconditionally.
+type Logger struct {
+	out    io.Writer
+	mu     *sync.Mutex
+	level  Level
+	format Format
+	fields []field
+}
+
+// New creates a Logger writing entries of level or above to w
+func New(w io.Writer, level Level, format Format) *Logger {
+	return &Logger{
+		out:    w,
+		mu:     &sync.Mutex{},
+		level:  level,
+		format: format,
+	}
+}
+
+// With returns a Logger which adds key=value to every entry
+func (l *Logger) With(key string, value interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	fields := make([]field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+	c := *l
+	c.fields = append(fields, field{key, value})
+	return &c
+}
+
+// Enabled tells if entries of level are written
+func (l *Logger) Enabled(level Level) bool {
+	return l != nil && level >= l.level
+}
+
+// Debugf logs a formatted message at Debug level
+func (l *Logger) Debugf(format string, args ...interface{}) {
+	l.log(Debug, format, args...)
+}
+
+// Infof logs a formatted message at Info level
+func (l *Logger) Infof(format string, args ...interface{}) {
+	l.log(Info, format, args...)
+}
+
+// Warnf logs a formatted message at Warn level
+func (l *Logger) Warnf(format string, args ...interface{}) {
+	l.log(Warn, format, args...)
+}
+
+// Errorf logs a formatted message at Error level
+func (l *Logger) Errorf(format string, args ...interface{}) {
+	l.log(Error, format, args...)
+}
+
+func (l *Logger) log(level Level, format string, args ...interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+	now := time.Now().UTC().Format(time.RFC3339Nano)
+
+	var buf bytes.Buffer
+	if l.format == JSON {
+		buf.WriteString(`{"time":`)
+		writeJSON(&buf, now)
+		buf.WriteString(`,"level":`)
+		writeJSON(&buf, level.String())
+		buf.WriteString(`,"msg":`)
+		writeJSON(&buf, msg)
+		for _, f := range l.fields {
+			buf.WriteByte(',')
+			writeJSON(&buf, f.key)
+			buf.WriteByte(':')
+			writeJSON(&buf, jsonValue(f.value))
+		}
+		buf.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&buf, "%s %-5s %s", now, strings.ToUpper(level.String()), msg)
+		for _, f := range l.fields {
+			fmt.Fprintf(&buf, " %s=%v", f.key, f.value)
+		}
+		buf.WriteByte('\n')
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(buf.Bytes())
+}
+
+//jsonValue converts values json can't represent in a useful way, such as errors, to strings
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return v
+	}
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+func (l Level) String() string {
+	switch l {
+	case Debug:
+		return "debug"
+	case Info:
+		return "info"
+	case Warn:
+		return "warn"
+	case Error:
+		return "error"
+	default:
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+}
+
+// ParseLevel converts one of debug, info, warn or error to a Level
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return Debug, nil
+	case "info":
+		return Info, nil
+	case "warn", "warning":
+		return Warn, nil
+	case "error":
+		return Error, nil
+	}
+	return 0, fmt.Errorf("Unknown log level %q", s)
+}
+
+// ParseFormat converts text or json to a Format
+func ParseFormat(s string) (Format, error) {
+	switch strings.ToLower(s) {
+	case "text":
+		return Text, nil
+	case "json":
+		return JSON, nil
+	}
+	return 0, fmt.Errorf("Unknown log format %q", s)
+}
@@ -0,0 +1,263 @@
+//Package lsd implements Local Service Discovery (BEP 14): torrents are announced by multicast on the local network
+//so that peers downloading the same ones find each other without a tracker
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	logger "github.com/adityameharia/gotor/logger"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// multicast groups of BEP 14
+var (
+	Group4 = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}
+	Group6 = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+)
+
+const (
+	// AnnounceInterval is how often every torrent is announced
+	AnnounceInterval = 5 * time.Minute
+	// MinAnnounceInterval is the shortest time between two announces of the same torrent
+	MinAnnounceInterval = time.Minute
+
+	// maxInfoHashes is the number of torrents announced in a single message, keeping it in one datagram
+	maxInfoHashes = 20
+)
+
+// PeerFunc receives the address of a peer found on the local network
+type PeerFunc func(ip net.IP, port uint16)
+
+type torrent struct {
+	found     PeerFunc
+	announced time.Time
+}
+
+//discovery is a peer announcing a torrent, passed from the listening goroutines to Run
+type discovery struct {
+	infoHash [20]byte
+	ip       net.IP
+	port     uint16
+}
+
+// Service announces torrents on the local network and reports the peers announcing the same ones
+type Service struct {
+	port   uint16
+	cookie string
+	log    *logger.Logger
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*torrent
+	wake     chan struct{}
+}
+
+// New creates a service announcing that we accept connections on port
+func New(port uint16, log *logger.Logger) *Service {
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+	return &Service{
+		port:     port,
+		cookie:   hex.EncodeToString(cookie),
+		log:      log.With("component", "lsd"),
+		torrents: make(map[[20]byte]*torrent),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// Add announces infoHash from now on, found being called for every peer announcing it.
+// found is called by the goroutine of Run, one call at a time for all the torrents, and may be called concurrently with Add and Remove.
+func (s *Service) Add(infoHash [20]byte, found PeerFunc) {
+	s.mu.Lock()
+	s.torrents[infoHash] = &torrent{found: found}
+	s.mu.Unlock()
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Remove stops announcing infoHash
+func (s *Service) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.torrents, infoHash)
+}
+
+// Run joins the multicast groups and announces and listens until ctx is cancelled.
+// It fails only if neither IPv4 nor IPv6 multicast is available.
+func (s *Service) Run(ctx context.Context) error {
+	var conns []*net.UDPConn
+	for _, group := range []*net.UDPAddr{Group4, Group6} {
+		network := "udp4"
+		if group.IP.To4() == nil {
+			network = "udp6"
+		}
+		conn, err := net.ListenMulticastUDP(network, nil, group)
+		if err != nil {
+			s.log.Debugf("Could not join %s: %v", group, err)
+			continue
+		}
+		conns = append(conns, conn)
+	}
+	if len(conns) == 0 {
+		return fmt.Errorf("Could not join any local service discovery group")
+	}
+
+	// the peers found by the listeners of every group are reported from this goroutine only
+	found := make(chan discovery)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for _, conn := range conns {
+		wg.Add(1)
+		go func(conn *net.UDPConn) {
+			defer wg.Done()
+			s.listen(conn, found, done)
+		}(conn)
+	}
+	// closing the sockets stops the listeners
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	defer close(done)
+
+	ticker := time.NewTicker(MinAnnounceInterval)
+	defer ticker.Stop()
+	for {
+		s.announce(conns)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		case <-s.wake:
+		case d := <-found:
+			s.report(d)
+		}
+	}
+}
+
+//report calls the PeerFunc of the torrent a peer was found for, unless it was removed meanwhile
+func (s *Service) report(d discovery) {
+	s.mu.Lock()
+	t := s.torrents[d.infoHash]
+	s.mu.Unlock()
+	if t != nil {
+		s.log.Debugf("Found peer %s:%d for %x", d.ip, d.port, d.infoHash)
+		t.found(d.ip, d.port)
+	}
+}
+
+//announce sends the torrents which are due, never announced or last announced AnnounceInterval ago
+func (s *Service) announce(conns []*net.UDPConn) {
+	now := time.Now()
+	var due [][20]byte
+	s.mu.Lock()
+	for ih, t := range s.torrents {
+		if now.Sub(t.announced) >= AnnounceInterval {
+			t.announced = now
+			due = append(due, ih)
+		}
+	}
+	s.mu.Unlock()
+
+	for len(due) > 0 {
+		n := len(due)
+		if n > maxInfoHashes {
+			n = maxInfoHashes
+		}
+		for _, conn := range conns {
+			group := Group4
+			if conn.LocalAddr().(*net.UDPAddr).IP.To4() == nil {
+				group = Group6
+			}
+			_, err := conn.WriteToUDP(s.message(group, due[:n]), group)
+			if err != nil {
+				s.log.Debugf("Announce to %s failed: %v", group, err)
+			}
+		}
+		due = due[n:]
+	}
+}
+
+//message builds a BT-SEARCH announce of infoHashes for group
+func (s *Service) message(group *net.UDPAddr, infoHashes [][20]byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", group, s.port)
+	for _, ih := range infoHashes {
+		fmt.Fprintf(&b, "Infohash: %x\r\n", ih)
+	}
+	fmt.Fprintf(&b, "cookie: %s\r\n\r\n\r\n", s.cookie)
+	return b.Bytes()
+}
+
+//listen reads the announces sent to the group of conn and passes the peers announcing our torrents to found, until conn or done is closed
+func (s *Service) listen(conn *net.UDPConn, found chan<- discovery, done <-chan struct{}) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		port, infoHashes, err := s.parse(buf[:n])
+		if err != nil {
+			s.log.Debugf("Invalid announce from %s: %v", from, err)
+			continue
+		}
+		for _, ih := range infoHashes {
+			s.mu.Lock()
+			_, ok := s.torrents[ih]
+			s.mu.Unlock()
+			if !ok {
+				continue
+			}
+			select {
+			case found <- discovery{infoHash: ih, ip: from.IP, port: port}:
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+//parse reads a BT-SEARCH announce, returning nothing for our own announces which come back to us
+func (s *Service) parse(msg []byte) (uint16, [][20]byte, error) {
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(msg)))
+	if err != nil {
+		return 0, nil, err
+	}
+	if req.Method != "BT-SEARCH" {
+		return 0, nil, fmt.Errorf("Unexpected method %q", req.Method)
+	}
+	if req.Header.Get("Cookie") == s.cookie {
+		return 0, nil, nil
+	}
+
+	port, err := strconv.ParseUint(req.Header.Get("Port"), 10, 16)
+	if err != nil || port == 0 {
+		return 0, nil, fmt.Errorf("Invalid port %q", req.Header.Get("Port"))
+	}
+
+	var infoHashes [][20]byte
+	for _, v := range req.Header.Values("Infohash") {
+		var ih [20]byte
+		b, err := hex.DecodeString(strings.TrimSpace(v))
+		if err != nil || len(b) != len(ih) {
+			return 0, nil, fmt.Errorf("Invalid infohash %q", v)
+		}
+		copy(ih[:], b)
+		infoHashes = append(infoHashes, ih)
+	}
+	return uint16(port), infoHashes, nil
+}
@@ -0,0 +1,160 @@
+//Package merkle computes the SHA-256 merkle trees BitTorrent v2 (BEP 52) verifies files with.
+//The leaves are the hashes of the 16 KiB blocks of a file, and the leaves beyond the end of the file are zero.
+package merkle
+
+import (
+	"crypto/sha256"
+)
+
+// BlockSize is the size of the blocks hashed into the leaves of the tree
+const BlockSize = 16384
+
+// Hash is a node of a merkle tree
+type Hash [32]byte
+
+// Leaf returns the leaf hash of a block of at most BlockSize bytes
+func Leaf(block []byte) Hash {
+	return sha256.Sum256(block)
+}
+
+// Parent returns the hash of the node above left and right
+func Parent(left, right Hash) Hash {
+	var b [64]byte
+	copy(b[:32], left[:])
+	copy(b[32:], right[:])
+	return sha256.Sum256(b[:])
+}
+
+// Pad returns the hash of a subtree of height zero leaves, which stands for the part of a layer beyond the end of a file
+func Pad(height int) Hash {
+	var h Hash
+	for i := 0; i < height; i++ {
+		h = Parent(h, h)
+	}
+	return h
+}
+
+// Root returns the root of the tree whose layer at height is hashes, followed by pad hashes up to width nodes.
+// width must be a power of two at least len(hashes).
+func Root(hashes []Hash, width int, height int) Hash {
+	if width == 0 {
+		return Hash{}
+	}
+	layer := make([]Hash, width)
+	copy(layer, hashes)
+	pad := Pad(height)
+	for i := len(hashes); i < width; i++ {
+		layer[i] = pad
+	}
+	for len(layer) > 1 {
+		for i := 0; i < len(layer)/2; i++ {
+			layer[i] = Parent(layer[2*i], layer[2*i+1])
+		}
+		layer = layer[:len(layer)/2]
+	}
+	return layer[0]
+}
+
+// Leaves returns the leaf hashes of data, cut into blocks
+func Leaves(data []byte) []Hash {
+	leaves := make([]Hash, 0, Blocks(int64(len(data))))
+	for len(data) > 0 {
+		n := BlockSize
+		if n > len(data) {
+			n = len(data)
+		}
+		leaves = append(leaves, Leaf(data[:n]))
+		data = data[n:]
+	}
+	return leaves
+}
+
+// PieceHash returns the root of the subtree of width leaves covering data, the way the piece layer of a file is made
+func PieceHash(data []byte, width int) Hash {
+	return Root(Leaves(data), width, 0)
+}
+
+// Blocks returns the number of blocks of a file of length bytes
+func Blocks(length int64) int {
+	return int((length + BlockSize - 1) / BlockSize)
+}
+
+// Width returns the smallest power of two at least n, the number of nodes of a layer of n hashes once padded
+func Width(n int) int {
+	w := 1
+	for w < n {
+		w <<= 1
+	}
+	return w
+}
+
+// Height returns the log2 of width, a power of two
+func Height(width int) int {
+	h := 0
+	for width > 1 {
+		width >>= 1
+		h++
+	}
+	return h
+}
+
+// Verify checks hashes, the nodes from index of the layer at height of a tree, against root using proof,
+// the uncles of their subtree from the bottom up. len(hashes) must be a power of two and index a multiple of it.
+func Verify(root Hash, hashes []Hash, height int, index int, proof []Hash) bool {
+	n := len(hashes)
+	if n == 0 || n&(n-1) != 0 || index%n != 0 {
+		return false
+	}
+	node := Root(hashes, n, height)
+	pos := index / n
+	for _, uncle := range proof {
+		if pos%2 == 0 {
+			node = Parent(node, uncle)
+		} else {
+			node = Parent(uncle, node)
+		}
+		pos /= 2
+	}
+	return pos == 0 && node == root
+}
+
+// Tree keeps every layer of a merkle tree from a layer up to its root, to give the proofs of the nodes of that layer
+type Tree struct {
+	layers [][]Hash
+}
+
+// NewTree returns the tree whose layer at height is hashes, followed by pad hashes up to width nodes.
+// width must be a power of two at least len(hashes).
+func NewTree(hashes []Hash, width int, height int) *Tree {
+	layer := make([]Hash, width)
+	copy(layer, hashes)
+	pad := Pad(height)
+	for i := len(hashes); i < width; i++ {
+		layer[i] = pad
+	}
+	t := &Tree{layers: [][]Hash{layer}}
+	for len(layer) > 1 {
+		up := make([]Hash, len(layer)/2)
+		for i := range up {
+			up[i] = Parent(layer[2*i], layer[2*i+1])
+		}
+		t.layers = append(t.layers, up)
+		layer = up
+	}
+	return t
+}
+
+// Root returns the root of the tree
+func (t *Tree) Root() Hash {
+	return t.layers[len(t.layers)-1][0]
+}
+
+// Proof returns the uncles of the node at index of the bottom layer of the tree, from the bottom up, as Verify takes them
+func (t *Tree) Proof(index int) []Hash {
+	proof := make([]Hash, 0, len(t.layers)-1)
+	for _, layer := range t.layers[:len(t.layers)-1] {
+		proof = append(proof, layer[index^1])
+		index /= 2
+	}
+	return proof
+}
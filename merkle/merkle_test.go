@@ -0,0 +1,35 @@
+package merkle
+
+import (
+	"testing"
+)
+
+func TestTreeProof(t *testing.T) {
+	for _, n := range []int{1, 2, 3, 5, 8, 13} {
+		hashes := make([]Hash, n)
+		for i := range hashes {
+			hashes[i] = Leaf([]byte{byte(i)})
+		}
+		width := Width(n)
+		tree := NewTree(hashes, width, 2)
+		root := Root(hashes, width, 2)
+		if tree.Root() != root {
+			t.Fatalf("%d hashes: tree root %x, want %x", n, tree.Root(), root)
+		}
+		for i, h := range hashes {
+			proof := tree.Proof(i)
+			if len(proof) != Height(width) {
+				t.Errorf("%d hashes: proof of %d has %d hashes, want %d", n, i, len(proof), Height(width))
+			}
+			if !Verify(root, []Hash{h}, 2, i, proof) {
+				t.Errorf("%d hashes: proof of %d does not verify", n, i)
+			}
+			if Verify(root, []Hash{Leaf([]byte("other"))}, 2, i, proof) {
+				t.Errorf("%d hashes: proof of %d verifies another hash", n, i)
+			}
+			if n > 1 && Verify(root, []Hash{h}, 2, i^1, proof) {
+				t.Errorf("%d hashes: proof of %d verifies at index %d", n, i, i^1)
+			}
+		}
+	}
+}
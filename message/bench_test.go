@@ -0,0 +1,117 @@
+package message
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+//handed is where the benchmarks hand messages over, as the reader goroutine of a connection does through its events
+var handed *Message
+
+//pieceStream returns n blocks of piece 0 each followed by a Have, as a peer uploading to us sends them
+func pieceStream(n int) []byte {
+	var b bytes.Buffer
+	data := make([]byte, MaxBlockLength)
+	for i := 0; i < n; i++ {
+		b.Write(FormatPiece(0, i*MaxBlockLength, data).Serialize())
+		b.Write(FormatHave(i).Serialize())
+	}
+	return b.Bytes()
+}
+
+func BenchmarkReadBlock(b *testing.B) {
+	const blocks = 16
+	stream := pieceStream(blocks)
+	piece := make([]byte, blocks*MaxBlockLength)
+	block := func(index, begin, length int) []byte {
+		return piece[begin : begin+length]
+	}
+
+	// each message allocated, and the data of Piece messages copied into the piece
+	b.Run("Read", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(stream)))
+		for i := 0; i < b.N; i++ {
+			r := bytes.NewReader(stream)
+			for {
+				msg, err := Read(r)
+				if err != nil {
+					break
+				}
+				if msg.ID == Piece {
+					ParsePiece(0, piece, msg)
+				}
+			}
+		}
+	})
+
+	// the data read into the piece, and the rest of the payload copied to be handed over, as connections did
+	b.Run("Copy", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(stream)))
+		br := bytes.NewReader(stream)
+		r := NewReader(br, 0)
+		for i := 0; i < b.N; i++ {
+			br.Reset(stream)
+			for {
+				msg, err := r.Read(block)
+				if err != nil {
+					break
+				}
+				handed = &Message{ID: msg.ID, Payload: append([]byte(nil), msg.Payload...)}
+			}
+		}
+	})
+
+	// the data read into the piece, and the rest of the payload handed over in a pooled buffer given back once handled
+	b.Run("Pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(stream)))
+		br := bytes.NewReader(stream)
+		r := NewReader(br, 0)
+		for i := 0; i < b.N; i++ {
+			br.Reset(stream)
+			for {
+				msg, err := r.ReadPooled(block)
+				if err != nil {
+					break
+				}
+				handed = msg
+				Free(msg.Payload)
+			}
+		}
+	})
+}
+
+func BenchmarkWriteBatch(b *testing.B) {
+	const requests = 64
+	block := make([]byte, MaxBlockLength)
+
+	// every message serialized into a buffer of its own and written by itself
+	b.Run("Serialize", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < requests; j++ {
+				ioutil.Discard.Write(FormatRequest(1, j*MaxBlockLength, MaxBlockLength).Serialize())
+			}
+			ioutil.Discard.Write(FormatPiece(1, 0, block).Serialize())
+			ioutil.Discard.Write(FormatHave(1).Serialize())
+		}
+	})
+
+	// the messages buffered and written together
+	b.Run("Writer", func(b *testing.B) {
+		b.ReportAllocs()
+		w := NewWriter(ioutil.Discard)
+		piece := FormatPiece(1, 0, block)
+		for i := 0; i < b.N; i++ {
+			for j := 0; j < requests; j++ {
+				w.WriteRequest(1, j*MaxBlockLength, MaxBlockLength)
+			}
+			w.WriteMessage(piece)
+			w.WriteHave(1)
+			w.Flush()
+		}
+	})
+}
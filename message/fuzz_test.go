@@ -0,0 +1,142 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	merkle "github.com/adityameharia/gotor/merkle"
+	"runtime"
+	"testing"
+)
+
+//maxAlloc is how many bytes reading messages may allocate, on top of the largest payload any message type allows
+//with numPieces pieces, for the message itself and the bookkeeping of the runtime
+const maxAlloc = 4096
+
+//largestPayload returns the largest payload of any message type with numPieces pieces
+func largestPayload(numPieces int) int {
+	largest := 0
+	for id := 0; id < 256; id++ {
+		if max := maxPayload(messageID(id), numPieces); max > largest {
+			largest = max
+		}
+	}
+	return largest
+}
+
+//allocated returns the number of bytes f allocates
+func allocated(f func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	f()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+//frame returns a message of type id with payload, its length prefix being length instead of the actual one if it isn't 0
+func frame(id messageID, payload []byte, length uint32) []byte {
+	if length == 0 {
+		length = uint32(len(payload) + 1)
+	}
+	b := make([]byte, 5, 5+len(payload))
+	binary.BigEndian.PutUint32(b, length)
+	b[4] = byte(id)
+	return append(b, payload...)
+}
+
+//addSeeds adds messages of every type, valid or not, to the corpus of f
+func addSeeds(f *testing.F) {
+	spec := HashSpec{Index: 0, Length: 2, ProofLayers: 1}
+	seeds := [][]byte{
+		{0, 0, 0, 0},
+		(&Message{ID: Unchoke}).Serialize(),
+		FormatHave(7).Serialize(),
+		(&Message{ID: Bitfield, Payload: []byte{0xff, 0x80}}).Serialize(),
+		FormatRequest(1, 16384, 16384).Serialize(),
+		FormatPiece(1, 0, make([]byte, 64)).Serialize(),
+		FormatHashRequest(spec).Serialize(),
+		FormatHashes(spec, make([]merkle.Hash, 2), make([]merkle.Hash, 1)).Serialize(),
+		append(FormatHave(1).Serialize(), FormatPiece(2, 16, []byte("block")).Serialize()...),
+		frame(Piece, []byte{0, 0, 0, 1}, 0),
+		frame(Piece, make([]byte, 8), 0xffffffff),
+		frame(Bitfield, nil, 1<<20),
+		frame(Hashes, nil, 0x7fffffff),
+		frame(42, []byte("unknown"), 0),
+		frame(Have, []byte{0, 0}, 0),
+		{0, 0, 1},
+	}
+	for _, s := range seeds {
+		f.Add(s, uint16(0))
+		f.Add(s, uint16(16))
+	}
+}
+
+//checkMessage fails if msg has a payload longer than its type allows
+func checkMessage(t *testing.T, msg *Message, numPieces int) {
+	if msg == nil {
+		return
+	}
+	if max := maxPayload(msg.ID, numPieces); len(msg.Payload) > max {
+		t.Fatalf("Read %s message with a payload of %d bytes, at most %d are allowed", msg.name(), len(msg.Payload), max)
+	}
+}
+
+//checkErr fails if err is a *LengthError for a message which is not too long
+func checkErr(t *testing.T, err error) {
+	var lerr *LengthError
+	if errors.As(err, &lerr) && lerr.Length <= int64(lerr.Max) {
+		t.Fatalf("Refused a message which is not too long: %v", err)
+	}
+}
+
+func FuzzReadLimit(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte, numPieces uint16) {
+		r := bytes.NewReader(data)
+		for {
+			var msg *Message
+			var err error
+			n := allocated(func() {
+				msg, err = ReadLimit(r, int(numPieces))
+			})
+			if limit := uint64(largestPayload(int(numPieces)) + maxAlloc); n > limit {
+				t.Fatalf("Reading a message allocated %d bytes, more than %d", n, limit)
+			}
+			if err != nil {
+				checkErr(t, err)
+				return
+			}
+			checkMessage(t, msg, int(numPieces))
+		}
+	})
+}
+
+func FuzzReaderRead(f *testing.F) {
+	addSeeds(f)
+	f.Fuzz(func(t *testing.T, data []byte, numPieces uint16) {
+		r := NewReader(bytes.NewReader(data), int(numPieces))
+		piece := make([]byte, MaxBlockLength)
+		block := func(index, begin, length int) []byte {
+			// every other piece is read into the piece, the others into the payload
+			if index%2 == 1 || length > len(piece) {
+				return nil
+			}
+			return piece[:length]
+		}
+		for {
+			var msg *Message
+			var err error
+			n := allocated(func() {
+				msg, err = r.Read(block)
+			})
+			if limit := uint64(largestPayload(int(numPieces)) + maxAlloc); n > limit {
+				t.Fatalf("Reading a message allocated %d bytes, more than %d", n, limit)
+			}
+			if err != nil {
+				checkErr(t, err)
+				return
+			}
+			checkMessage(t, msg, int(numPieces))
+		}
+	})
+}
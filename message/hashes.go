@@ -0,0 +1,105 @@
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+	merkle "github.com/adityameharia/gotor/merkle"
+)
+
+// HashSpec identifies hashes of the merkle tree of a file, as carried by HashRequest, Hashes and HashReject messages
+type HashSpec struct {
+	// PiecesRoot is the root of the tree of the file
+	PiecesRoot merkle.Hash
+	// BaseLayer is the layer of the hashes, 0 being the leaves
+	BaseLayer int
+	// Index is the first hash in the layer and Length the number of hashes, a power of two
+	Index  int
+	Length int
+	// ProofLayers is the number of layers of uncle hashes above the hashes needed to verify them
+	ProofLayers int
+}
+
+const hashSpecLength = 32 + 4*4
+
+func (h HashSpec) serialize() []byte {
+	payload := make([]byte, hashSpecLength)
+	copy(payload, h.PiecesRoot[:])
+	binary.BigEndian.PutUint32(payload[32:36], uint32(h.BaseLayer))
+	binary.BigEndian.PutUint32(payload[36:40], uint32(h.Index))
+	binary.BigEndian.PutUint32(payload[40:44], uint32(h.Length))
+	binary.BigEndian.PutUint32(payload[44:48], uint32(h.ProofLayers))
+	return payload
+}
+
+func parseHashSpec(msg *Message, id messageID) (HashSpec, error) {
+	var h HashSpec
+	if msg.ID != id {
+		return h, fmt.Errorf("Expected ID %d, got ID %d", id, msg.ID)
+	}
+	if len(msg.Payload) < hashSpecLength {
+		return h, fmt.Errorf("Payload too short. %d < %d", len(msg.Payload), hashSpecLength)
+	}
+	copy(h.PiecesRoot[:], msg.Payload)
+	h.BaseLayer = int(binary.BigEndian.Uint32(msg.Payload[32:36]))
+	h.Index = int(binary.BigEndian.Uint32(msg.Payload[36:40]))
+	h.Length = int(binary.BigEndian.Uint32(msg.Payload[40:44]))
+	h.ProofLayers = int(binary.BigEndian.Uint32(msg.Payload[44:48]))
+	return h, nil
+}
+
+// FormatHashRequest creates a HASH REQUEST message
+func FormatHashRequest(h HashSpec) *Message {
+	return &Message{ID: HashRequest, Payload: h.serialize()}
+}
+
+// ParseHashRequest parses a HASH REQUEST message
+func ParseHashRequest(msg *Message) (HashSpec, error) {
+	h, err := parseHashSpec(msg, HashRequest)
+	if err == nil && len(msg.Payload) != hashSpecLength {
+		err = fmt.Errorf("Expected payload length %d, got length %d", hashSpecLength, len(msg.Payload))
+	}
+	return h, err
+}
+
+// FormatHashReject creates a HASH REJECT message refusing the request h
+func FormatHashReject(h HashSpec) *Message {
+	return &Message{ID: HashReject, Payload: h.serialize()}
+}
+
+// ParseHashReject parses a HASH REJECT message
+func ParseHashReject(msg *Message) (HashSpec, error) {
+	h, err := parseHashSpec(msg, HashReject)
+	if err == nil && len(msg.Payload) != hashSpecLength {
+		err = fmt.Errorf("Expected payload length %d, got length %d", hashSpecLength, len(msg.Payload))
+	}
+	return h, err
+}
+
+// FormatHashes creates a HASHES message answering h with the hashes asked for followed by the proof
+func FormatHashes(h HashSpec, hashes []merkle.Hash, proof []merkle.Hash) *Message {
+	payload := h.serialize()
+	for _, hash := range hashes {
+		payload = append(payload, hash[:]...)
+	}
+	for _, hash := range proof {
+		payload = append(payload, hash[:]...)
+	}
+	return &Message{ID: Hashes, Payload: payload}
+}
+
+// ParseHashes parses a HASHES message into its spec, the Length hashes asked for and the proof which follows them
+func ParseHashes(msg *Message) (HashSpec, []merkle.Hash, []merkle.Hash, error) {
+	h, err := parseHashSpec(msg, Hashes)
+	if err != nil {
+		return h, nil, nil, err
+	}
+	rest := msg.Payload[hashSpecLength:]
+	if len(rest)%32 != 0 || h.Length <= 0 || len(rest)/32 < h.Length {
+		return h, nil, nil, fmt.Errorf("Invalid hashes payload length %d for %d hashes", len(msg.Payload), h.Length)
+	}
+	all := make([]merkle.Hash, len(rest)/32)
+	for i := range all {
+		copy(all[i][:], rest[i*32:])
+	}
+	return h, all[:h.Length], all[h.Length:], nil
+}
@@ -0,0 +1,88 @@
+package message
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MaxBlockLength is the largest block of data a Piece message may carry
+const MaxBlockLength = 16384
+
+const (
+	//maxBitfield is the largest Bitfield accepted when the number of pieces is not known, enough for 2M pieces
+	maxBitfield = 1 << 18
+	//maxHashes is the largest number of hashes of a Hashes message, 512 asked for and the proof of a tree of 2^32 blocks
+	maxHashes = 512 + 32
+	//maxUnknown is the largest message of a type we don't know, which is read and ignored
+	maxUnknown = 2 * MaxBlockLength
+)
+
+// LengthError is returned when the length prefix of a message is more than its type allows.
+// The peer is either broken or malicious and should be disconnected.
+type LengthError struct {
+	ID     messageID
+	Length int64
+	Max    int
+}
+
+func (e *LengthError) Error() string {
+	m := Message{ID: e.ID}
+	return fmt.Sprintf("%s message with a payload of %d bytes, at most %d are allowed", m.name(), e.Length, e.Max)
+}
+
+//maxPayload returns the largest payload a message of type id may have, numPieces being the number of pieces of the torrent or 0 if it is not known
+func maxPayload(id messageID, numPieces int) int {
+	switch id {
+	case Choke, Unchoke, Interested, NotInterested:
+		return 0
+	case Have:
+		return 4
+	case Bitfield:
+		if numPieces > 0 {
+			return (numPieces + 7) / 8
+		}
+		return maxBitfield
+	case Request, Cancel:
+		return 12
+	case Piece:
+		return 8 + MaxBlockLength
+	case HashRequest, HashReject:
+		return hashSpecLength
+	case Hashes:
+		return hashSpecLength + 32*maxHashes
+	}
+	return maxUnknown
+}
+
+// ReadLimit reads a message from r like Read, but checks its length against the largest its type allows before allocating it,
+// the largest Bitfield being sized by numPieces. A *LengthError is returned for a message which is too long.
+func ReadLimit(r io.Reader, numPieces int) (*Message, error) {
+	var header [5]byte
+	_, err := io.ReadFull(r, header[:4])
+	if err != nil {
+		return nil, err
+	}
+
+	l := binary.BigEndian.Uint32(header[:4])
+	if l == 0 {
+		return nil, nil
+	}
+
+	_, err = io.ReadFull(r, header[4:])
+	if err != nil {
+		return nil, err
+	}
+	id := messageID(header[4])
+	max := maxPayload(id, numPieces)
+	if int64(l)-1 > int64(max) {
+		return nil, &LengthError{ID: id, Length: int64(l) - 1, Max: max}
+	}
+
+	payload := make([]byte, l-1)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{ID: id, Payload: payload}, nil
+}
@@ -34,36 +34,20 @@ const (
 	Piece messageID = 7
 	// Cancel cancels a request
 	Cancel messageID = 8
+	// HashRequest asks for hashes of the merkle tree of a file (BEP 52)
+	HashRequest messageID = 21
+	// Hashes delivers the hashes asked for by a HashRequest, with their proof
+	Hashes messageID = 22
+	// HashReject refuses a HashRequest
+	HashReject messageID = 23
 )
 
 //Read reads a message from stream.
 //The first 4 bytes of the stream gives the length of the message and hence we get the length then read that many bytes from string.
 //Return nil on keep alive msg,i.e to not close the connection
+//Messages longer than their type allows are refused as with ReadLimit, without knowing the number of pieces.
 func Read(r io.Reader) (*Message, error) {
-	buf := make([]byte, 4)
-
-	_, err := io.ReadFull(r, buf)
-	if err != nil {
-		return nil, err
-	}
-
-	l := binary.BigEndian.Uint32(buf)
-	if l == 0 {
-		return nil, nil
-	}
-
-	msg := make([]byte, l)
-	_, err = io.ReadFull(r, msg)
-	if err != nil {
-		return nil, err
-	}
-
-	m := Message{
-		ID:      messageID(msg[0]),
-		Payload: msg[1:],
-	}
-
-	return &m, nil
+	return ReadLimit(r, 0)
 }
 
 func (m *Message) String() string {
@@ -96,6 +80,12 @@ func (m *Message) name() string {
 		return "Piece"
 	case Cancel:
 		return "Cancel"
+	case HashRequest:
+		return "HashRequest"
+	case Hashes:
+		return "Hashes"
+	case HashReject:
+		return "HashReject"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
@@ -125,6 +115,29 @@ func FormatRequest(index, begin, length int) *Message {
 	return &Message{ID: Request, Payload: payload}
 }
 
+// ParseRequest parses a REQUEST message
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	if msg.ID != Request {
+		return 0, 0, 0, fmt.Errorf("Expected REQUEST (ID %d), got ID %d", Request, msg.ID)
+	}
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("Expected payload length 12, got length %d", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
+// FormatPiece creates a PIECE message carrying a block of a piece
+func FormatPiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: Piece, Payload: payload}
+}
+
 // ParseHave parses a HAVE message
 func ParseHave(msg *Message) (int, error) {
 	if msg.ID != Have {
@@ -0,0 +1,34 @@
+package message
+
+//poolSize is the number of payload buffers kept for reuse, and poolBuffer the capacity of each, enough for a Piece message
+const (
+	poolSize   = 256
+	poolBuffer = 8 + MaxBlockLength
+)
+
+//pool holds the payload buffers given back with Free
+var pool = make(chan []byte, poolSize)
+
+// Buffer returns a buffer of n bytes for a payload, reusing one given back with Free when it is large enough
+func Buffer(n int) []byte {
+	if n > poolBuffer {
+		return make([]byte, n)
+	}
+	select {
+	case b := <-pool:
+		return b[:n]
+	default:
+		return make([]byte, n, poolBuffer)
+	}
+}
+
+// Free gives back a buffer returned by Buffer for reuse, which must not be used anymore
+func Free(b []byte) {
+	if cap(b) != poolBuffer {
+		return
+	}
+	select {
+	case pool <- b:
+	default:
+	}
+}
@@ -0,0 +1,111 @@
+package message
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// BlockFunc returns where the data of a Piece message for block begin of piece index goes,
+// a slice of length bytes, or nil if the block is not wanted
+type BlockFunc func(index, begin, length int) []byte
+
+// Reader reads the messages of a connection through a buffer, reusing the memory of their payloads.
+// The data of Piece messages can be read straight into the piece it belongs to.
+type Reader struct {
+	r         *bufio.Reader
+	numPieces int
+	header    [13]byte
+	buf       []byte
+	msg       Message
+}
+
+// NewReader returns a Reader of the messages of r, refusing the ones which are too long as ReadLimit does
+func NewReader(r io.Reader, numPieces int) *Reader {
+	return &Reader{r: bufio.NewReaderSize(r, 2*MaxBlockLength), numPieces: numPieces}
+}
+
+// Read reads the next message, nil being a keep-alive. The message is only valid until the next call.
+// If block is not nil, it is asked where the data of a Piece message goes. When it returns a slice, the data is read into it,
+// and the payload of the message is only the index and begin of the block, without the data.
+func (r *Reader) Read(block BlockFunc) (*Message, error) {
+	id, payload, ok, err := r.read(block, r.payload)
+	if err != nil || !ok {
+		return nil, err
+	}
+	r.msg = Message{ID: id, Payload: payload}
+	return &r.msg, nil
+}
+
+// ReadPooled reads the next message like Read, but its payload is taken from Buffer and belongs to the caller,
+// who may keep it or give it back with Free once done with it
+func (r *Reader) ReadPooled(block BlockFunc) (*Message, error) {
+	id, payload, ok, err := r.read(block, Buffer)
+	if err != nil || !ok {
+		return nil, err
+	}
+	return &Message{ID: id, Payload: payload}, nil
+}
+
+//read reads the next message into a payload of n bytes from alloc, ok being false for a keep-alive
+func (r *Reader) read(block BlockFunc, alloc func(n int) []byte) (id messageID, payload []byte, ok bool, err error) {
+	_, err = io.ReadFull(r.r, r.header[:4])
+	if err != nil {
+		return 0, nil, false, err
+	}
+
+	l := binary.BigEndian.Uint32(r.header[:4])
+	if l == 0 {
+		return 0, nil, false, nil
+	}
+	b, err := r.r.ReadByte()
+	if err != nil {
+		return 0, nil, false, err
+	}
+	id = messageID(b)
+	max := maxPayload(id, r.numPieces)
+	if int64(l)-1 > int64(max) {
+		return 0, nil, false, &LengthError{ID: id, Length: int64(l) - 1, Max: max}
+	}
+	n := int(l) - 1
+
+	if id == Piece && block != nil && n >= 8 {
+		_, err = io.ReadFull(r.r, r.header[5:13])
+		if err != nil {
+			return 0, nil, false, err
+		}
+		index := int(binary.BigEndian.Uint32(r.header[5:9]))
+		begin := int(binary.BigEndian.Uint32(r.header[9:13]))
+		if dst := block(index, begin, n-8); dst != nil {
+			_, err = io.ReadFull(r.r, dst[:n-8])
+			if err != nil {
+				return 0, nil, false, err
+			}
+			payload = alloc(8)
+			copy(payload, r.header[5:13])
+			return Piece, payload, true, nil
+		}
+		payload = alloc(n)
+		copy(payload, r.header[5:13])
+		_, err = io.ReadFull(r.r, payload[8:])
+		if err != nil {
+			return 0, nil, false, err
+		}
+		return Piece, payload, true, nil
+	}
+
+	payload = alloc(n)
+	_, err = io.ReadFull(r.r, payload)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	return id, payload, true, nil
+}
+
+//payload returns the buffer of the reader, grown to n bytes if needed
+func (r *Reader) payload(n int) []byte {
+	if cap(r.buf) < n {
+		r.buf = make([]byte, n)
+	}
+	return r.buf[:n]
+}
@@ -0,0 +1,66 @@
+package message
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// Writer buffers the messages sent on a connection until Flush, so that they are written together
+// without allocating a buffer for each of them
+type Writer struct {
+	w      *bufio.Writer
+	header [17]byte
+}
+
+// NewWriter returns a Writer of messages to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriterSize(w, 2*MaxBlockLength)}
+}
+
+// WriteMessage writes m, nil being a keep-alive
+func (w *Writer) WriteMessage(m *Message) error {
+	if m == nil {
+		binary.BigEndian.PutUint32(w.header[:4], 0)
+		_, err := w.w.Write(w.header[:4])
+		return err
+	}
+	binary.BigEndian.PutUint32(w.header[:4], uint32(len(m.Payload)+1))
+	w.header[4] = byte(m.ID)
+	_, err := w.w.Write(w.header[:5])
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(m.Payload)
+	return err
+}
+
+// WriteRequest writes a Request message
+func (w *Writer) WriteRequest(index, begin, length int) error {
+	binary.BigEndian.PutUint32(w.header[0:4], 13)
+	w.header[4] = byte(Request)
+	binary.BigEndian.PutUint32(w.header[5:9], uint32(index))
+	binary.BigEndian.PutUint32(w.header[9:13], uint32(begin))
+	binary.BigEndian.PutUint32(w.header[13:17], uint32(length))
+	_, err := w.w.Write(w.header[:17])
+	return err
+}
+
+// WriteHave writes a Have message
+func (w *Writer) WriteHave(index int) error {
+	binary.BigEndian.PutUint32(w.header[0:4], 5)
+	w.header[4] = byte(Have)
+	binary.BigEndian.PutUint32(w.header[5:9], uint32(index))
+	_, err := w.w.Write(w.header[:9])
+	return err
+}
+
+// Buffered returns the number of bytes written but not flushed yet
+func (w *Writer) Buffered() int {
+	return w.w.Buffered()
+}
+
+// Flush writes the buffered messages to the connection
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
@@ -0,0 +1,216 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Initiate performs the MSE handshake as the connecting side, for the torrent with infohash skey.
+// The returned connection carries the BitTorrent handshake and everything after it.
+func Initiate(conn net.Conn, skey [20]byte, policy Policy) (*Conn, error) {
+	if policy == Disable {
+		return nil, ErrEncryptionRefused
+	}
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	// 1. A->B: Ya, PadA
+	padA, err := randomPad()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(append([]byte{}, keys.public...), padA...))
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. B->A: Yb, PadB
+	br := bufio.NewReaderSize(conn, keySize+maxPad+64)
+	first, err := br.Peek(20)
+	if err != nil {
+		return nil, err
+	}
+	if IsPlaintext(first) {
+		return nil, ErrPlaintextRefused
+	}
+	yb := make([]byte, keySize)
+	_, err = io.ReadFull(br, yb)
+	if err != nil {
+		return nil, err
+	}
+	s, err := keys.secret(yb)
+	if err != nil {
+		return nil, err
+	}
+
+	enc := newCipher("keyA", s, skey[:])
+	dec := newCipher("keyB", s, skey[:])
+
+	// 3. A->B: HASH('req1', S), HASH('req2', SKEY) xor HASH('req3', S), ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA))
+	var msg bytes.Buffer
+	msg.Write(hash([]byte("req1"), s))
+	req2 := hash([]byte("req2"), skey[:])
+	req3 := hash([]byte("req3"), s)
+	for i := range req2 {
+		req2[i] ^= req3[i]
+	}
+	msg.Write(req2)
+
+	plain := make([]byte, 8+4+2+2)
+	binary.BigEndian.PutUint32(plain[8:12], policy.provide())
+	// no PadC and no initial payload, the BitTorrent handshake follows on the stream
+	encrypted := make([]byte, len(plain))
+	enc.XORKeyStream(encrypted, plain)
+	msg.Write(encrypted)
+
+	_, err = conn.Write(msg.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD), PadB being skipped by looking for the encrypted VC
+	encVC := make([]byte, len(vc))
+	dec.XORKeyStream(encVC, vc)
+	err = syncTo(br, encVC, maxPad+len(vc))
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := readDecrypted(br, dec, 4+2)
+	if err != nil {
+		return nil, err
+	}
+	method := binary.BigEndian.Uint32(head[0:4])
+	padLen := int(binary.BigEndian.Uint16(head[4:6]))
+	if padLen > maxPad {
+		return nil, fmt.Errorf("PadD too long: %d", padLen)
+	}
+	_, err = readDecrypted(br, dec, padLen)
+	if err != nil {
+		return nil, err
+	}
+
+	if method != cryptoRC4 && method != cryptoPlaintext || method&policy.provide() == 0 {
+		return nil, fmt.Errorf("Peer selected crypto method %#x which we did not provide", method)
+	}
+	return newConn(conn, br, method, enc, dec, nil), nil
+}
+
+// Receive performs the MSE handshake as the accepting side.
+// skeys are the infohashes of the torrents we serve, the one picked by the peer is returned.
+// Connections which start with a plaintext BitTorrent handshake should not be passed to Receive, see IsPlaintext.
+func Receive(conn net.Conn, skeys [][20]byte, policy Policy) (*Conn, [20]byte, error) {
+	var skey [20]byte
+	if policy == Disable {
+		return nil, skey, ErrEncryptionRefused
+	}
+	keys, err := newKeyPair()
+	if err != nil {
+		return nil, skey, err
+	}
+
+	// 1. A->B: Ya, PadA
+	br := bufio.NewReaderSize(conn, keySize+maxPad+64)
+	ya := make([]byte, keySize)
+	_, err = io.ReadFull(br, ya)
+	if err != nil {
+		return nil, skey, err
+	}
+	s, err := keys.secret(ya)
+	if err != nil {
+		return nil, skey, err
+	}
+
+	// 2. B->A: Yb, PadB
+	padB, err := randomPad()
+	if err != nil {
+		return nil, skey, err
+	}
+	_, err = conn.Write(append(append([]byte{}, keys.public...), padB...))
+	if err != nil {
+		return nil, skey, err
+	}
+
+	// 3. A->B: HASH('req1', S) after PadA, then HASH('req2', SKEY) xor HASH('req3', S)
+	err = syncTo(br, hash([]byte("req1"), s), maxPad+20)
+	if err != nil {
+		return nil, skey, err
+	}
+	obfuscated := make([]byte, 20)
+	_, err = io.ReadFull(br, obfuscated)
+	if err != nil {
+		return nil, skey, err
+	}
+	req3 := hash([]byte("req3"), s)
+	for i := range obfuscated {
+		obfuscated[i] ^= req3[i]
+	}
+	found := false
+	for _, k := range skeys {
+		if bytes.Equal(hash([]byte("req2"), k[:]), obfuscated) {
+			skey, found = k, true
+			break
+		}
+	}
+	if !found {
+		return nil, skey, errors.New("Peer asked for a torrent we don't have")
+	}
+
+	dec := newCipher("keyA", s, skey[:])
+	enc := newCipher("keyB", s, skey[:])
+
+	// ENCRYPT(VC, crypto_provide, len(PadC), PadC, len(IA)), ENCRYPT(IA)
+	head, err := readDecrypted(br, dec, 8+4+2)
+	if err != nil {
+		return nil, skey, err
+	}
+	if !bytes.Equal(head[:8], vc) {
+		return nil, skey, errors.New("Invalid verification constant")
+	}
+	provided := binary.BigEndian.Uint32(head[8:12])
+	padLen := int(binary.BigEndian.Uint16(head[12:14]))
+	if padLen > maxPad {
+		return nil, skey, fmt.Errorf("PadC too long: %d", padLen)
+	}
+	_, err = readDecrypted(br, dec, padLen)
+	if err != nil {
+		return nil, skey, err
+	}
+	l, err := readDecrypted(br, dec, 2)
+	if err != nil {
+		return nil, skey, err
+	}
+	initial, err := readDecrypted(br, dec, int(binary.BigEndian.Uint16(l)))
+	if err != nil {
+		return nil, skey, err
+	}
+
+	method, err := policy.choose(provided)
+	if err != nil {
+		return nil, skey, err
+	}
+
+	// 4. B->A: ENCRYPT(VC, crypto_select, len(padD), padD) without padD
+	reply := make([]byte, 8+4+2)
+	binary.BigEndian.PutUint32(reply[8:12], method)
+	enc.XORKeyStream(reply, reply)
+	_, err = conn.Write(reply)
+	if err != nil {
+		return nil, skey, err
+	}
+
+	return newConn(conn, br, method, enc, dec, initial), skey, nil
+}
+
+// IsPlaintext tells if the first bytes received on a connection are a plaintext BitTorrent handshake
+// rather than the public key of an MSE handshake. 20 bytes are enough to tell.
+func IsPlaintext(first []byte) bool {
+	return bytes.HasPrefix(first, []byte("\x13BitTorrent protocol"))
+}
@@ -0,0 +1,256 @@
+//Package mse implements Message Stream Encryption, the obfuscated handshake and RC4 stream which hide BitTorrent traffic from middleboxes
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Policy tells whether connections are encrypted
+type Policy int
+
+const (
+	// Disable only makes plaintext connections and refuses encrypted ones
+	Disable Policy = iota
+	// Prefer encrypts whenever the peer supports it and falls back to plaintext otherwise
+	Prefer
+	// Require refuses every connection which isn't RC4 encrypted
+	Require
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Disable:
+		return "disable"
+	case Prefer:
+		return "prefer"
+	case Require:
+		return "require"
+	default:
+		return fmt.Sprintf("policy(%d)", int(p))
+	}
+}
+
+// ParsePolicy converts one of disable, prefer or require to a Policy
+func ParsePolicy(s string) (Policy, error) {
+	switch strings.ToLower(s) {
+	case "disable", "disabled":
+		return Disable, nil
+	case "prefer", "preferred":
+		return Prefer, nil
+	case "require", "required":
+		return Require, nil
+	}
+	return 0, fmt.Errorf("Unknown encryption policy %q", s)
+}
+
+// crypto methods offered in crypto_provide and picked in crypto_select
+const (
+	cryptoPlaintext = 1
+	cryptoRC4       = 2
+)
+
+const (
+	keySize = 96
+	maxPad  = 512
+)
+
+// dhPrime is the 768 bit safe prime of the Diffie-Hellman exchange and dhGenerator its generator
+var (
+	dhPrime, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	dhGenerator = big.NewInt(2)
+)
+
+// vc is the verification constant, 8 zero bytes
+var vc = make([]byte, 8)
+
+// ErrPlaintextRefused is returned when the policy requires encryption but the peer only does plaintext
+var ErrPlaintextRefused = errors.New("Peer does not support encryption")
+
+// ErrEncryptionRefused is returned when an encrypted handshake is received but encryption is disabled
+var ErrEncryptionRefused = errors.New("Encryption is disabled")
+
+//keyPair is our side of the Diffie-Hellman exchange
+type keyPair struct {
+	private *big.Int
+	public  []byte
+}
+
+func newKeyPair() (*keyPair, error) {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	priv := new(big.Int).SetBytes(b)
+	pub := new(big.Int).Exp(dhGenerator, priv, dhPrime)
+	return &keyPair{private: priv, public: pad(pub.Bytes())}, nil
+}
+
+//secret computes the shared secret S from the public key of the peer
+func (k *keyPair) secret(peerPublic []byte) ([]byte, error) {
+	y := new(big.Int).SetBytes(peerPublic)
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(new(big.Int).Sub(dhPrime, big.NewInt(1))) >= 0 {
+		return nil, errors.New("Invalid Diffie-Hellman public key")
+	}
+	return pad(new(big.Int).Exp(y, k.private, dhPrime).Bytes()), nil
+}
+
+//pad left pads b with zeros to keySize bytes
+func pad(b []byte) []byte {
+	if len(b) >= keySize {
+		return b
+	}
+	res := make([]byte, keySize)
+	copy(res[keySize-len(b):], b)
+	return res
+}
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+//newCipher creates the RC4 stream for key name ("keyA" or "keyB") with the first 1024 bytes discarded
+func newCipher(name string, s []byte, skey []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(hash([]byte(name), s, skey))
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+//randomPad returns between 0 and maxPad random bytes
+func randomPad() ([]byte, error) {
+	n := make([]byte, 2)
+	_, err := rand.Read(n)
+	if err != nil {
+		return nil, err
+	}
+	p := make([]byte, int(binary.BigEndian.Uint16(n))%(maxPad+1))
+	_, err = rand.Read(p)
+	return p, err
+}
+
+//provide returns the crypto_provide bitfield allowed by the policy
+func (p Policy) provide() uint32 {
+	switch p {
+	case Require:
+		return cryptoRC4
+	case Disable:
+		return cryptoPlaintext
+	default:
+		return cryptoRC4 | cryptoPlaintext
+	}
+}
+
+//choose picks the method to use among the ones provided by the peer
+func (p Policy) choose(provided uint32) (uint32, error) {
+	allowed := provided & p.provide()
+	if allowed&cryptoRC4 != 0 {
+		return cryptoRC4, nil
+	}
+	if allowed&cryptoPlaintext != 0 {
+		return cryptoPlaintext, nil
+	}
+	if p == Require {
+		return 0, ErrPlaintextRefused
+	}
+	return 0, fmt.Errorf("No common crypto method in %#x", provided)
+}
+
+// Conn is a connection after the MSE handshake, encrypted with RC4 or plaintext depending on what was negotiated
+type Conn struct {
+	net.Conn
+	r         io.Reader
+	enc       *rc4.Cipher
+	wmu       sync.Mutex
+	encrypted bool
+}
+
+// Encrypted tells if RC4 was negotiated, otherwise the payload goes in plaintext
+func (c *Conn) Encrypted() bool {
+	return c.encrypted
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
+
+//newConn builds the connection once the handshake is done, br holding whatever was read past it
+func newConn(conn net.Conn, br *bufio.Reader, method uint32, enc, dec *rc4.Cipher, initial []byte) *Conn {
+	var r io.Reader = br
+	c := &Conn{Conn: conn}
+	if method == cryptoRC4 {
+		r = &cipherReader{r: br, c: dec}
+		c.enc = enc
+		c.encrypted = true
+	}
+	if len(initial) > 0 {
+		r = io.MultiReader(bytes.NewReader(initial), r)
+	}
+	c.r = r
+	return c
+}
+
+type cipherReader struct {
+	r io.Reader
+	c *rc4.Cipher
+}
+
+func (r *cipherReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.c.XORKeyStream(b[:n], b[:n])
+	return n, err
+}
+
+//readDecrypted reads exactly n bytes from r and decrypts them with c
+func readDecrypted(r io.Reader, c *rc4.Cipher, n int) ([]byte, error) {
+	b := make([]byte, n)
+	_, err := io.ReadFull(r, b)
+	if err != nil {
+		return nil, err
+	}
+	c.XORKeyStream(b, b)
+	return b, nil
+}
+
+//syncTo reads from r until pattern has been read, giving up after max bytes
+func syncTo(r *bufio.Reader, pattern []byte, max int) error {
+	window := make([]byte, 0, max)
+	for len(window) < max {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return errors.New("Could not find the synchronisation point of the encrypted handshake")
+}
@@ -0,0 +1,118 @@
+package peer
+
+import (
+	"bytes"
+	connection "github.com/adityameharia/gotor/connection"
+)
+
+// DefaultMaxStrikes is the number of corrupt pieces after which a peer is banned when Torrent.MaxStrikes is 0
+const DefaultMaxStrikes = 3
+
+//failedPiece keeps the data of a piece which failed the integrity check, along with who sent each block,
+//so that the culprit can be found by comparing it with the data once the piece has been verified
+type failedPiece struct {
+	buf     []byte
+	sources []Peer
+}
+
+//blockSources returns a slice with room for the peer of every block of a piece of length bytes
+func blockSources(length int) []Peer {
+	return make([]Peer, (length+MaxBlockSize-1)/MaxBlockSize)
+}
+
+//pieceFailed records a piece which failed the integrity check.
+//If a single peer sent all of it, that peer gets a strike straight away,
+//otherwise the piece is kept until a verified copy shows which blocks were corrupt.
+func (t *Torrent) pieceFailed(index int, buf []byte, sources []Peer) {
+	senders := make(map[string]Peer)
+	for _, p := range sources {
+		if p.IP != nil {
+			senders[p.IP.String()] = p
+		}
+	}
+	if len(senders) == 1 {
+		for _, p := range senders {
+			t.strike(p, index)
+		}
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.failed == nil {
+		t.failed = make(map[int]*failedPiece)
+	}
+	t.failed[index] = &failedPiece{buf: buf, sources: sources}
+}
+
+//pieceVerified compares buf with a previously failed download of the same piece and strikes every peer which sent a corrupt block
+func (t *Torrent) pieceVerified(index int, buf []byte) {
+	t.mu.Lock()
+	f := t.failed[index]
+	delete(t.failed, index)
+	t.mu.Unlock()
+	if f == nil {
+		return
+	}
+
+	culprits := make(map[string]Peer)
+	for i, p := range f.sources {
+		begin := i * MaxBlockSize
+		end := begin + MaxBlockSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+		if p.IP != nil && !bytes.Equal(f.buf[begin:end], buf[begin:end]) {
+			culprits[p.IP.String()] = p
+		}
+	}
+	for _, p := range culprits {
+		t.strike(p, index)
+	}
+}
+
+//strike counts one more corrupt piece sent by p, and once it reaches the limit bans p and closes its connections
+func (t *Torrent) strike(p Peer, index int) {
+	max := t.MaxStrikes
+	if max <= 0 {
+		max = DefaultMaxStrikes
+	}
+
+	t.mu.Lock()
+	if t.strikes == nil {
+		t.strikes = make(map[string]int)
+		t.banned = make(map[string]bool)
+	}
+	ip := p.IP.String()
+	t.strikes[ip]++
+	strikes := t.strikes[ip]
+	ban := strikes >= max && !t.banned[ip]
+	var conns []*connection.Client
+	if ban {
+		t.banned[ip] = true
+		// every connection from the address is dropped, not only the one which sent the piece
+		for c, cp := range t.conns {
+			if cp.IP.Equal(p.IP) {
+				conns = append(conns, c)
+			}
+		}
+	}
+	t.mu.Unlock()
+
+	log := t.log().With("peer", p.String())
+	log.Warnf("Peer sent corrupt data for piece #%d (%d/%d strikes)", index, strikes, max)
+	if ban {
+		log.Warnf("Banned peer for sending corrupt data, closing its %d connections", len(conns))
+		for _, c := range conns {
+			c.Close()
+		}
+		t.emit(Event{Type: PeerBanned, Peer: p, Piece: index})
+	}
+}
+
+// Banned tells if the peer has been banned for sending corrupt data
+func (t *Torrent) Banned(p Peer) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.banned[p.IP.String()]
+}
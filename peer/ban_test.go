@@ -0,0 +1,105 @@
+package peer
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	connection "github.com/adityameharia/gotor/connection"
+)
+
+//connect opens a connection from tor to the seed at addr with a peer ID ending in id, and registers it as coming from ip
+func connect(t *testing.T, tor *Torrent, addr Peer, id byte, ip string) (*connection.Client, Peer) {
+	pid := append([]byte("-GT0001-00000000000"), id)
+	c, err := connection.New(context.Background(), addr.String(), pid, tor.InfoHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	p := Peer{IP: net.ParseIP(ip), Port: 6881}
+	if err := tor.register(c, p); err != nil {
+		t.Fatal(err)
+	}
+	return c, p
+}
+
+//closed tells if the connection gets closed within a second
+func closed(c *connection.Client) bool {
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case ev, ok := <-c.Events():
+			if !ok {
+				return true
+			}
+			ev.Release()
+		case <-timeout:
+			return false
+		}
+	}
+}
+
+func TestBanCulprit(t *testing.T) {
+	data := testData(2*testPieceLength, 3)
+	_, addr := seed(t, data, 1)
+
+	tor := newTestTorrent(data, 2)
+	tor.MaxStrikes = 1
+	tor.init()
+	var banned []Peer
+	tor.OnEvent = func(e Event) {
+		if e.Type == PeerBanned {
+			banned = append(banned, e.Peer)
+		}
+	}
+
+	honest, h := connect(t, tor, addr, 3, "10.0.0.1")
+	cheater, c := connect(t, tor, addr, 4, "10.0.0.2")
+	// a second connection from the same address must be dropped too
+	again, _ := connect(t, tor, addr, 5, "10.0.0.2")
+
+	// the first block of piece #1 comes from the honest peer and the second one, corrupt, from the cheater
+	piece := data[testPieceLength:]
+	corrupt := append([]byte(nil), piece...)
+	corrupt[MaxBlockSize+10] ^= 0xff
+	tor.pieceFailed(1, corrupt, []Peer{h, c})
+	if tor.Banned(h) || tor.Banned(c) {
+		t.Fatal("Banned a peer before knowing which block was corrupt")
+	}
+
+	// the re-download tells which block was corrupt
+	tor.pieceVerified(1, piece)
+	if tor.Banned(h) {
+		t.Error("Banned the peer which sent a valid block")
+	}
+	if !tor.Banned(c) {
+		t.Error("Did not ban the peer which sent the corrupt block")
+	}
+	if len(banned) != 1 || !banned[0].IP.Equal(c.IP) {
+		t.Errorf("Got PeerBanned events for %v, want %v", banned, c)
+	}
+	if !closed(cheater) || !closed(again) {
+		t.Error("The connections of the banned peer were not closed")
+	}
+	if closed(honest) {
+		t.Error("Closed the connection of the peer which sent a valid block")
+	}
+}
+
+func TestBanSingleSender(t *testing.T) {
+	data := testData(testPieceLength, 4)
+	tor := newTestTorrent(data, 1)
+	tor.init()
+	p := Peer{IP: net.ParseIP("10.0.0.1"), Port: 6881}
+	sources := []Peer{p, p}
+	for i := 0; i < DefaultMaxStrikes; i++ {
+		if tor.Banned(p) {
+			t.Fatalf("Banned after %d corrupt pieces, want %d", i, DefaultMaxStrikes)
+		}
+		tor.pieceFailed(0, data, sources)
+	}
+	if !tor.Banned(p) {
+		t.Fatalf("Not banned after %d corrupt pieces", DefaultMaxStrikes)
+	}
+}
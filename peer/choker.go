@@ -0,0 +1,168 @@
+package peer
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ChokeInterval is how often the choker re-evaluates which peers to unchoke
+const ChokeInterval = 10 * time.Second
+
+// OptimisticUnchokeInterval is how often the optimistic unchoke slots are rotated
+const OptimisticUnchokeInterval = 30 * time.Second
+
+// DefaultUnchokeSlots is the number of peers unchoked for their rate when Torrent.UnchokeSlots is 0
+const DefaultUnchokeSlots = 4
+
+// DefaultOptimisticUnchokeSlots is the number of optimistic unchokes when Torrent.OptimisticUnchokeSlots is 0
+const DefaultOptimisticUnchokeSlots = 1
+
+//choker implements tit-for-tat: the interested peers which upload the most to us (or which we upload
+//the most to, once we are seeding) are unchoked, plus a few random ones so that new peers get a chance
+type choker struct {
+	slots           int
+	optimisticSlots int
+	seeding         func() bool
+
+	mu         sync.Mutex
+	peers      map[chokable]*chokeState
+	optimistic map[chokable]bool
+}
+
+//chokable is the part of a connection the choker uses, as implemented by *connection.Client
+type chokable interface {
+	BytesRead() int64
+	BytesWritten() int64
+	PeerInterested() bool
+	AmChoking() bool
+	SendChoke() error
+	SendUnchoke() error
+}
+
+type chokeState struct {
+	lastRead    int64
+	lastWritten int64
+	rate        int64
+}
+
+func newChoker(slots, optimisticSlots int, seeding func() bool) *choker {
+	if slots <= 0 {
+		slots = DefaultUnchokeSlots
+	}
+	if optimisticSlots <= 0 {
+		optimisticSlots = DefaultOptimisticUnchokeSlots
+	}
+	return &choker{
+		slots:           slots,
+		optimisticSlots: optimisticSlots,
+		seeding:         seeding,
+		peers:           make(map[chokable]*chokeState),
+		optimistic:      make(map[chokable]bool),
+	}
+}
+
+//add starts managing the choke state of c
+func (ch *choker) add(c chokable) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.peers[c] = &chokeState{lastRead: c.BytesRead(), lastWritten: c.BytesWritten()}
+}
+
+//remove stops managing c, usually because it disconnected
+func (ch *choker) remove(c chokable) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	delete(ch.peers, c)
+	delete(ch.optimistic, c)
+}
+
+//run re-evaluates the unchoked peers every ChokeInterval until ctx is done
+func (ch *choker) run(ctx context.Context) {
+	ticker := time.NewTicker(ChokeInterval)
+	defer ticker.Stop()
+
+	rounds := 0
+	rotateEvery := int(OptimisticUnchokeInterval / ChokeInterval)
+	for {
+		select {
+		case <-ticker.C:
+			ch.rechoke(rounds%rotateEvery == 0)
+			rounds++
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+//rechoke updates the rates of every peer, picks the ones to unchoke and sends the choke messages which changed.
+//If rotate is set, new optimistic unchokes are picked.
+func (ch *choker) rechoke(rotate bool) {
+	ch.mu.Lock()
+	seeding := ch.seeding()
+
+	var interested []chokable
+	for c, s := range ch.peers {
+		read, written := c.BytesRead(), c.BytesWritten()
+		if seeding {
+			s.rate = written - s.lastWritten
+		} else {
+			s.rate = read - s.lastRead
+		}
+		s.lastRead, s.lastWritten = read, written
+
+		if c.PeerInterested() {
+			interested = append(interested, c)
+		}
+	}
+
+	sort.Slice(interested, func(i, j int) bool {
+		return ch.peers[interested[i]].rate > ch.peers[interested[j]].rate
+	})
+
+	unchoke := make(map[chokable]bool)
+	for i := 0; i < len(interested) && i < ch.slots; i++ {
+		unchoke[interested[i]] = true
+	}
+
+	if rotate {
+		ch.optimistic = make(map[chokable]bool)
+	}
+	// drop optimistic unchokes which earned a regular slot or lost interest
+	for c := range ch.optimistic {
+		if unchoke[c] || !c.PeerInterested() {
+			delete(ch.optimistic, c)
+		}
+	}
+	var candidates []chokable
+	for _, c := range interested {
+		if !unchoke[c] && !ch.optimistic[c] {
+			candidates = append(candidates, c)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	for i := 0; len(ch.optimistic) < ch.optimisticSlots && i < len(candidates); i++ {
+		ch.optimistic[candidates[i]] = true
+	}
+	for c := range ch.optimistic {
+		unchoke[c] = true
+	}
+
+	peers := make([]chokable, 0, len(ch.peers))
+	for c := range ch.peers {
+		peers = append(peers, c)
+	}
+	ch.mu.Unlock()
+
+	for _, c := range peers {
+		if unchoke[c] && c.AmChoking() {
+			c.SendUnchoke()
+		} else if !unchoke[c] && !c.AmChoking() {
+			c.SendChoke()
+		}
+	}
+}
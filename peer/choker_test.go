@@ -0,0 +1,172 @@
+package peer
+
+import (
+	"fmt"
+	"testing"
+)
+
+//fakePeer is a connection whose traffic and interest the tests set
+type fakePeer struct {
+	name             string
+	read, written    int64
+	interested       bool
+	choking          bool
+	chokes, unchokes int
+}
+
+func (p *fakePeer) BytesRead() int64     { return p.read }
+func (p *fakePeer) BytesWritten() int64  { return p.written }
+func (p *fakePeer) PeerInterested() bool { return p.interested }
+func (p *fakePeer) AmChoking() bool      { return p.choking }
+func (p *fakePeer) SendChoke() error {
+	p.choking = true
+	p.chokes++
+	return nil
+}
+func (p *fakePeer) SendUnchoke() error {
+	p.choking = false
+	p.unchokes++
+	return nil
+}
+func (p *fakePeer) String() string { return p.name }
+
+//newPeers returns n interested peers which we choke
+func newPeers(n int) []*fakePeer {
+	peers := make([]*fakePeer, n)
+	for i := range peers {
+		peers[i] = &fakePeer{name: fmt.Sprintf("peer%d", i), interested: true, choking: true}
+	}
+	return peers
+}
+
+//unchoked returns the peers which we don't choke
+func unchoked(peers []*fakePeer) map[*fakePeer]bool {
+	res := make(map[*fakePeer]bool)
+	for _, p := range peers {
+		if !p.choking {
+			res[p] = true
+		}
+	}
+	return res
+}
+
+func TestChokerSlots(t *testing.T) {
+	for _, seeding := range []bool{false, true} {
+		seeding := seeding
+		ch := newChoker(2, 1, func() bool { return seeding })
+		peers := newPeers(6)
+		for _, p := range peers {
+			ch.add(p)
+		}
+		// peer i sends us i*1000 bytes and is sent (5-i)*1000 bytes, peer 5 isn't interested
+		for i, p := range peers {
+			p.read = int64(i) * 1000
+			p.written = int64(5-i) * 1000
+		}
+		peers[5].interested = false
+		ch.rechoke(true)
+
+		top := []*fakePeer{peers[4], peers[3]}
+		if seeding {
+			top = []*fakePeer{peers[0], peers[1]}
+		}
+		got := unchoked(peers)
+		if len(got) != 3 {
+			t.Fatalf("Seeding %v: unchoked %d peers, want 2 regular and 1 optimistic", seeding, len(got))
+		}
+		for _, p := range top {
+			if !got[p] {
+				t.Errorf("Seeding %v: %s was not unchoked for its rate", seeding, p)
+			}
+		}
+		if got[peers[5]] {
+			t.Errorf("Seeding %v: unchoked a peer which is not interested", seeding)
+		}
+	}
+}
+
+func TestChokerRates(t *testing.T) {
+	ch := newChoker(1, 1, func() bool { return false })
+	peers := newPeers(3)
+	for _, p := range peers {
+		ch.add(p)
+	}
+	// peer 0 sent the most in total, but peer 1 the most since the last round
+	peers[0].read = 10000
+	ch.rechoke(false)
+	peers[0].read += 100
+	peers[1].read += 5000
+	ch.optimistic = nil
+	ch.rechoke(true)
+	if peers[1].choking {
+		t.Fatal("Peer with the highest rate since the last round was not unchoked")
+	}
+}
+
+func TestChokerOptimisticRotation(t *testing.T) {
+	ch := newChoker(1, 1, func() bool { return false })
+	peers := newPeers(8)
+	for _, p := range peers {
+		ch.add(p)
+	}
+	peers[0].read = 1 << 20
+
+	optimistic := func() *fakePeer {
+		var res *fakePeer
+		for p := range unchoked(peers) {
+			if p != peers[0] {
+				if res != nil {
+					t.Fatalf("More than one optimistic unchoke: %s and %s", res, p)
+				}
+				res = p
+			}
+		}
+		if res == nil {
+			t.Fatal("No optimistic unchoke")
+		}
+		return res
+	}
+
+	ch.rechoke(true)
+	first := optimistic()
+	// the optimistic unchoke is kept until it is rotated
+	for i := 0; i < 5; i++ {
+		peers[0].read += 1 << 20
+		ch.rechoke(false)
+		if p := optimistic(); p != first {
+			t.Fatalf("Optimistic unchoke changed from %s to %s without rotating", first, p)
+		}
+	}
+	// rotating picks other peers over time, choking the previous ones
+	seen := map[*fakePeer]bool{first: true}
+	for i := 0; i < 50 && len(seen) < 4; i++ {
+		peers[0].read += 1 << 20
+		ch.rechoke(true)
+		seen[optimistic()] = true
+	}
+	if len(seen) < 4 {
+		t.Fatalf("Rotation picked only %d different optimistic unchokes", len(seen))
+	}
+	if peers[0].choking {
+		t.Fatal("Top uploader was choked")
+	}
+
+	// a peer losing interest gives up its optimistic slot
+	p := optimistic()
+	p.interested = false
+	peers[0].read += 1 << 20
+	ch.rechoke(false)
+	if !p.choking {
+		t.Fatal("Optimistic unchoke which lost interest was not choked")
+	}
+	optimistic()
+
+	ch.remove(peers[0])
+	for _, p := range peers[1:] {
+		p.interested = false
+	}
+	ch.rechoke(true)
+	if len(unchoked(peers[1:])) != 0 {
+		t.Fatal("Peers which are not interested stayed unchoked")
+	}
+}
@@ -0,0 +1,130 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+)
+
+//init builds the logger of the torrent, and allocates the download buffer and the set of verified pieces the first time Download is called
+func (t *Torrent) init() {
+	t.log()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.buf == nil {
+		t.buf = make([]byte, t.Length)
+		t.done = make([]bool, t.numPieces())
+	}
+	if t.resumed == nil {
+		t.resumed = make(chan struct{})
+	}
+}
+
+// Pause stops a running download and closes all of its peer connections.
+// Pieces that have already been verified are kept, and Download blocks until Resume is called.
+func (t *Torrent) Pause() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.paused {
+		return
+	}
+	t.paused = true
+	if t.resumed == nil {
+		t.resumed = make(chan struct{})
+	}
+	if t.stopRun != nil {
+		t.stopRun()
+	}
+}
+
+// Resume continues a download stopped by Pause
+func (t *Torrent) Resume() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.paused {
+		return
+	}
+	t.paused = false
+	close(t.resumed)
+	t.resumed = make(chan struct{})
+}
+
+// Paused tells if the download is currently paused
+func (t *Torrent) Paused() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.paused
+}
+
+// Completed returns the number of pieces that have been downloaded and verified
+func (t *Torrent) Completed() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, d := range t.done {
+		if d {
+			n++
+		}
+	}
+	return n
+}
+
+// Downloaded returns the number of bytes received from peers so far, including pieces that failed verification
+func (t *Torrent) Downloaded() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.downloaded
+}
+
+//addDownloaded counts n more bytes received from peers
+func (t *Torrent) addDownloaded(n int) {
+	t.mu.Lock()
+	t.downloaded += int64(n)
+	t.mu.Unlock()
+}
+
+// Wasted returns the number of bytes of blocks received from peers which were not needed anymore or never requested
+func (t *Torrent) Wasted() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.wasted
+}
+
+//addWasted counts n more bytes received from peers for nothing
+func (t *Torrent) addWasted(n int) {
+	t.mu.Lock()
+	t.wasted += int64(n)
+	t.mu.Unlock()
+}
+
+// Seed uploads the torrent, once Download returned it, to the peers from the trackers and the ones connecting to us
+// until ctx is cancelled. The choker then unchokes the peers we upload the most to instead of the ones uploading to us.
+func (t *Torrent) Seed(ctx context.Context) error {
+	t.init()
+	if !t.seeding() {
+		return fmt.Errorf("Cannot seed a torrent with %d of its %d pieces verified", t.Completed(), t.numPieces())
+	}
+	t.log().Infof("Seeding")
+	return t.run(ctx, true)
+}
+
+//seeding tells if every piece has been verified, so that we only upload
+func (t *Torrent) seeding() bool {
+	return t.Completed() == t.numPieces()
+}
+
+//waitResume blocks while the torrent is paused
+func (t *Torrent) waitResume(ctx context.Context) error {
+	for {
+		t.mu.Lock()
+		paused, resumed := t.paused, t.resumed
+		t.mu.Unlock()
+		if !paused {
+			return nil
+		}
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
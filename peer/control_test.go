@@ -0,0 +1,146 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	ratelimit "github.com/adityameharia/gotor/ratelimit"
+)
+
+//verifications counts the PieceVerified events of a torrent by piece
+type verifications struct {
+	mu     sync.Mutex
+	pieces map[int]int
+}
+
+func (v *verifications) add(index int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.pieces == nil {
+		v.pieces = make(map[int]int)
+	}
+	v.pieces[index]++
+}
+
+//check fails the test unless every one of n pieces was verified exactly once
+func (v *verifications) check(t *testing.T, n int) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for i := 0; i < n; i++ {
+		if v.pieces[i] != 1 {
+			t.Errorf("Piece #%d verified %d times, want once", i, v.pieces[i])
+		}
+	}
+}
+
+//disconnected waits until tor has no connections left
+func disconnected(t *testing.T, tor *Torrent, who string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for len(tor.connections()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("The %s still has %d connections", who, len(tor.connections()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//slowLeecher returns a torrent of data downloading from the seed at addr slowly enough to be stopped halfway,
+//calling stop once the first piece is verified
+func slowLeecher(data []byte, addr Peer, v *verifications, stop func()) *Torrent {
+	tor := newTestTorrent(data, 2)
+	tor.Peers = []Peer{addr}
+	tor.Limits.Download = ratelimit.New(4 * testPieceLength)
+	var once sync.Once
+	tor.OnEvent = func(e Event) {
+		if e.Type == PieceVerified {
+			v.add(e.Piece)
+			once.Do(stop)
+		}
+	}
+	return tor
+}
+
+func TestPauseResume(t *testing.T) {
+	data := testData(16*testPieceLength, 6)
+	seeder, addr := seed(t, data, 1)
+
+	var v verifications
+	var tor *Torrent
+	tor = slowLeecher(data, addr, &v, func() { tor.Pause() })
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	type download struct {
+		data []byte
+		err  error
+	}
+	done := make(chan download, 1)
+	go func() {
+		got, err := tor.Download(ctx)
+		done <- download{got, err}
+	}()
+
+	for !tor.Paused() {
+		time.Sleep(10 * time.Millisecond)
+	}
+	disconnected(t, tor, "paused leecher")
+	disconnected(t, seeder, "seeder of the paused leecher")
+	completed := tor.Completed()
+	if completed == 0 || completed == len(tor.PieceHashes) {
+		t.Fatalf("Paused with %d of %d pieces", completed, len(tor.PieceHashes))
+	}
+	select {
+	case d := <-done:
+		t.Fatalf("Download returned while paused: %v", d.err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if tor.Completed() != completed {
+		t.Fatalf("Verified %d more pieces while paused", tor.Completed()-completed)
+	}
+
+	tor.Resume()
+	d := <-done
+	if d.err != nil {
+		t.Fatal(d.err)
+	}
+	if !bytes.Equal(d.data, data) {
+		t.Fatal("Downloaded data differs from the seeded data")
+	}
+	v.check(t, len(tor.PieceHashes))
+}
+
+func TestCancelResume(t *testing.T) {
+	data := testData(16*testPieceLength, 7)
+	seeder, addr := seed(t, data, 1)
+
+	var v verifications
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	tor := slowLeecher(data, addr, &v, cancel)
+	if _, err := tor.Download(ctx); err != context.Canceled {
+		t.Fatalf("Download returned %v, want %v", err, context.Canceled)
+	}
+	// Download returns once its connections are closed
+	if n := len(tor.connections()); n > 0 {
+		t.Fatalf("Cancelled download left %d connections", n)
+	}
+	disconnected(t, seeder, "seeder of the cancelled leecher")
+	completed := tor.Completed()
+	if completed == 0 || completed == len(tor.PieceHashes) {
+		t.Fatalf("Cancelled with %d of %d pieces", completed, len(tor.PieceHashes))
+	}
+
+	// downloading again picks up where the cancelled download left off
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	got, err := tor.Download(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Downloaded data differs from the seeded data")
+	}
+	v.check(t, len(tor.PieceHashes))
+}
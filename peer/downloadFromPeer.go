@@ -2,12 +2,15 @@ package peer
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	connection "github.com/adityameharia/gotor/connection"
+	logger "github.com/adityameharia/gotor/logger"
 	message "github.com/adityameharia/gotor/message"
-	"log"
-	"runtime"
+	"sync"
 	"time"
 )
 
@@ -20,21 +23,34 @@ const MaxBacklog = 5
 type work struct {
 	index  int
 	hash   [20]byte
+	v2     *PieceV2
 	length int
+	// padding tells which blocks are padding, nil if none are
+	padding []bool
 }
 
 type result struct {
-	index int
-	buf   []byte
+	index   int
+	buf     []byte
+	peer    Peer
+	webSeed string
 }
 
 type pieceProgress struct {
+	torrent    *Torrent
 	index      int
 	client     *connection.Client
+	peer       Peer
 	buf        []byte
+	sources    []Peer
 	downloaded int
 	requested  int
 	backlog    int
+
+	// mu guards pending, the length of the blocks requested and not received yet by their offset,
+	// as the reader goroutine of the connection checks them
+	mu      sync.Mutex
+	pending map[int]int
 }
 
 type pieceResult struct {
@@ -42,55 +58,236 @@ type pieceResult struct {
 	buf   []byte
 }
 
-//Download make a worker queues,launches go routines ,co-ordinates with the result
-//basically this func is the heart of the package which does it all
-func (t *Torrent) Download() ([]byte, error) {
+//Download returns once every piece has been verified or ctx is cancelled.
+//Verified pieces are kept on the Torrent, so calling Download again after a cancellation picks up where it left off.
+func (t *Torrent) Download(ctx context.Context) ([]byte, error) {
+
+	t.init()
+	t.log().Infof("Starting download")
+	for {
+		err := t.waitResume(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		runCtx, cancel := context.WithCancel(ctx)
+		t.mu.Lock()
+		t.stopRun = cancel
+		if t.paused {
+			cancel()
+		}
+		t.mu.Unlock()
+
+		err = t.run(runCtx, false)
+		cancel()
+
+		if err == nil {
+			return t.buf, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if !t.Paused() {
+			return nil, err
+		}
+		t.log().Infof("Paused download")
+	}
+}
+
+//announce fetches peers from the trackers and adds them, returning the error of Announce for the caller to log
+func (t *Torrent) announce(ctx context.Context) error {
+	t.mu.Lock()
+	t.lastAnnounce = time.Now()
+	t.mu.Unlock()
 
-	log.Println("Starting download for", t.Name)
+	peers, err := t.Announce(ctx)
+	t.emit(Event{Type: TrackerAnnounce, Peers: len(peers), Err: err})
+	if err == nil {
+		t.log().Infof("Tracker returned %d peers", len(peers))
+	}
+	if t.AnnounceV2 != nil {
+		t.announceV2(ctx)
+	}
+	t.addPeers(peers)
+	return err
+}
+
+//run downloads the pieces that are still missing until all of them are verified or ctx is cancelled.
+//If seed is set, it keeps uploading to the peers after that until ctx is cancelled.
+//It does not return before every worker it started has exited and closed its connection.
+func (t *Torrent) run(ctx context.Context, seed bool) error {
+	if t.Announce != nil {
+		err := t.announce(ctx)
+		if err != nil {
+			t.log().Warnf("Announce failed: %v", err)
+		}
+		t.mu.Lock()
+		noPeers := len(t.Peers) == 0
+		t.mu.Unlock()
+		if err != nil && noPeers && len(t.WebSeeds) == 0 && len(t.HTTPSeeds) == 0 && !seed {
+			return err
+		}
+	}
 
-	workerQueue := make(chan *work, len(t.PieceHashes))
+	workerQueue := make(chan *work, t.numPieces())
 	workerResults := make(chan *result)
 
-	for index, hash := range t.PieceHashes {
-		length := t.pieceSize(index)
-		workerQueue <- &work{index, hash, length}
+	remaining := 0
+	padding := t.paddingBlocks()
+	for index := 0; index < t.numPieces(); index++ {
+		if t.done[index] {
+			continue
+		}
+		pw := t.newWork(index)
+		pw.padding = padding[index]
+		workerQueue <- pw
+		remaining++
 	}
 
-	// Start workers
-	for _, peer := range t.Peers {
-		go t.startDownload(peer, workerQueue, workerResults)
+	workerCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer cancel()
+
+	t.choker = newChoker(t.UnchokeSlots, t.OptimisticUnchokeSlots, t.seeding)
+	go t.choker.run(workerCtx)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		t.manage(workerCtx, &wg)
+	}()
+
+	stopReport := make(chan struct{})
+	defer close(stopReport)
+	go t.reportThroughput(stopReport)
+
+	// Start workers for as many peers as the pool allows. Workers which exit and peers added while running
+	// are replaced with new workers straight away, until spawn is cleared before the workers are stopped.
+	// Peers connecting to us are handed to serve, which starts their worker the same way.
+	t.mu.Lock()
+	t.spawn = func(peer Peer) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			useful := t.startDownload(workerCtx, peer, workerQueue, workerResults)
+			t.release(peer.String(), useful, workerCtx.Err() != nil)
+		}()
+	}
+	t.serve = func(c *connection.Client, peer Peer) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			useful := t.downloadFrom(workerCtx, c, peer, workerQueue, workerResults)
+			t.release(peer.String(), useful, workerCtx.Err() != nil)
+		}()
+	}
+	t.topUp()
+	t.mu.Unlock()
+	defer func() {
+		t.mu.Lock()
+		t.spawn = nil
+		t.serve = nil
+		t.mu.Unlock()
+	}()
+	for _, url := range t.WebSeeds {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			t.startWebSeed(workerCtx, url, workerQueue, workerResults)
+		}(url)
+	}
+	for _, url := range t.HTTPSeeds {
+		wg.Add(1)
+		go func(url string) {
+			defer wg.Done()
+			t.startHTTPSeed(workerCtx, url, workerQueue, workerResults)
+		}(url)
 	}
 
 	// Collect results into a buffer until full
-	buf := make([]byte, t.Length)
-	donePieces := 0
-	for donePieces < len(t.PieceHashes) {
-		fmt.Println("a piece done")
-		res := <-workerResults
+	for remaining > 0 {
+		var res *result
+		select {
+		case res = <-workerResults:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
 		begin, end := t.calculateBounds(res.index)
-		copy(buf[begin:end], res.buf)
-		donePieces++
+		t.mu.Lock()
+		copy(t.buf[begin:end], res.buf)
+		t.done[res.index] = true
+		t.mu.Unlock()
+		remaining--
+		t.pieceDone(res.index)
+
+		t.emit(Event{Type: PieceVerified, Piece: res.index, Peer: res.peer, WebSeed: res.webSeed})
+	}
+
+	if !seed {
+		t.emit(Event{Type: DownloadComplete})
+		return nil
+	}
+	<-ctx.Done()
+	return ctx.Err()
+}
 
-		percent := float64(donePieces) / float64(len(t.PieceHashes)) * 100
-		numWorkers := runtime.NumGoroutine() - 1 // subtract 1 for main thread
-		fmt.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
+//log returns the logger of the torrent with its name and infohash as fields.
+//The logger is built once, when the download starts, as the torrent doesn't change afterwards.
+func (t *Torrent) log() *logger.Logger {
+	t.logOnce.Do(func() {
+		t.logger = t.Logger.With("torrent", t.Name).With("infohash", fmt.Sprintf("%x", t.InfoHash))
+	})
+	return t.logger
+}
+
+//mergePeers appends the peers in add which are not already in peers
+func mergePeers(peers []Peer, add []Peer) []Peer {
+	seen := make(map[string]bool, len(peers))
+	for _, p := range peers {
+		seen[p.String()] = true
 	}
-	close(workerQueue)
+	for _, p := range add {
+		if seen[p.String()] {
+			continue
+		}
+		seen[p.String()] = true
+		peers = append(peers, p)
+	}
+	return peers
+}
 
-	return buf, nil
+//numPieces returns the number of pieces of the torrent, v1 or v2
+func (t *Torrent) numPieces() int {
+	if t.PiecesV2 != nil {
+		return len(t.PiecesV2)
+	}
+	return len(t.PieceHashes)
+}
 
+//newWork returns the work of downloading and verifying a piece
+func (t *Torrent) newWork(index int) *work {
+	pw := &work{index: index, length: t.pieceSize(index)}
+	if t.PiecesV2 != nil {
+		pw.v2 = &t.PiecesV2[index]
+	} else {
+		pw.hash = t.PieceHashes[index]
+	}
+	return pw
 }
 
 func (t *Torrent) calculateBounds(index int) (begin int, end int) {
 	begin = index * t.PieceLength
-	end = begin + t.PieceLength
-	if end > t.Length {
-		end = t.Length
-	}
+	end = begin + t.pieceSize(index)
 	return begin, end
 }
 
+//pieceSize returns the length of a piece. The pieces of a v2 torrent stop at the end of their file,
+//and the padding up to the next piece boundary is not part of any piece.
 func (t *Torrent) pieceSize(index int) int {
+	if t.PiecesV2 != nil {
+		return t.PiecesV2[index].Length
+	}
 	b := index * t.PieceLength
 	e := b + t.PieceLength
 	if e > t.Length {
@@ -99,62 +296,159 @@ func (t *Torrent) pieceSize(index int) int {
 	return e - b
 }
 
-func (t *Torrent) startDownload(peer Peer, workQueue chan *work, results chan *result) {
-	c, err := connection.New(peer.String(), t.PeerID, t.InfoHash)
+//startDownload downloads pieces from peer until the connection breaks or ctx is done, and tells if it got any
+func (t *Torrent) startDownload(ctx context.Context, peer Peer, workQueue chan *work, results chan *result) (useful bool) {
+	log := t.log().With("peer", peer.String())
+	if t.Banned(peer) {
+		log.Debugf("Not connecting to banned peer")
+		return
+	}
+	infoHash, v2 := t.swarm(peer)
+	c, err := connection.New(ctx, peer.String(), t.PeerID, infoHash, t.connOptions(v2)...)
+	if errors.Is(err, connection.ErrBlocked) {
+		log.Infof("Peer blocked by IP filter")
+		return
+	}
+	if err != nil {
+		log.Debugf("Could not handshake: %v", err)
+		return
+	}
+	return t.downloadFrom(ctx, c, peer, workQueue, results)
+}
+
+//downloadFrom downloads pieces over c, made to or by peer, until the connection breaks or ctx is done, and tells if it got any
+func (t *Torrent) downloadFrom(ctx context.Context, c *connection.Client, peer Peer, workQueue chan *work, results chan *result) (useful bool) {
+	log := t.log().With("peer", peer.String())
+	err := t.claim(peer.String(), c.RemoteID())
 	if err != nil {
-		log.Printf("Could not handshake with %s. Disconnecting\n", peer.IP)
+		log.Debugf("Disconnecting: %v", err)
+		c.Close()
 		return
 	}
-	defer c.Conn.Close()
+	defer func() {
+		t.choker.remove(c)
+		t.unregister(c)
+		c.Close()
+		t.emit(Event{Type: PeerDisconnected, Peer: peer, Err: err})
+	}()
+
+	log.Debugf("Completed handshake over %s", c.Transport())
+	t.emit(Event{Type: PeerConnected, Peer: peer})
+
+	t.choker.add(c)
+	err = t.register(c, peer)
+	if err == nil {
+		err = t.updateInterest(c)
+	}
+	if err != nil {
+		return
+	}
+
+	for {
+		// no work is taken while the peer has nothing we need
+		queue := workQueue
+		if !c.AmInterested() {
+			queue = nil
+		}
 
-	log.Printf("Completed handshake with %s\n", peer.IP)
+		var pw *work
+		select {
+		case pw = <-queue:
+		case ev, ok := <-c.Events():
+			// between pieces, blocks are not expected and only the other messages are handled
+			err = eventError(c, ev, ok)
+			if err == nil && ev.Message != nil && ev.Message.ID != message.Piece {
+				err = t.handleMessage(c, ev.Message)
+			}
+			ev.Release()
+			if err != nil {
+				log.Debugf("Disconnecting: %v", err)
+				return
+			}
+			continue
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
 
-	c.SendUnchoke()
-	c.SendInterested()
+		if t.Banned(peer) {
+			workQueue <- pw
+			err = fmt.Errorf("Peer %s is banned", peer)
+			return
+		}
 
-	for pw := range workQueue {
-		if !c.Bitfield.CheckPiece(pw.index) {
+		if !c.HasPiece(pw.index) {
 			workQueue <- pw // Put piece back on the queue
 			continue
 		}
 
-		fmt.Println("hi")
-
 		// Download the piece
-		buf, err := attemptDownloadPiece(c, pw)
+		var buf []byte
+		var sources []Peer
+		buf, sources, err = t.attemptDownloadPiece(ctx, c, peer, pw)
 		if err != nil {
-			log.Println("Exiting", err)
+			var lerr *message.LengthError
+			if errors.As(err, &lerr) {
+				log.Warnf("Disconnecting peer which sent an oversized message: %v", err)
+			} else {
+				log.Debugf("Disconnecting: %v", err)
+			}
 			workQueue <- pw // Put piece back on the queue
+			t.emit(Event{Type: PieceFailed, Piece: pw.index, Peer: peer, Err: err})
 			return
 		}
-		fmt.Println("bye")
+		t.addDownloaded(len(buf))
+
 		err = checkIntegrity(pw, buf)
-		fmt.Println("ffs")
 		if err != nil {
-			log.Printf("Piece #%d failed integrity check\n", pw.index)
+			log.Warnf("Piece #%d failed integrity check", pw.index)
 			workQueue <- pw // Put piece back on the queue
+			t.emit(Event{Type: PieceFailed, Piece: pw.index, Peer: peer, Err: err})
+			if pw.v2 != nil && c.SupportsV2() {
+				t.pieceFailedV2(c, peer, pw, buf, sources)
+			} else {
+				t.pieceFailed(pw.index, buf, sources)
+			}
 			continue
 		}
+		t.pieceVerified(pw.index, buf)
 
-		c.SendHave(pw.index)
-		results <- &result{pw.index, buf}
+		useful = true
+		select {
+		case results <- &result{index: pw.index, buf: buf, peer: peer}:
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		}
 	}
 }
 
-func attemptDownloadPiece(c *connection.Client, pw *work) ([]byte, error) {
+//attemptDownloadPiece downloads a piece from c and returns it, along with the peer which sent each block
+func (t *Torrent) attemptDownloadPiece(ctx context.Context, c *connection.Client, peer Peer, pw *work) ([]byte, []Peer, error) {
 	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
+		torrent: t,
+		index:   pw.index,
+		client:  c,
+		peer:    peer,
+		buf:     make([]byte, pw.length),
+		sources: blockSources(pw.length),
+		pending: make(map[int]int),
 	}
+	c.SetBlockFunc(state.block)
+	defer c.SetBlockFunc(nil)
 
-	// Setting a deadline helps get unresponsive peers unstuck.
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
+	// A timeout helps get unresponsive peers unstuck.
+	timeout := time.NewTimer(30 * time.Second)
+	defer timeout.Stop()
+
+	for {
+		state.skipPadding(pw)
+		if state.downloaded >= pw.length {
+			break
+		}
 
-	for state.downloaded < pw.length {
 		// If unchoked, send requests until we have enough unfulfilled requests
-		if !state.client.Choked {
+		if !c.PeerChoking() {
 			for state.backlog < MaxBacklog && state.requested < pw.length {
 				blockSize := MaxBlockSize
 				// Last block might be shorter than the typical block
@@ -162,56 +456,92 @@ func attemptDownloadPiece(c *connection.Client, pw *work) ([]byte, error) {
 					blockSize = pw.length - state.requested
 				}
 
+				state.mu.Lock()
+				state.pending[state.requested] = blockSize
+				state.mu.Unlock()
 				err := c.SendRequest(pw.index, state.requested, blockSize)
 				if err != nil {
-					return nil, err
+					return nil, nil, err
 				}
 				state.backlog++
 				state.requested += blockSize
+				state.skipPadding(pw)
 			}
 		}
 
-		err := state.parseMessage()
-		if err != nil {
-			return nil, err
+		select {
+		case ev, ok := <-c.Events():
+			err := eventError(c, ev, ok)
+			if err == nil {
+				err = state.handle(ev)
+			}
+			ev.Release()
+			if err != nil {
+				return nil, nil, err
+			}
+		case <-timeout.C:
+			return nil, nil, fmt.Errorf("Timed out downloading piece #%d", pw.index)
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
 		}
 	}
-	return state.buf, nil
+	return state.buf, state.sources, nil
 }
 
-func (p *pieceProgress) parseMessage() error {
-	msg, err := p.client.ReadMessageFromPeer()
-	if err != nil {
-		return err
-	}
-
+//handle handles an event of the connection while the piece is being downloaded
+func (p *pieceProgress) handle(ev connection.Event) error {
+	msg := ev.Message
 	if msg == nil { // keep-alive
 		return nil
 	}
+	if msg.ID != message.Piece {
+		return p.torrent.handleMessage(p.client, msg)
+	}
 
-	switch msg.ID {
-	case message.Unchoke:
-		p.client.Choked = false
-	case message.Choke:
-		p.client.Choked = true
-	case message.Have:
-		index, err := message.ParseHave(msg)
-		if err != nil {
-			return err
+	if ev.Received < 0 {
+		// a block we cancelled, already received or never asked for, peers may send those after a Cancel
+		if len(msg.Payload) > 8 {
+			p.torrent.addWasted(len(msg.Payload) - 8)
 		}
-		p.client.Bitfield.PutPiece(index)
-	case message.Piece:
-		n, err := message.ParsePiece(p.index, p.buf, msg)
-		if err != nil {
+		return nil
+	}
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	p.sources[begin/MaxBlockSize] = p.peer
+	p.downloaded += ev.Received
+	p.backlog--
+	return nil
+}
+
+//block returns where the data of a Piece message goes in the piece, which the reader goroutine of the connection reads it straight into.
+//Only blocks which were requested and not received yet are taken, so the piece is not written to once all of them arrived.
+func (p *pieceProgress) block(index, begin, length int) []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if index != p.index || p.pending[begin] != length || length == 0 {
+		return nil
+	}
+	delete(p.pending, begin)
+	return p.buf[begin : begin+length]
+}
+
+//eventError returns the error an event of c carries, the error which broke the connection if ok is false as the events are over
+func eventError(c *connection.Client, ev connection.Event, ok bool) error {
+	if !ok {
+		if err := c.Err(); err != nil {
 			return err
 		}
-		p.downloaded += n
-		p.backlog--
+		return connection.ErrClosed
 	}
-	return nil
+	return ev.Err
 }
 
 func checkIntegrity(pw *work, buf []byte) error {
+	if pw.v2 != nil {
+		if !pw.v2.verify(buf) {
+			return fmt.Errorf("Index %d failed integrity check", pw.index)
+		}
+		return nil
+	}
 	hash := sha1.Sum(buf)
 	if !bytes.Equal(hash[:], pw.hash[:]) {
 		return fmt.Errorf("Index %d failed integrity check", pw.index)
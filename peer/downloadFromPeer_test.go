@@ -0,0 +1,55 @@
+package peer
+
+import (
+	"encoding/binary"
+	"testing"
+
+	connection "github.com/adityameharia/gotor/connection"
+	message "github.com/adityameharia/gotor/message"
+)
+
+//pieceEvent returns the event of a Piece message for the block at begin, received into the piece if received is not -1
+func pieceEvent(index, begin, length, received int) connection.Event {
+	payload := make([]byte, 8, 8+length)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	if received < 0 {
+		payload = payload[:8+length]
+	}
+	return connection.Event{Message: &message.Message{ID: message.Piece, Payload: payload}, Received: received}
+}
+
+func TestPieceProgressUnrequested(t *testing.T) {
+	tor := newTestTorrent(testData(testPieceLength, 5), 1)
+	tor.init()
+	p := &pieceProgress{
+		torrent: tor,
+		buf:     make([]byte, testPieceLength),
+		sources: blockSources(testPieceLength),
+		pending: map[int]int{0: MaxBlockSize},
+		backlog: 1,
+	}
+
+	if p.block(0, 0, MaxBlockSize) == nil {
+		t.Fatal("Requested block refused")
+	}
+	if err := p.handle(pieceEvent(0, 0, MaxBlockSize, MaxBlockSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same block again, and one which was never requested
+	for _, begin := range []int{0, MaxBlockSize} {
+		if p.block(0, begin, MaxBlockSize) != nil {
+			t.Fatalf("Block at %d taken although it is not pending", begin)
+		}
+		if err := p.handle(pieceEvent(0, begin, MaxBlockSize, -1)); err != nil {
+			t.Fatalf("Block at %d broke the download: %v", begin, err)
+		}
+	}
+	if p.downloaded != MaxBlockSize || p.backlog != 0 {
+		t.Errorf("Got %d bytes downloaded and %d requests in flight, want %d and 0", p.downloaded, p.backlog, MaxBlockSize)
+	}
+	if got := tor.Wasted(); got != 2*MaxBlockSize {
+		t.Errorf("Wasted %d bytes, want %d", got, 2*MaxBlockSize)
+	}
+}
@@ -0,0 +1,124 @@
+package peer
+
+import (
+	"time"
+)
+
+// EventType tells what an Event is about
+type EventType int
+
+const (
+	// PieceVerified is sent when a piece has been downloaded and its hash matched
+	PieceVerified EventType = iota
+	// PieceFailed is sent when a piece could not be downloaded or failed the integrity check
+	PieceFailed
+	// PeerConnected is sent when the handshake with a peer has completed
+	PeerConnected
+	// PeerDisconnected is sent when the connection with a peer has been closed
+	PeerDisconnected
+	// TrackerAnnounce is sent after every announce, with the number of peers received or the error
+	TrackerAnnounce
+	// Throughput is sent every ThroughputInterval while downloading
+	Throughput
+	// DownloadComplete is sent once every piece has been verified
+	DownloadComplete
+	// PeerBanned is sent when a peer is banned for sending corrupt data
+	PeerBanned
+	// Listening is sent when we start accepting connections from the peers of the torrent, and when we stop
+	Listening
+)
+
+// ThroughputInterval is how often Throughput events are sent
+const ThroughputInterval = time.Second
+
+// Event describes something that happened while downloading a torrent.
+// Only the fields which make sense for its Type are set.
+type Event struct {
+	Type EventType
+	Time time.Time
+
+	// Piece is the index of the piece for PieceVerified, PieceFailed and PeerBanned
+	Piece int
+	// Peer is the peer for PeerConnected, PeerDisconnected, PeerBanned, PieceVerified and PieceFailed
+	Peer Peer
+	// WebSeed is the URL of the web seed or HTTP seed instead of Peer for PieceVerified and PieceFailed of pieces fetched over HTTP
+	WebSeed string
+	// Peers is the number of peers returned for TrackerAnnounce
+	Peers int
+	// Port is the port we accept connections on for Listening, 0 once we stopped
+	Port uint16
+	// Err is the reason for PieceFailed, PeerDisconnected and a failed TrackerAnnounce
+	Err error
+
+	// Completed and Total are the number of verified pieces and the total number of pieces
+	Completed int
+	Total     int
+	// Downloaded is the number of bytes received from peers so far
+	Downloaded int64
+	// Rate is the download rate in bytes per second over the last ThroughputInterval
+	Rate float64
+}
+
+// EventHandler receives the events of a torrent.
+// Calls are never made concurrently, but a slow handler slows down the download.
+type EventHandler func(Event)
+
+func (t EventType) String() string {
+	switch t {
+	case PieceVerified:
+		return "PieceVerified"
+	case PieceFailed:
+		return "PieceFailed"
+	case PeerConnected:
+		return "PeerConnected"
+	case PeerDisconnected:
+		return "PeerDisconnected"
+	case TrackerAnnounce:
+		return "TrackerAnnounce"
+	case Throughput:
+		return "Throughput"
+	case DownloadComplete:
+		return "DownloadComplete"
+	case PeerBanned:
+		return "PeerBanned"
+	case Listening:
+		return "Listening"
+	default:
+		return "Unknown"
+	}
+}
+
+//emit fills in the common fields of e and hands it to the OnEvent handler
+func (t *Torrent) emit(e Event) {
+	if t.OnEvent == nil {
+		return
+	}
+	e.Time = time.Now()
+	e.Total = t.numPieces()
+	e.Completed = t.Completed()
+	e.Downloaded = t.Downloaded()
+
+	t.eventMu.Lock()
+	defer t.eventMu.Unlock()
+	t.OnEvent(e)
+}
+
+//reportThroughput sends a Throughput event every ThroughputInterval until done is closed
+func (t *Torrent) reportThroughput(done <-chan struct{}) {
+	ticker := time.NewTicker(ThroughputInterval)
+	defer ticker.Stop()
+
+	last := t.Downloaded()
+	lastTime := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			curr := t.Downloaded()
+			rate := float64(curr-last) / now.Sub(lastTime).Seconds()
+			last, lastTime = curr, now
+			t.emit(Event{Type: Throughput, Rate: rate})
+		case <-done:
+			return
+		}
+	}
+}
@@ -1,10 +1,19 @@
 package peer
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	connection "github.com/adityameharia/gotor/connection"
+	ipfilter "github.com/adityameharia/gotor/ipfilter"
+	logger "github.com/adityameharia/gotor/logger"
+	mse "github.com/adityameharia/gotor/mse"
+	proxy "github.com/adityameharia/gotor/proxy"
+	utp "github.com/adityameharia/gotor/utp"
 	"net"
 	"strconv"
+	"sync"
+	"time"
 )
 
 //MaxSize is the maximmum size we get request for from a peer in one request
@@ -22,6 +31,99 @@ type Torrent struct {
 	PieceLength int
 	Length      int
 	Name        string
+
+	// Files is the layout of a multi file torrent, nil for a single file torrent
+	Files []File
+
+	// WebSeeds are the URLs of HTTP servers hosting the files of the torrent (BEP 19), used alongside the peers
+	WebSeeds []string
+	// HTTPSeeds are the URLs of seed scripts serving the pieces of the torrent (BEP 17), used alongside the peers
+	HTTPSeeds []string
+
+	// InfoHashV2 is the SHA-256 infohash of a BitTorrent v2 or hybrid torrent (BEP 52), zero for a v1 torrent.
+	// The InfoHash of a v2 only torrent is its first 20 bytes.
+	InfoHashV2 [32]byte
+	// PiecesV2 verifies the pieces of a v2 only torrent, in place of PieceHashes
+	PiecesV2 []PieceV2
+
+	// Private is set for private torrents (BEP 27), whose peers must only come from their own tracker.
+	// AddPeers drops the peers found by other means for them, such as by local service discovery.
+	Private bool
+
+	// Announce, if set, is called at the start of every run of Download
+	// to fetch fresh peers, which are added to Peers.
+	Announce func(ctx context.Context) ([]Peer, error)
+	// AnnounceV2, if set for a hybrid torrent, is called along with Announce to fetch the peers of the v2 swarm,
+	// which are connected to with the truncated v2 infohash
+	AnnounceV2 func(ctx context.Context) ([]Peer, error)
+
+	// OnEvent, if set, receives progress events of the download
+	OnEvent EventHandler
+
+	// Limits throttles the download and upload rates of the torrent
+	Limits Limits
+
+	// UnchokeSlots and OptimisticUnchokeSlots are the number of peers we upload to because they are the best,
+	// and because they were picked at random. DefaultUnchokeSlots and DefaultOptimisticUnchokeSlots are used if 0.
+	UnchokeSlots           int
+	OptimisticUnchokeSlots int
+
+	// Dialer makes the connections to peers and trackers, proxy.Direct is used if nil
+	Dialer proxy.Dialer
+
+	// Encryption is the Message Stream Encryption policy of the connections to peers
+	Encryption mse.Policy
+
+	// UTP, if set, is tried before TCP when connecting to peers
+	UTP *utp.Socket
+
+	// Filter, if set, blocks connections to the address ranges it contains
+	Filter *ipfilter.Filter
+
+	// KeepAlive is how long a connection may go without sending anything before a keep-alive is sent, and
+	// IdleTimeout how long a peer may send nothing before it is disconnected. The defaults of the connection package are used if 0.
+	KeepAlive   time.Duration
+	IdleTimeout time.Duration
+	// UselessTimeout is how long a peer is kept while no block is exchanged with it, DefaultUselessTimeout if 0.
+	// The peers dropped for it are replaced with peers which are not connected.
+	UselessTimeout time.Duration
+
+	// MaxConnections is the number of peers connected to at once, DefaultMaxConnections if 0.
+	// GlobalConnections, if set, is meant to be shared by every torrent to cap their connections altogether.
+	// Peers are picked from Peers, and after a connection are not connected to again before their backoff runs out.
+	MaxConnections    int
+	GlobalConnections *ConnLimit
+
+	// MaxStrikes is the number of corrupt pieces after which a peer is banned, DefaultMaxStrikes is used if 0
+	MaxStrikes int
+
+	// Logger receives the log entries of the download, nothing is logged if it is nil
+	Logger *logger.Logger
+
+	logOnce      sync.Once
+	logger       *logger.Logger
+	mu           sync.Mutex
+	buf          []byte
+	done         []bool
+	downloaded   int64
+	wasted       int64
+	paused       bool
+	resumed      chan struct{}
+	stopRun      context.CancelFunc
+	spawn        func(Peer)
+	serve        func(*connection.Client, Peer)
+	v2Peers      map[string]bool
+	eventMu      sync.Mutex
+	choker       *choker
+	conns        map[*connection.Client]Peer
+	interestMu   sync.Mutex
+	pool         map[string]*peerState
+	poolIDs      map[string]string
+	lastAnnounce time.Time
+	port         uint16
+	failed       map[int]*failedPiece
+	strikes      map[string]int
+	banned       map[string]bool
 }
 
 // Peer struct containg ip and port of the client
@@ -51,6 +153,21 @@ func DecodePeer(bin []byte) ([]Peer, error) {
 	return peers, nil
 }
 
+//DecodePeer6 converts the compact string of IPv6 peers of the peers6 key into Peers
+func DecodePeer6(bin []byte) ([]Peer, error) {
+	const size = 18
+	if len(bin)%size != 0 {
+		return nil, fmt.Errorf("Peers6 string has been corrupted")
+	}
+	peers := make([]Peer, len(bin)/size)
+	for i := range peers {
+		offset := i * size
+		peers[i].IP = net.IP(bin[offset : offset+16])
+		peers[i].Port = binary.BigEndian.Uint16(bin[offset+16 : offset+18])
+	}
+	return peers, nil
+}
+
 //String is used to convert the peer struct to a valid ip address
 func (p Peer) String() string {
 	return net.JoinHostPort(p.IP.String(), strconv.Itoa(int(p.Port)))
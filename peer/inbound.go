@@ -0,0 +1,113 @@
+package peer
+
+import (
+	"context"
+	connection "github.com/adityameharia/gotor/connection"
+	"net"
+	"sync"
+)
+
+// Serve accepts the connections of peers to us on l until l is closed, and adds them to the download while it runs.
+// Connections completing their handshake while the download is paused or over, or while the torrent has
+// as many peers as it connects to, are closed.
+// It returns the error of l.Accept once l is closed, after the handshakes in progress are over.
+func (t *Torrent) Serve(l net.Listener) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			t.accept(ctx, conn)
+		}()
+	}
+}
+
+// SetPort records that we accept connections from the peers of the torrent on port, or no more if it is 0,
+// and sends a Listening event
+func (t *Torrent) SetPort(port uint16) {
+	t.mu.Lock()
+	t.port = port
+	t.mu.Unlock()
+	t.emit(Event{Type: Listening, Port: port})
+}
+
+// Port returns the port set with SetPort, 0 if we don't accept connections
+func (t *Torrent) Port() uint16 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.port
+}
+
+//accept completes the handshake of a peer which connected to us and hands the connection to a worker of the running download
+func (t *Torrent) accept(ctx context.Context, conn net.Conn) {
+	peer := remotePeer(conn)
+	log := t.log().With("peer", peer.String())
+	if t.Banned(peer) {
+		log.Debugf("Not accepting banned peer")
+		conn.Close()
+		return
+	}
+	v2 := t.PiecesV2 != nil || t.InfoHashV2 != [32]byte{}
+	c, err := connection.Accept(ctx, conn, t.PeerID, t.infoHashes(), t.connOptions(v2)...)
+	if err != nil {
+		log.Debugf("Could not handshake: %v", err)
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.serve == nil || !t.admit(peer.String()) {
+		log.Debugf("Not accepting peer while not downloading or connected to enough peers")
+		c.Close()
+		return
+	}
+	t.serve(c, peer)
+}
+
+//admit counts a peer which connected to us at addr as one of the connections of the torrent,
+//unless the torrent or the global limit has no room for it. t.mu must be held.
+func (t *Torrent) admit(addr string) bool {
+	active := 0
+	for _, s := range t.pool {
+		if s.active {
+			active++
+		}
+	}
+	if s := t.pool[addr]; active >= t.maxConnections() || (s != nil && s.active) || !t.GlobalConnections.acquire() {
+		return false
+	}
+	s := t.peerState(addr)
+	s.active = true
+	s.inbound = true
+	return true
+}
+
+//infoHashes returns the infohashes peers can connect to us with, the truncated v2 infohash being one of them for a hybrid torrent
+func (t *Torrent) infoHashes() [][20]byte {
+	hashes := [][20]byte{t.InfoHash}
+	if t.InfoHashV2 != [32]byte{} && t.PiecesV2 == nil {
+		var ih [20]byte
+		copy(ih[:], t.InfoHashV2[:])
+		hashes = append(hashes, ih)
+	}
+	return hashes
+}
+
+//remotePeer returns the address a peer connected to us from
+func remotePeer(conn net.Conn) Peer {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	case *net.UDPAddr:
+		return Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	}
+	return Peer{}
+}
@@ -0,0 +1,156 @@
+package peer
+
+import (
+	"fmt"
+	connection "github.com/adityameharia/gotor/connection"
+	message "github.com/adityameharia/gotor/message"
+)
+
+//register adds the connection to peer to the connections of the torrent and tells it which pieces we have.
+//The bitfield is sent while holding the lock, so that the Haves of pieceDone can only come after it.
+func (t *Torrent) register(c *connection.Client, peer Peer) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conns == nil {
+		t.conns = make(map[*connection.Client]Peer)
+	}
+	t.conns[c] = peer
+
+	var bf connection.Bitfield
+	for i, d := range t.done {
+		if d {
+			if bf == nil {
+				bf = make(connection.Bitfield, (len(t.done)+7)/8)
+			}
+			bf.PutPiece(i)
+		}
+	}
+	if bf == nil {
+		return nil
+	}
+	return c.SendBitfield(bf)
+}
+
+//unregister removes c from the connections of the torrent
+func (t *Torrent) unregister(c *connection.Client) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.conns, c)
+}
+
+//connections returns the connections of the torrent
+func (t *Torrent) connections() []*connection.Client {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	conns := make([]*connection.Client, 0, len(t.conns))
+	for c := range t.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+//wants tells if c has a piece which we have not verified yet
+func (t *Torrent) wants(c *connection.Client) bool {
+	bf := c.Bitfield()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, d := range t.done {
+		if !d && bf.CheckPiece(i) {
+			return true
+		}
+	}
+	return false
+}
+
+//updateInterest tells c whether we are interested in its pieces, if that changed
+func (t *Torrent) updateInterest(c *connection.Client) error {
+	t.interestMu.Lock()
+	defer t.interestMu.Unlock()
+	want := t.wants(c)
+	if want && !c.AmInterested() {
+		return c.SendInterested()
+	}
+	if !want && c.AmInterested() {
+		return c.SendNotInterested()
+	}
+	return nil
+}
+
+//peerHas makes us interested in c once it has a piece which we have not verified yet
+func (t *Torrent) peerHas(c *connection.Client, index int) error {
+	t.interestMu.Lock()
+	defer t.interestMu.Unlock()
+	if c.AmInterested() {
+		return nil
+	}
+	t.mu.Lock()
+	want := index >= 0 && index < len(t.done) && !t.done[index]
+	t.mu.Unlock()
+	if !want {
+		return nil
+	}
+	return c.SendInterested()
+}
+
+//pieceDone tells every connection that we have a piece, and loses interest in the peers which have nothing else we need
+func (t *Torrent) pieceDone(index int) {
+	for _, c := range t.connections() {
+		c.SendHave(index)
+		if c.AmInterested() && c.HasPiece(index) {
+			t.updateInterest(c)
+		}
+	}
+}
+
+//handleMessage handles the messages which change what we want from the peer or ask something of us, rather than carry a piece.
+//What the messages say about the peer is tracked by the connection.
+func (t *Torrent) handleMessage(c *connection.Client, msg *message.Message) error {
+	switch msg.ID {
+	case message.Have:
+		index, err := message.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		return t.peerHas(c, index)
+	case message.Bitfield:
+		return t.updateInterest(c)
+	case message.Request:
+		return t.serveRequest(c, msg)
+	case message.HashRequest:
+		// we don't serve hashes
+		h, err := message.ParseHashRequest(msg)
+		if err != nil {
+			return err
+		}
+		return c.SendHashReject(h)
+	}
+	return nil
+}
+
+//serveRequest sends the block c asked for if we are not choking it and have verified its piece.
+//Requests we can't serve are dropped, as the peer asks again once it is unchoked or sees our Have.
+func (t *Torrent) serveRequest(c *connection.Client, msg *message.Message) error {
+	index, begin, length, err := message.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	if index < 0 || index >= t.numPieces() {
+		return fmt.Errorf("Peer requested invalid piece #%d", index)
+	}
+	if length <= 0 || length > message.MaxBlockLength || begin < 0 || begin+length > t.pieceSize(index) {
+		return fmt.Errorf("Peer requested invalid block [%d, %d) of piece #%d", begin, begin+length, index)
+	}
+	if c.AmChoking() {
+		return nil
+	}
+
+	t.mu.Lock()
+	if !t.done[index] {
+		t.mu.Unlock()
+		return nil
+	}
+	start, _ := t.calculateBounds(index)
+	block := append([]byte(nil), t.buf[start+begin:start+begin+length]...)
+	t.mu.Unlock()
+	return c.SendPiece(index, begin, block)
+}
@@ -0,0 +1,36 @@
+package peer
+
+import (
+	connection "github.com/adityameharia/gotor/connection"
+	ratelimit "github.com/adityameharia/gotor/ratelimit"
+)
+
+// Limits are the rate limiters applied to the connections of a torrent.
+// Any of them may be nil for no limit, and their rates can be changed while downloading.
+type Limits struct {
+	// GlobalDownload and GlobalUpload are meant to be shared by every torrent
+	GlobalDownload *ratelimit.Limiter
+	GlobalUpload   *ratelimit.Limiter
+
+	// Download and Upload limit this torrent only
+	Download *ratelimit.Limiter
+	Upload   *ratelimit.Limiter
+
+	// PeerDownload and PeerUpload set the rate of every single connection,
+	// each connection gets its own bucket derived from them
+	PeerDownload *ratelimit.Limiter
+	PeerUpload   *ratelimit.Limiter
+}
+
+//connOption returns the connection option applying the limits to one new connection
+func (l Limits) connOption() connection.Option {
+	return connection.WithRateLimit(
+		[]*ratelimit.Limiter{l.GlobalDownload, l.Download, l.PeerDownload.Derive()},
+		[]*ratelimit.Limiter{l.GlobalUpload, l.Upload, l.PeerUpload.Derive()},
+	)
+}
+
+//httpLimiters returns the download limiters of one web seed or HTTP seed, which is throttled like a connection
+func (l Limits) httpLimiters() []*ratelimit.Limiter {
+	return []*ratelimit.Limiter{l.GlobalDownload, l.Download, l.PeerDownload.Derive()}
+}
@@ -0,0 +1,63 @@
+package peer
+
+import (
+	"net"
+	"sort"
+)
+
+// local address ranges: private IPv4 (RFC 1918), IPv4 link local, unique local IPv6 and IPv6 link local
+var localNets = parseCIDRs("10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "169.254.0.0/16", "fc00::/7", "fe80::/10")
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// IsLocal reports whether the peer is on the local network, such as the peers found by local service discovery
+func (p Peer) IsLocal() bool {
+	if p.IP.IsLoopback() {
+		return true
+	}
+	for _, n := range localNets {
+		if n.Contains(p.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+//localFirst sorts peers so that the local ones, much faster than the others, are connected to first
+func localFirst(peers []Peer) []Peer {
+	sorted := make([]Peer, len(peers))
+	copy(sorted, peers)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].IsLocal() && !sorted[j].IsLocal()
+	})
+	return sorted
+}
+
+// AddPeers adds peers found after the download started, such as LAN peers found by local service discovery.
+// If a download is running the peers which are new are connected to straight away as long as the connection limits allow,
+// otherwise on the next run. Private torrents only get peers from their tracker, so the peers are dropped for them.
+func (t *Torrent) AddPeers(peers ...Peer) {
+	if t.Private {
+		t.log().Debugf("Dropping %d peers not from the tracker of the private torrent", len(peers))
+		return
+	}
+	t.addPeers(peers)
+}
+
+//addPeers adds peers, from the trackers or found by other means, and connects to them if the download is running
+func (t *Torrent) addPeers(peers []Peer) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Peers = mergePeers(t.Peers, peers)
+	t.topUp()
+}
@@ -0,0 +1,60 @@
+package peer
+
+import (
+	"context"
+	connection "github.com/adityameharia/gotor/connection"
+	"sync"
+	"time"
+)
+
+// ManageInterval is how often the connections are checked for peers which became useless
+const ManageInterval = 10 * time.Second
+
+// DefaultUselessTimeout is how long a peer is kept without exchanging a block when Torrent.UselessTimeout is 0
+const DefaultUselessTimeout = 2 * time.Minute
+
+//connOptions returns the options of the connections to the peers of the torrent, for the swarm of peer
+func (t *Torrent) connOptions(v2 bool) []connection.Option {
+	opts := []connection.Option{t.Limits.connOption(), connection.WithIPFilter(t.Filter), connection.WithDialer(t.Dialer),
+		connection.WithEncryption(t.Encryption), connection.WithUTP(t.UTP), connection.WithPieces(t.numPieces()),
+		connection.WithKeepAlive(t.KeepAlive), connection.WithIdleTimeout(t.IdleTimeout)}
+	if v2 {
+		opts = append(opts, connection.WithV2())
+	}
+	return opts
+}
+
+//manage drops the peers which became useless and tops up the connections every ManageInterval, until ctx is done.
+//The announces it starts are added to wg, the WaitGroup of the running download.
+func (t *Torrent) manage(ctx context.Context, wg *sync.WaitGroup) {
+	ticker := time.NewTicker(ManageInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.dropUseless()
+			t.refill(ctx, wg)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+//dropUseless disconnects the peers with which no block was exchanged for the useless timeout.
+//Their workers exit and are replaced with other peers by the pool.
+func (t *Torrent) dropUseless() {
+	timeout := t.UselessTimeout
+	if timeout <= 0 {
+		timeout = DefaultUselessTimeout
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for c, p := range t.conns {
+		if time.Since(c.LastPiece()) < timeout {
+			continue
+		}
+		t.log().With("peer", p.String()).Debugf("Disconnecting peer which exchanged no block for %v", timeout)
+		c.Close()
+	}
+}
@@ -0,0 +1,49 @@
+package peer
+
+//paddingBlocks returns, by piece index, which blocks of the pieces lie entirely in padding files (BEP 47).
+//Those blocks are zeros, so they are not asked for and the zeros are hashed along with the rest of the piece.
+func (t *Torrent) paddingBlocks() map[int][]bool {
+	var pads map[int][]bool
+	offset := 0
+	for _, f := range t.Files {
+		begin, end := offset, offset+f.Length
+		offset = end
+		if !f.Padding || f.Length == 0 || t.PiecesV2 != nil {
+			continue
+		}
+		if pads == nil {
+			pads = make(map[int][]bool)
+		}
+		for index := begin / t.PieceLength; index <= (end-1)/t.PieceLength; index++ {
+			pieceBegin, pieceEnd := t.calculateBounds(index)
+			blocks := pads[index]
+			if blocks == nil {
+				blocks = make([]bool, len(blockSources(pieceEnd-pieceBegin)))
+				pads[index] = blocks
+			}
+			for i := range blocks {
+				b := pieceBegin + i*MaxBlockSize
+				e := b + MaxBlockSize
+				if e > pieceEnd {
+					e = pieceEnd
+				}
+				if b >= begin && e <= end {
+					blocks[i] = true
+				}
+			}
+		}
+	}
+	return pads
+}
+
+//skipPadding moves past the blocks of the piece which are padding, counting them as downloaded
+func (p *pieceProgress) skipPadding(pw *work) {
+	for p.requested < pw.length && pw.padding != nil && pw.padding[p.requested/MaxBlockSize] {
+		n := MaxBlockSize
+		if pw.length-p.requested < n {
+			n = pw.length - p.requested
+		}
+		p.requested += n
+		p.downloaded += n
+	}
+}
@@ -0,0 +1,224 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DefaultMaxConnections is the number of peers a torrent is connected to at once when Torrent.MaxConnections is 0
+const DefaultMaxConnections = 50
+
+// RetryBackoff is how long a peer is not connected to again after a connection, doubling with every failure in a row up to MaxRetryBackoff.
+// A connection which got us a piece is not a failure.
+const RetryBackoff = 15 * time.Second
+
+// MaxRetryBackoff is the longest a peer which keeps failing waits before being connected to again
+const MaxRetryBackoff = 30 * time.Minute
+
+// ReannounceInterval is how often the trackers are asked for more peers while there are no peers left to connect to
+const ReannounceInterval = 5 * time.Minute
+
+// ConnLimit caps the number of peers connected to at once by all the torrents sharing it
+type ConnLimit struct {
+	max int
+
+	mu sync.Mutex
+	n  int
+}
+
+// NewConnLimit returns a limit of max connections
+func NewConnLimit(max int) *ConnLimit {
+	return &ConnLimit{max: max}
+}
+
+// Connections returns the number of connections counted against the limit
+func (l *ConnLimit) Connections() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.n
+}
+
+//acquire counts one more connection, unless the limit is reached. A nil limit is no limit.
+func (l *ConnLimit) acquire() bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.n >= l.max {
+		return false
+	}
+	l.n++
+	return true
+}
+
+//release counts one connection less
+func (l *ConnLimit) release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.n--
+	l.mu.Unlock()
+}
+
+//peerState is what the pool knows of one of the peers of the torrent, by address
+type peerState struct {
+	// active is set while a worker is connecting or connected to the peer
+	active bool
+	// inbound is set while the peer is connected to us from addr, which is not where it listens
+	inbound bool
+	// id is the peer ID the peer sent in its last handshake
+	id       string
+	failures int
+	retryAt  time.Time
+	// self is set for an address which turned out to be us
+	self bool
+}
+
+//peerState returns the state of the peer at addr. t.mu must be held.
+func (t *Torrent) peerState(addr string) *peerState {
+	if t.pool == nil {
+		t.pool = make(map[string]*peerState)
+		t.poolIDs = make(map[string]string)
+	}
+	s := t.pool[addr]
+	if s == nil {
+		s = &peerState{}
+		t.pool[addr] = s
+	}
+	return s
+}
+
+//maxConnections returns the number of peers the torrent connects to at once
+func (t *Torrent) maxConnections() int {
+	if t.MaxConnections > 0 {
+		return t.MaxConnections
+	}
+	return DefaultMaxConnections
+}
+
+//topUp connects to peers until MaxConnections of them are active or the global limit is reached, local peers first.
+//Peers which are backing off, banned, or connected at another address are skipped.
+//It returns false if it ran out of peers to connect to. t.mu must be held.
+func (t *Torrent) topUp() bool {
+	if t.spawn == nil {
+		return true
+	}
+	active := 0
+	for _, s := range t.pool {
+		if s.active {
+			active++
+		}
+	}
+
+	now := time.Now()
+	for _, p := range localFirst(t.Peers) {
+		if active >= t.maxConnections() {
+			return true
+		}
+		s := t.peerState(p.String())
+		if s.active || s.self || now.Before(s.retryAt) || t.banned[p.IP.String()] {
+			continue
+		}
+		if s.id != "" && t.poolIDs[s.id] != "" {
+			continue
+		}
+		if !t.GlobalConnections.acquire() {
+			return true
+		}
+		s.active = true
+		active++
+		t.spawn(p)
+	}
+	return active >= t.maxConnections()
+}
+
+//claim records the peer ID of the peer connected to at addr,
+//refusing the connection if the peer is us or is already connected at another address
+func (t *Torrent) claim(addr string, id []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.peerState(addr)
+	if bytes.Equal(id, t.PeerID) {
+		s.self = true
+		return fmt.Errorf("Connected to ourselves")
+	}
+	s.id = string(id)
+	if s.id == "" {
+		return nil
+	}
+	if other := t.poolIDs[s.id]; other != "" && other != addr {
+		return fmt.Errorf("Peer is already connected at %s", other)
+	}
+	t.poolIDs[s.id] = addr
+	return nil
+}
+
+//release records that the worker of the peer at addr exited, after getting us a piece or not, and replaces it with another peer.
+//A worker stopped along with the download doesn't count as a failure.
+func (t *Torrent) release(addr string, useful, stopped bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.peerState(addr)
+	s.active = false
+	if s.id != "" && t.poolIDs[s.id] == addr {
+		delete(t.poolIDs, s.id)
+	}
+	t.GlobalConnections.release()
+	if s.inbound {
+		// peers are not connected to at the address they connected to us from, so there is nothing to back off from
+		delete(t.pool, addr)
+	}
+	if stopped {
+		return
+	}
+	if s.inbound {
+		t.topUp()
+		return
+	}
+	if useful {
+		s.failures = 0
+	} else {
+		s.failures++
+	}
+	s.retryAt = time.Now().Add(backoff(s.failures))
+	t.topUp()
+}
+
+//backoff returns how long a peer waits before being connected to again after failures in a row
+func backoff(failures int) time.Duration {
+	d := RetryBackoff
+	for i := 1; i < failures && d < MaxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > MaxRetryBackoff {
+		d = MaxRetryBackoff
+	}
+	return d
+}
+
+//refill connects to the peers whose backoff ran out, and asks the trackers for more peers
+//if there are none left and they were not asked for ReannounceInterval. The announce is added to wg.
+func (t *Torrent) refill(ctx context.Context, wg *sync.WaitGroup) {
+	t.mu.Lock()
+	full := t.topUp()
+	reannounce := !full && t.Announce != nil && time.Since(t.lastAnnounce) >= ReannounceInterval
+	if reannounce {
+		t.lastAnnounce = time.Now()
+	}
+	t.mu.Unlock()
+	if reannounce {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := t.announce(ctx)
+			if err != nil && ctx.Err() == nil {
+				t.log().Warnf("Reannounce failed: %v", err)
+			}
+		}()
+	}
+}
@@ -0,0 +1,174 @@
+package peer
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+//poolTorrent returns a torrent with n peers whose spawned workers are only recorded in spawned
+func poolTorrent(n, max int) (*Torrent, *[]Peer) {
+	tor := &Torrent{PeerID: []byte("-GT0001-000000000000"), MaxConnections: max}
+	for i := 0; i < n; i++ {
+		tor.Peers = append(tor.Peers, Peer{IP: net.IPv4(10, 0, 0, byte(i+1)), Port: 6881})
+	}
+	spawned := &[]Peer{}
+	tor.spawn = func(p Peer) {
+		*spawned = append(*spawned, p)
+	}
+	return tor, spawned
+}
+
+func topUp(tor *Torrent) bool {
+	tor.mu.Lock()
+	defer tor.mu.Unlock()
+	return tor.topUp()
+}
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, RetryBackoff},
+		{1, RetryBackoff},
+		{2, 2 * RetryBackoff},
+		{3, 4 * RetryBackoff},
+		{7, 64 * RetryBackoff},
+		{8, MaxRetryBackoff},
+		{100, MaxRetryBackoff},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.failures); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestPoolCaps(t *testing.T) {
+	tor, spawned := poolTorrent(5, 2)
+	if !topUp(tor) {
+		t.Error("topUp ran out of peers with 5 peers for 2 connections")
+	}
+	if len(*spawned) != 2 {
+		t.Fatalf("Connected to %d peers, want 2", len(*spawned))
+	}
+
+	// a worker exiting is replaced straight away, by a peer which is not backing off
+	first := (*spawned)[0]
+	tor.release(first.String(), false, false)
+	if len(*spawned) != 3 || (*spawned)[2].String() == first.String() {
+		t.Fatalf("Connected to %v after a worker exited", *spawned)
+	}
+	// a stopped worker is not replaced
+	tor.release((*spawned)[1].String(), false, true)
+	if len(*spawned) != 3 {
+		t.Fatalf("Connected to %v after the download stopped", *spawned)
+	}
+
+	// the global limit is shared with other torrents
+	limit := NewConnLimit(3)
+	a, spawnedA := poolTorrent(5, 2)
+	b, spawnedB := poolTorrent(5, 2)
+	a.GlobalConnections, b.GlobalConnections = limit, limit
+	topUp(a)
+	topUp(b)
+	if len(*spawnedA) != 2 || len(*spawnedB) != 1 || limit.Connections() != 3 {
+		t.Fatalf("Connected to %d and %d peers with %d global connections, want 2, 1 and 3", len(*spawnedA), len(*spawnedB), limit.Connections())
+	}
+	a.release((*spawnedA)[0].String(), true, true)
+	if limit.Connections() != 2 {
+		t.Errorf("Got %d global connections after a release, want 2", limit.Connections())
+	}
+	topUp(b)
+	if len(*spawnedB) != 2 {
+		t.Errorf("Torrent sharing the global limit connected to %d peers once a connection was released, want 2", len(*spawnedB))
+	}
+}
+
+func TestPoolBackoff(t *testing.T) {
+	tor, spawned := poolTorrent(1, 1)
+	addr := tor.Peers[0].String()
+	for failures := 1; failures <= 10; failures++ {
+		topUp(tor)
+		tor.release(addr, false, false)
+		s := tor.pool[addr]
+		if s.failures != failures {
+			t.Fatalf("Got %d failures, want %d", s.failures, failures)
+		}
+		if wait := time.Until(s.retryAt); wait > backoff(failures) || wait < backoff(failures)-time.Second {
+			t.Errorf("Peer waits %v after %d failures, want %v", wait, failures, backoff(failures))
+		}
+		// the peer is not connected to again before its backoff runs out
+		if topUp(tor) || len(*spawned) != failures {
+			t.Fatalf("Connected to a peer backing off")
+		}
+		s.retryAt = time.Now()
+	}
+
+	// a connection which got us a piece resets the failures, a stopped one leaves them as they were
+	topUp(tor)
+	tor.release(addr, true, false)
+	if s := tor.pool[addr]; s.failures != 0 || time.Until(s.retryAt) > RetryBackoff {
+		t.Errorf("Got %d failures and a wait of %v after a useful connection", s.failures, time.Until(s.retryAt))
+	}
+	tor.pool[addr].retryAt = time.Now()
+	topUp(tor)
+	tor.release(addr, false, true)
+	if s := tor.pool[addr]; s.failures != 0 {
+		t.Errorf("Got %d failures after the download stopped", s.failures)
+	}
+
+	// banned peers are not connected to
+	tor.banned = map[string]bool{tor.Peers[0].IP.String(): true}
+	n := len(*spawned)
+	topUp(tor)
+	if len(*spawned) != n {
+		t.Error("Connected to a banned peer")
+	}
+}
+
+func TestPoolDedupe(t *testing.T) {
+	tor, spawned := poolTorrent(3, 3)
+	a, b, c := tor.Peers[0].String(), tor.Peers[1].String(), tor.Peers[2].String()
+	topUp(tor)
+
+	if err := tor.claim(a, []byte("-XX0001-000000000001")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tor.claim(b, []byte("-XX0001-000000000001")); err == nil {
+		t.Fatal("Connected twice to the same peer ID")
+	}
+	if err := tor.claim(c, tor.PeerID); err == nil {
+		t.Fatal("Connected to ourselves")
+	}
+	tor.release(b, false, false)
+	tor.release(c, false, false)
+	for _, addr := range []string{b, c} {
+		tor.pool[addr].retryAt = time.Time{}
+	}
+
+	// the peer known at b is still connected at a, and c is us
+	n := len(*spawned)
+	topUp(tor)
+	if len(*spawned) != n {
+		t.Fatalf("Connected to %v", (*spawned)[n:])
+	}
+
+	// once a is gone, the peer can be connected to at b
+	tor.release(a, true, false)
+	if len(*spawned) != n+1 || (*spawned)[n].String() != b {
+		t.Fatalf("Connected to %v once the peer was released, want %s", (*spawned)[n:], b)
+	}
+	if err := tor.claim(b, []byte("-XX0001-000000000001")); err != nil {
+		t.Fatal(err)
+	}
+
+	// peers without an ID are never duplicates
+	for i := 0; i < 2; i++ {
+		if err := tor.claim(fmt.Sprintf("10.0.1.%d:6881", i), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
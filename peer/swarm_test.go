@@ -0,0 +1,150 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+//testPieceLength is the piece length of the test torrents, two blocks
+const testPieceLength = 2 * MaxBlockSize
+
+//testData returns length bytes of random data
+func testData(length int, seed int64) []byte {
+	data := make([]byte, length)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+//newTestTorrent returns a torrent of data, with a peer ID ending in id
+func newTestTorrent(data []byte, id byte) *Torrent {
+	var hashes [][20]byte
+	for begin := 0; begin < len(data); begin += testPieceLength {
+		end := begin + testPieceLength
+		if end > len(data) {
+			end = len(data)
+		}
+		hashes = append(hashes, sha1.Sum(data[begin:end]))
+	}
+	return &Torrent{
+		PeerID:      append([]byte("-GT0001-00000000000"), id),
+		InfoHash:    sha1.Sum(data[:1]),
+		PieceHashes: hashes,
+		PieceLength: testPieceLength,
+		Length:      len(data),
+		Name:        "test",
+	}
+}
+
+//complete gives tor all of data, as if it had downloaded it
+func complete(tor *Torrent, data []byte) {
+	tor.init()
+	tor.mu.Lock()
+	copy(tor.buf, data)
+	for i := range tor.done {
+		tor.done[i] = true
+	}
+	tor.mu.Unlock()
+}
+
+//listenLocal serves the peers connecting to tor on the loopback interface until the test ends, and returns its address
+func listenLocal(t *testing.T, tor *Torrent) Peer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan struct{})
+	go func() {
+		tor.Serve(l)
+		close(served)
+	}()
+	t.Cleanup(func() {
+		l.Close()
+		<-served
+	})
+	addr := l.Addr().(*net.TCPAddr)
+	return Peer{IP: addr.IP, Port: uint16(addr.Port)}
+}
+
+//seed seeds data from a torrent accepting connections on the loopback interface until the test ends, and returns its address.
+//Its choker is run every few milliseconds instead of every ChokeInterval.
+func seed(t *testing.T, data []byte, id byte) (*Torrent, Peer) {
+	tor := newTestTorrent(data, id)
+	complete(tor, data)
+	connected := make(chan struct{}, 1)
+	tor.OnEvent = func(e Event) {
+		if e.Type == PeerConnected {
+			select {
+			case connected <- struct{}{}:
+			default:
+			}
+		}
+	}
+	addr := listenLocal(t, tor)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	seeded := make(chan error, 1)
+	go func() {
+		seeded <- tor.Seed(ctx)
+	}()
+	// peers connecting before the seed runs would be turned away
+	for running := false; !running; {
+		tor.mu.Lock()
+		running = tor.serve != nil
+		tor.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		// the choker is set once a peer connected
+		select {
+		case <-connected:
+		case <-ctx.Done():
+			return
+		}
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				tor.choker.rechoke(true)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-seeded; err != context.Canceled {
+			t.Errorf("Seed returned %v, want %v", err, context.Canceled)
+		}
+	})
+	return tor, addr
+}
+
+func TestSeed(t *testing.T) {
+	data := testData(5*testPieceLength+100, 1)
+	_, addr := seed(t, data, 1)
+
+	tor := newTestTorrent(data, 2)
+	tor.Peers = []Peer{addr}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	got, err := tor.Download(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("Downloaded data differs from the seeded data")
+	}
+}
+
+func TestSeedIncomplete(t *testing.T) {
+	tor := newTestTorrent(testData(testPieceLength, 2), 1)
+	if err := tor.Seed(context.Background()); err == nil {
+		t.Fatal("Seeded a torrent with no verified pieces")
+	}
+}
@@ -0,0 +1,168 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	connection "github.com/adityameharia/gotor/connection"
+	merkle "github.com/adityameharia/gotor/merkle"
+	message "github.com/adityameharia/gotor/message"
+	"time"
+)
+
+// PieceV2 is what a piece of a BitTorrent v2 torrent (BEP 52) is verified against
+type PieceV2 struct {
+	// Hash is the root of the subtree of the blocks of the piece, as found in the piece layer of its file
+	Hash merkle.Hash
+	// Root is the pieces root of the file the piece belongs to, and FileWidth the number of leaves of its tree
+	Root      merkle.Hash
+	FileWidth int
+	// Block is the index in its file of the first block of the piece, and Width the number of leaves of its subtree
+	Block int
+	Width int
+	// Length is the size of the piece, which stops at the end of its file
+	Length int
+	// Layer is the tree from the piece layer of the file up to Root, nil for a file of a single piece
+	Layer *merkle.Tree
+}
+
+//verify tells if buf is the data of the piece, by hashing it up to the pieces root of its file
+//with the other hashes of the piece layer
+func (p *PieceV2) verify(buf []byte) bool {
+	if len(buf) != p.Length {
+		return false
+	}
+	hash := merkle.PieceHash(buf, p.Width)
+	if p.Layer == nil {
+		return p.Block == 0 && hash == p.Root
+	}
+	index := p.Block / p.Width
+	return hash == p.Hash && merkle.Verify(p.Root, []merkle.Hash{hash}, merkle.Height(p.Width), index, p.Layer.Proof(index))
+}
+
+//announceV2 fetches the peers of the v2 swarm of a hybrid torrent and adds them
+func (t *Torrent) announceV2(ctx context.Context) {
+	peers, err := t.AnnounceV2(ctx)
+	t.emit(Event{Type: TrackerAnnounce, Peers: len(peers), Err: err})
+	if err != nil {
+		t.log().Warnf("Announce to the v2 swarm failed: %v", err)
+		return
+	}
+	t.log().Infof("Tracker returned %d peers of the v2 swarm", len(peers))
+
+	t.mu.Lock()
+	if t.v2Peers == nil {
+		t.v2Peers = make(map[string]bool)
+	}
+	for _, p := range peers {
+		t.v2Peers[p.String()] = true
+	}
+	t.mu.Unlock()
+	t.addPeers(peers)
+}
+
+//swarm returns the infohash to connect to peer with, and whether it is the truncated v2 infohash
+func (t *Torrent) swarm(peer Peer) ([20]byte, bool) {
+	if t.PiecesV2 != nil {
+		return t.InfoHash, true
+	}
+	t.mu.Lock()
+	v2 := t.v2Peers[peer.String()]
+	t.mu.Unlock()
+	if !v2 {
+		return t.InfoHash, false
+	}
+	var ih [20]byte
+	copy(ih[:], t.InfoHashV2[:])
+	return ih, true
+}
+
+//pieceFailedV2 finds the blocks of a v2 piece which failed the integrity check by asking c for their hashes,
+//and strikes the peers which sent them. Without the hashes it falls back to pieceFailed.
+func (t *Torrent) pieceFailedV2(c *connection.Client, peer Peer, pw *work, buf []byte, sources []Peer) {
+	hashes, err := t.blockHashes(c, pw.v2)
+	if err != nil {
+		t.log().With("peer", peer.String()).Debugf("Could not get the block hashes of piece #%d: %v", pw.index, err)
+		t.pieceFailed(pw.index, buf, sources)
+		return
+	}
+
+	culprits := make(map[string]Peer)
+	for i, p := range sources {
+		begin := i * MaxBlockSize
+		end := begin + MaxBlockSize
+		if end > len(buf) {
+			end = len(buf)
+		}
+		if p.IP != nil && merkle.Leaf(buf[begin:end]) != hashes[i] {
+			culprits[p.IP.String()] = p
+		}
+	}
+	for _, p := range culprits {
+		t.strike(p, pw.index)
+	}
+}
+
+//blockHashes asks c for the leaf hashes of a piece, and checks them against the pieces root of its file with the proof it sends along
+func (t *Torrent) blockHashes(c *connection.Client, p *PieceV2) ([]merkle.Hash, error) {
+	spec := message.HashSpec{
+		PiecesRoot:  p.Root,
+		Index:       p.Block,
+		Length:      p.Width,
+		ProofLayers: merkle.Height(p.FileWidth) - merkle.Height(p.Width),
+	}
+	err := c.SendHashRequest(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := time.NewTimer(30 * time.Second)
+	defer timeout.Stop()
+
+	for {
+		var ev connection.Event
+		var ok bool
+		select {
+		case ev, ok = <-c.Events():
+			err = eventError(c, ev, ok)
+			if err != nil {
+				return nil, err
+			}
+		case <-timeout.C:
+			return nil, fmt.Errorf("Timed out waiting for the hashes")
+		}
+		if ev.Message == nil { // keep-alive
+			continue
+		}
+		hashes, err := t.hashesReply(c, p, spec, ev.Message)
+		ev.Release()
+		if err != nil || hashes != nil {
+			return hashes, err
+		}
+	}
+}
+
+//hashesReply handles a message of c while waiting for the hashes of spec, returning them once they came and were checked
+func (t *Torrent) hashesReply(c *connection.Client, p *PieceV2, spec message.HashSpec, msg *message.Message) ([]merkle.Hash, error) {
+	switch msg.ID {
+	case message.HashReject:
+		h, err := message.ParseHashReject(msg)
+		if err != nil {
+			return nil, err
+		}
+		if h == spec {
+			return nil, fmt.Errorf("Peer rejected the hash request")
+		}
+	case message.Hashes:
+		h, hashes, proof, err := message.ParseHashes(msg)
+		if err != nil || h != spec {
+			return nil, err
+		}
+		if !merkle.Verify(p.Root, hashes, 0, p.Block, proof) {
+			return nil, fmt.Errorf("Hashes don't match the pieces root %x", p.Root)
+		}
+		return hashes, nil
+	default:
+		return nil, t.handleMessage(c, msg)
+	}
+	return nil, nil
+}
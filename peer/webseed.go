@@ -0,0 +1,134 @@
+package peer
+
+import (
+	"context"
+	"errors"
+	proxy "github.com/adityameharia/gotor/proxy"
+	webseed "github.com/adityameharia/gotor/webseed"
+	"time"
+)
+
+// MaxWebSeedFailures is the number of failed pieces in a row after which a web seed or HTTP seed is left alone until the next run
+const MaxWebSeedFailures = 5
+
+// File is one of the files of a multi file torrent, in the order of the info dictionary
+type File struct {
+	Path   []string
+	Length int
+
+	// Padding is set for padding files (BEP 47) and for the space between the files of a v2 torrent.
+	// Padding is all zeros, it is never written to disk nor asked for.
+	Padding bool
+	// Executable and Hidden are the attributes of the file (BEP 47)
+	Executable bool
+	Hidden     bool
+	// Symlink is the path in the torrent the file links to, nil unless the file is a symlink
+	Symlink []string
+}
+
+//webSeedFiles returns the layout of the torrent as seen by web seeds, nil for a single file torrent
+func (t *Torrent) webSeedFiles() []webseed.File {
+	if len(t.Files) == 0 {
+		return nil
+	}
+	files := make([]webseed.File, len(t.Files))
+	for i, f := range t.Files {
+		files[i] = webseed.File{Path: webseed.Path(f.Path), Length: int64(f.Length), Padding: f.Padding}
+	}
+	return files
+}
+
+//fetchFunc downloads piece pw into buf
+type fetchFunc func(ctx context.Context, pw *work, buf []byte) error
+
+//startWebSeed downloads pieces from the BEP 19 web seed at url
+func (t *Torrent) startWebSeed(ctx context.Context, url string, workQueue chan *work, results chan *result) {
+	seed := &webseed.Seed{
+		URL:      url,
+		Name:     t.Name,
+		Files:    t.webSeedFiles(),
+		Client:   proxy.HTTPClient(t.Dialer, time.Minute),
+		Limiters: t.Limits.httpLimiters(),
+	}
+	t.downloadHTTP(ctx, url, func(ctx context.Context, pw *work, buf []byte) error {
+		begin, _ := t.calculateBounds(pw.index)
+		return seed.ReadAt(ctx, buf, int64(begin))
+	}, workQueue, results)
+}
+
+//startHTTPSeed downloads pieces from the BEP 17 seed script at url
+func (t *Torrent) startHTTPSeed(ctx context.Context, url string, workQueue chan *work, results chan *result) {
+	seed := &webseed.HTTPSeed{
+		URL:      url,
+		InfoHash: t.InfoHash,
+		Client:   proxy.HTTPClient(t.Dialer, time.Minute),
+		Limiters: t.Limits.httpLimiters(),
+	}
+	t.downloadHTTP(ctx, url, func(ctx context.Context, pw *work, buf []byte) error {
+		return seed.ReadPiece(ctx, pw.index, buf)
+	}, workQueue, results)
+}
+
+//downloadHTTP downloads pieces with fetch, taking them from the same queue as the peers.
+//Failed pieces go back to the queue, and the seed is given up after MaxWebSeedFailures in a row.
+//A seed which is busy is asked again once the time it gave has passed.
+func (t *Torrent) downloadHTTP(ctx context.Context, url string, fetch fetchFunc, workQueue chan *work, results chan *result) {
+	log := t.log().With("webseed", url)
+
+	failures := 0
+	for {
+		var pw *work
+		select {
+		case pw = <-workQueue:
+		case <-ctx.Done():
+			return
+		}
+
+		buf := make([]byte, pw.length)
+		err := fetch(ctx, pw, buf)
+		if err == nil {
+			t.addDownloaded(len(buf))
+		}
+		if err == nil {
+			err = checkIntegrity(pw, buf)
+		}
+		if err != nil {
+			workQueue <- pw // Put piece back on the queue
+			if ctx.Err() != nil {
+				return
+			}
+
+			var wait time.Duration
+			var retry *webseed.RetryError
+			if errors.As(err, &retry) {
+				log.Debugf("Seed is busy, retrying in %v", retry.After)
+				wait = retry.After
+			} else {
+				t.emit(Event{Type: PieceFailed, Piece: pw.index, WebSeed: url, Err: err})
+				failures++
+				if failures >= MaxWebSeedFailures {
+					log.Warnf("Giving up on web seed: %v", err)
+					return
+				}
+				log.Debugf("Piece #%d failed: %v", pw.index, err)
+				// back off a little more after every failure
+				wait = time.Duration(failures) * time.Second
+			}
+
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		failures = 0
+		t.pieceVerified(pw.index, buf)
+
+		select {
+		case results <- &result{index: pw.index, buf: buf, webSeed: url}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// HTTP is a proxy reached with the CONNECT method.
+// It can't relay UDP, so ListenPacket always fails.
+type HTTP struct {
+	Addr     string
+	Username string
+	Password string
+
+	// Forward is used to connect to the proxy itself, Direct if nil
+	Forward Dialer
+}
+
+// ErrUDPNotSupported is returned by ListenPacket for proxies which can't relay UDP
+var ErrUDPNotSupported = errors.New("Proxy can't relay UDP")
+
+func (p *HTTP) forward() Dialer {
+	if p.Forward == nil {
+		return Direct
+	}
+	return p.Forward
+}
+
+func (p *HTTP) url() *url.URL {
+	u := &url.URL{Scheme: "http", Host: p.Addr}
+	if p.Username != "" {
+		u.User = url.UserPassword(p.Username, p.Password)
+	}
+	return u
+}
+
+// DialContext opens a tunnel to address with CONNECT
+func (p *HTTP) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("HTTP proxy can't dial network %q", network)
+	}
+
+	conn, err := p.forward().DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the handshake must not outlive ctx
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if p.Username != "" {
+		auth := base64.StdEncoding.EncodeToString([]byte(p.Username + ":" + p.Password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	err = req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP proxy refused CONNECT to %s: %s", address, resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// ListenPacket returns ErrUDPNotSupported
+func (p *HTTP) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	return nil, ErrUDPNotSupported
+}
+
+//bufferedConn is a connection whose first bytes were already read into a bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
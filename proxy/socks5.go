@@ -0,0 +1,377 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SOCKS5 protocol constants, RFC 1928 and RFC 1929
+const (
+	socksVersion = 5
+
+	socksAuthNone     = 0
+	socksAuthPassword = 2
+	socksAuthNoneOK   = 0xff
+
+	socksConnect      = 1
+	socksUDPAssociate = 3
+
+	socksIPv4   = 1
+	socksDomain = 3
+	socksIPv6   = 4
+)
+
+// SOCKS5 is a proxy speaking SOCKS version 5, with optional username/password authentication.
+// TCP goes through CONNECT and UDP through UDP ASSOCIATE.
+type SOCKS5 struct {
+	Addr     string
+	Username string
+	Password string
+
+	// Forward is used to connect to the proxy itself, Direct if nil
+	Forward Dialer
+}
+
+func (p *SOCKS5) forward() Dialer {
+	if p.Forward == nil {
+		return Direct
+	}
+	return p.Forward
+}
+
+// DialContext connects to address through the proxy
+func (p *SOCKS5) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("SOCKS5 proxy can't dial network %q", network)
+	}
+	conn, _, err := p.request(ctx, socksConnect, address)
+	return conn, err
+}
+
+// ListenPacket sets up a UDP relay on the proxy with UDP ASSOCIATE.
+// The relay lives as long as the returned socket.
+func (p *SOCKS5) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	ctrl, bound, err := p.request(ctx, socksUDPAssociate, "0.0.0.0:0")
+	if err != nil {
+		return nil, err
+	}
+	relay, ok := bound.(*net.UDPAddr)
+	if !ok {
+		ctrl.Close()
+		return nil, fmt.Errorf("SOCKS5 proxy relays UDP at host name %s, which we don't resolve outside of the proxy", bound)
+	}
+
+	// a relay on an unspecified address is reached at the address of the proxy
+	if relay.IP == nil || relay.IP.IsUnspecified() {
+		host, _, err := net.SplitHostPort(ctrl.RemoteAddr().String())
+		if err != nil {
+			ctrl.Close()
+			return nil, err
+		}
+		relay.IP = net.ParseIP(host)
+	}
+
+	var lc net.ListenConfig
+	pc, err := lc.ListenPacket(ctx, "udp", ":0")
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	c := &socksPacketConn{PacketConn: pc, ctrl: ctrl, relay: relay}
+	// the relay is torn down by the proxy when the control connection closes, so close with it
+	go c.watchControl()
+	return c, nil
+}
+
+//request connects to the proxy, authenticates and sends cmd for address.
+//It returns the connection to the proxy and the address bound by the proxy.
+func (p *SOCKS5) request(ctx context.Context, cmd byte, address string) (net.Conn, net.Addr, error) {
+	conn, err := p.forward().DialContext(ctx, "tcp", p.Addr)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(30 * time.Second))
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	bound, err := p.handshake(conn, cmd, address)
+	close(done)
+	if err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, bound, nil
+}
+
+func (p *SOCKS5) handshake(conn net.Conn, cmd byte, address string) (net.Addr, error) {
+	methods := []byte{socksAuthNone}
+	if p.Username != "" {
+		methods = append(methods, socksAuthPassword)
+	}
+	_, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...))
+	if err != nil {
+		return nil, err
+	}
+
+	resp := make([]byte, 2)
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp[0] != socksVersion {
+		return nil, fmt.Errorf("Unexpected SOCKS version %d", resp[0])
+	}
+
+	switch resp[1] {
+	case socksAuthNone:
+	case socksAuthPassword:
+		err = p.authenticate(conn)
+		if err != nil {
+			return nil, err
+		}
+	case socksAuthNoneOK:
+		return nil, errors.New("SOCKS5 proxy accepted none of our authentication methods")
+	default:
+		return nil, fmt.Errorf("SOCKS5 proxy picked unknown authentication method %d", resp[1])
+	}
+
+	addr, err := encodeAddr(address)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append([]byte{socksVersion, cmd, 0}, addr...))
+	if err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, 3)
+	_, err = io.ReadFull(conn, head)
+	if err != nil {
+		return nil, err
+	}
+	if head[1] != 0 {
+		return nil, fmt.Errorf("SOCKS5 request for %s failed: %s", address, replyText(head[1]))
+	}
+	return readAddr(conn)
+}
+
+func (p *SOCKS5) authenticate(conn net.Conn) error {
+	if len(p.Username) > 255 || len(p.Password) > 255 {
+		return errors.New("SOCKS5 username and password must be at most 255 bytes")
+	}
+	req := []byte{1, byte(len(p.Username))}
+	req = append(req, p.Username...)
+	req = append(req, byte(len(p.Password)))
+	req = append(req, p.Password...)
+	_, err := conn.Write(req)
+	if err != nil {
+		return err
+	}
+
+	resp := make([]byte, 2)
+	_, err = io.ReadFull(conn, resp)
+	if err != nil {
+		return err
+	}
+	if resp[1] != 0 {
+		return errors.New("SOCKS5 authentication failed")
+	}
+	return nil
+}
+
+//encodeAddr encodes host:port as ATYP, address and port
+func encodeAddr(address string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 65535 {
+		return nil, fmt.Errorf("Invalid port in %q", address)
+	}
+
+	var b []byte
+	if ip := net.ParseIP(host); ip != nil {
+		if v4 := ip.To4(); v4 != nil {
+			b = append([]byte{socksIPv4}, v4...)
+		} else {
+			b = append([]byte{socksIPv6}, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("Host name %q is too long", host)
+		}
+		b = append([]byte{socksDomain, byte(len(host))}, host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+//readAddr reads ATYP, address and port.
+//A host name is returned as a *HostAddr, as resolving it would send a DNS query around the proxy.
+func readAddr(r io.Reader) (net.Addr, error) {
+	atyp := make([]byte, 1)
+	_, err := io.ReadFull(r, atyp)
+	if err != nil {
+		return nil, err
+	}
+
+	var host []byte
+	switch atyp[0] {
+	case socksIPv4:
+		host = make([]byte, 4)
+	case socksIPv6:
+		host = make([]byte, 16)
+	case socksDomain:
+		l := make([]byte, 1)
+		_, err = io.ReadFull(r, l)
+		if err != nil {
+			return nil, err
+		}
+		host = make([]byte, l[0])
+	default:
+		return nil, fmt.Errorf("Unknown SOCKS5 address type %d", atyp[0])
+	}
+	_, err = io.ReadFull(r, host)
+	if err != nil {
+		return nil, err
+	}
+	port := make([]byte, 2)
+	_, err = io.ReadFull(r, port)
+	if err != nil {
+		return nil, err
+	}
+
+	if atyp[0] == socksDomain {
+		return &HostAddr{Host: string(host), Port: int(binary.BigEndian.Uint16(port))}, nil
+	}
+	return &net.UDPAddr{IP: net.IP(host), Port: int(binary.BigEndian.Uint16(port))}, nil
+}
+
+// HostAddr is an address given by host name by a SOCKS5 proxy, such as the sender of a UDP datagram.
+// It is left unresolved so that no DNS query goes around the proxy.
+type HostAddr struct {
+	Host string
+	Port int
+}
+
+// Network returns "udp"
+func (a *HostAddr) Network() string {
+	return "udp"
+}
+
+func (a *HostAddr) String() string {
+	return net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+}
+
+func replyText(code byte) string {
+	switch code {
+	case 1:
+		return "general failure"
+	case 2:
+		return "connection not allowed by ruleset"
+	case 3:
+		return "network unreachable"
+	case 4:
+		return "host unreachable"
+	case 5:
+		return "connection refused"
+	case 6:
+		return "TTL expired"
+	case 7:
+		return "command not supported"
+	case 8:
+		return "address type not supported"
+	default:
+		return fmt.Sprintf("error %d", code)
+	}
+}
+
+//socksPacketConn sends and receives UDP datagrams through a SOCKS5 relay,
+//every datagram starting with RSV, FRAG and the address of the actual peer
+type socksPacketConn struct {
+	net.PacketConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+	once  sync.Once
+}
+
+func (c *socksPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	head, err := encodeAddr(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	pkt := make([]byte, 0, 3+len(head)+len(b))
+	pkt = append(pkt, 0, 0, 0)
+	pkt = append(pkt, head...)
+	pkt = append(pkt, b...)
+	_, err = c.PacketConn.WriteTo(pkt, c.relay)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socksPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+262)
+	for {
+		n, from, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// drop anything which isn't from the relay, and fragments which we don't reassemble
+		if udp, ok := from.(*net.UDPAddr); !ok || !udp.IP.Equal(c.relay.IP) || udp.Port != c.relay.Port {
+			continue
+		}
+		if n < 4 || buf[2] != 0 {
+			continue
+		}
+		r := bytes.NewReader(buf[3:n])
+		addr, err := readAddr(r)
+		if err != nil {
+			continue
+		}
+		return copy(b, buf[n-r.Len():n]), addr, nil
+	}
+}
+
+func (c *socksPacketConn) Close() error {
+	var err error
+	c.once.Do(func() {
+		c.ctrl.Close()
+		err = c.PacketConn.Close()
+	})
+	return err
+}
+
+//watchControl closes the socket once the proxy closes the control connection
+func (c *socksPacketConn) watchControl() {
+	io.Copy(ioutil.Discard, c.ctrl)
+	c.Close()
+}
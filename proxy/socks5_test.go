@@ -0,0 +1,311 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+//socksServer is a SOCKS5 proxy serving CONNECT and UDP ASSOCIATE on the loopback interface
+type socksServer struct {
+	l net.Listener
+	// username and password are required if username is set
+	username string
+	password string
+	// boundHost, if set, is the host name replied as the address of the UDP relay
+	boundHost string
+}
+
+func newSOCKSServer(t *testing.T) *socksServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &socksServer{l: l}
+	go s.serve()
+	return s
+}
+
+func (s *socksServer) Close() {
+	s.l.Close()
+}
+
+func (s *socksServer) serve() {
+	for {
+		conn, err := s.l.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *socksServer) handle(conn net.Conn) {
+	defer conn.Close()
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	want := byte(socksAuthNone)
+	if s.username != "" {
+		want = socksAuthPassword
+	}
+	if bytes.IndexByte(methods, want) < 0 {
+		conn.Write([]byte{socksVersion, socksAuthNoneOK})
+		return
+	}
+	conn.Write([]byte{socksVersion, want})
+	if want == socksAuthPassword && !s.authenticate(conn) {
+		return
+	}
+
+	req := make([]byte, 3)
+	if _, err := io.ReadFull(conn, req); err != nil {
+		return
+	}
+	addr, err := readAddr(conn)
+	if err != nil {
+		return
+	}
+	switch req[1] {
+	case socksConnect:
+		s.connect(conn, addr.String())
+	case socksUDPAssociate:
+		s.associate(conn)
+	default:
+		conn.Write([]byte{socksVersion, 7, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+	}
+}
+
+func (s *socksServer) authenticate(conn net.Conn) bool {
+	read := func() string {
+		l := make([]byte, 1)
+		io.ReadFull(conn, l)
+		b := make([]byte, l[0])
+		io.ReadFull(conn, b)
+		return string(b)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+		return false
+	}
+	user, pass := read(), read()
+	if user != s.username || pass != s.password {
+		conn.Write([]byte{1, 1})
+		return false
+	}
+	conn.Write([]byte{1, 0})
+	return true
+}
+
+//reply sends a successful reply with the bound address addr
+func reply(conn net.Conn, addr string) {
+	b, _ := encodeAddr(addr)
+	conn.Write(append([]byte{socksVersion, 0, 0}, b...))
+}
+
+func (s *socksServer) connect(conn net.Conn, address string) {
+	target, err := net.Dial("tcp", address)
+	if err != nil {
+		conn.Write([]byte{socksVersion, 5, 0, socksIPv4, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer target.Close()
+	reply(conn, target.LocalAddr().String())
+	go io.Copy(target, conn)
+	io.Copy(conn, target)
+}
+
+//associate relays the datagrams of the client, which is the first to send one, until conn closes
+func (s *socksServer) associate(conn net.Conn) {
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return
+	}
+	defer relay.Close()
+	if s.boundHost != "" {
+		_, port, _ := net.SplitHostPort(relay.LocalAddr().String())
+		reply(conn, net.JoinHostPort(s.boundHost, port))
+	} else {
+		reply(conn, relay.LocalAddr().String())
+	}
+
+	go func() {
+		var client net.Addr
+		buf := make([]byte, 65536)
+		for {
+			n, from, err := relay.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if client == nil || from.String() == client.String() {
+				client = from
+				r := bytes.NewReader(buf[3:n])
+				to, err := readAddr(r)
+				if err != nil {
+					continue
+				}
+				udp, _ := net.ResolveUDPAddr("udp", to.String())
+				relay.WriteTo(buf[n-r.Len():n], udp)
+				continue
+			}
+			head, _ := encodeAddr(from.String())
+			pkt := append(append([]byte{0, 0, 0}, head...), buf[:n]...)
+			relay.WriteTo(pkt, client)
+		}
+	}()
+	io.Copy(ioutil.Discard, conn)
+}
+
+func echoTCP(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l
+}
+
+func testEcho(t *testing.T, conn net.Conn) {
+	msg := []byte("through the proxy")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatalf("Got %q, want %q", got, msg)
+	}
+}
+
+func TestSOCKS5Connect(t *testing.T) {
+	s := newSOCKSServer(t)
+	defer s.Close()
+	echo := echoTCP(t)
+	defer echo.Close()
+
+	p := &SOCKS5{Addr: s.l.Addr().String()}
+	conn, err := p.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+}
+
+func TestSOCKS5Auth(t *testing.T) {
+	s := newSOCKSServer(t)
+	s.username, s.password = "user", "secret"
+	defer s.Close()
+	echo := echoTCP(t)
+	defer echo.Close()
+
+	p := &SOCKS5{Addr: s.l.Addr().String(), Username: "user", Password: "secret"}
+	conn, err := p.DialContext(context.Background(), "tcp", echo.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	p.Password = "wrong"
+	if _, err := p.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Fatal("Connected with a wrong password")
+	}
+	p.Username = ""
+	if _, err := p.DialContext(context.Background(), "tcp", echo.Addr().String()); err == nil {
+		t.Fatal("Connected without authenticating")
+	}
+}
+
+func TestSOCKS5UDPAssociate(t *testing.T) {
+	s := newSOCKSServer(t)
+	defer s.Close()
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	p := &SOCKS5{Addr: s.l.Addr().String()}
+	pc, err := p.ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	msg := []byte("datagram")
+	if _, err := pc.WriteTo(msg, echo.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, from, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		t.Fatalf("Got %q, want %q", buf[:n], msg)
+	}
+	if from.String() != echo.LocalAddr().String() {
+		t.Fatalf("Got datagram from %s, want %s", from, echo.LocalAddr())
+	}
+}
+
+func TestSOCKS5RelayHostName(t *testing.T) {
+	s := newSOCKSServer(t)
+	s.boundHost = "relay.invalid"
+	defer s.Close()
+
+	p := &SOCKS5{Addr: s.l.Addr().String()}
+	pc, err := p.ListenPacket(context.Background())
+	if err == nil {
+		pc.Close()
+		t.Fatal("Resolved the host name of the relay")
+	}
+}
+
+func TestReadAddrHostName(t *testing.T) {
+	b, err := encodeAddr("peer.invalid:6881")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr, err := readAddr(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, ok := addr.(*HostAddr)
+	if !ok || host.Host != "peer.invalid" || host.Port != 6881 {
+		t.Fatalf("Got %#v, want an unresolved peer.invalid:6881", addr)
+	}
+}
@@ -0,0 +1,85 @@
+package ratelimit
+
+import (
+	"context"
+	"net"
+)
+
+// chunk is the most bytes read or written at once, so that a single call doesn't use up a whole bucket
+const chunk = 16 * 1024
+
+type conn struct {
+	net.Conn
+	read   []*Limiter
+	write  []*Limiter
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// Conn wraps c so that reads wait on every limiter in read and writes on every limiter in write.
+// Blocked reads and writes return net.ErrClosed when the connection is closed.
+func Conn(c net.Conn, read, write []*Limiter) net.Conn {
+	read, write = compact(read), compact(write)
+	if len(read) == 0 && len(write) == 0 {
+		return c
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &conn{
+		Conn:   c,
+		read:   read,
+		write:  write,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	if len(b) > chunk {
+		b = b[:chunk]
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		werr := WaitAll(c.ctx, n, c.read...)
+		if err == nil && werr != nil {
+			err = net.ErrClosed
+		}
+	}
+	return n, err
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		p := b
+		if len(p) > chunk {
+			p = p[:chunk]
+		}
+		err := WaitAll(c.ctx, len(p), c.write...)
+		if err != nil {
+			return written, net.ErrClosed
+		}
+		n, err := c.Conn.Write(p)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+func (c *conn) Close() error {
+	c.cancel()
+	return c.Conn.Close()
+}
+
+//compact drops the nil limiters
+func compact(limiters []*Limiter) []*Limiter {
+	var res []*Limiter
+	for _, l := range limiters {
+		if l != nil {
+			res = append(res, l)
+		}
+	}
+	return res
+}
@@ -0,0 +1,122 @@
+//Package ratelimit throttles the traffic of connections with token buckets
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket which lets through Rate bytes per second with bursts of up to one second worth of bytes.
+// A nil *Limiter or a rate of 0 means unlimited. The rate can be changed at any time with SetRate.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   int
+	parent *Limiter
+	tokens float64
+	last   time.Time
+}
+
+// New creates a Limiter letting through rate bytes per second, 0 means unlimited
+func New(rate int) *Limiter {
+	return &Limiter{rate: rate}
+}
+
+// Derive creates a new bucket which always has the same rate as l.
+// It is used for per peer limits, where every connection gets its own bucket
+// but changing the rate of l changes it for all of them.
+func (l *Limiter) Derive() *Limiter {
+	if l == nil {
+		return nil
+	}
+	return &Limiter{parent: l}
+}
+
+// SetRate changes the rate of the limiter, 0 means unlimited
+func (l *Limiter) SetRate(rate int) {
+	if l == nil {
+		return
+	}
+	if l.parent != nil {
+		l.parent.SetRate(rate)
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+}
+
+// Rate returns the number of bytes per second let through by the limiter
+func (l *Limiter) Rate() int {
+	if l == nil {
+		return 0
+	}
+	if l.parent != nil {
+		return l.parent.Rate()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// WaitN blocks until n bytes may be sent or received, or ctx is done
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	d := l.reserve(n)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//reserve takes n tokens from the bucket and returns how long to wait until the bucket is no longer in debt
+func (l *Limiter) reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	rate := l.Rate()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if rate <= 0 {
+		l.last = now
+		l.tokens = 0
+		return 0
+	}
+	if l.last.IsZero() {
+		l.tokens = float64(rate)
+	} else {
+		l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	}
+	l.last = now
+
+	// the bucket holds at most one second worth of bytes
+	if l.tokens > float64(rate) {
+		l.tokens = float64(rate)
+	}
+
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / float64(rate) * float64(time.Second))
+}
+
+// WaitAll waits for n bytes on every limiter in turn
+func WaitAll(ctx context.Context, n int, limiters ...*Limiter) error {
+	for _, l := range limiters {
+		err := l.WaitN(ctx, n)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package ratelimit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+//near tells if d is within 50ms of want
+func near(d, want time.Duration) bool {
+	return d > want-50*time.Millisecond && d < want+50*time.Millisecond
+}
+
+func TestLimiterBurst(t *testing.T) {
+	l := New(1000)
+	if d := l.reserve(1000); d != 0 {
+		t.Fatalf("Waited %v for the first second worth of bytes", d)
+	}
+	if d := l.reserve(500); !near(d, 500*time.Millisecond) {
+		t.Fatalf("Waited %v for 500 bytes over the burst at 1000 B/s, want 500ms", d)
+	}
+
+	// an idle bucket fills up to one second worth of bytes, not more
+	l = New(1000)
+	l.reserve(1000)
+	l.last = time.Now().Add(-10 * time.Second)
+	if d := l.reserve(1000); d != 0 {
+		t.Fatalf("Waited %v after the bucket refilled", d)
+	}
+	if d := l.reserve(1000); !near(d, time.Second) {
+		t.Fatalf("Waited %v for 1000 bytes over a refilled bucket, want 1s", d)
+	}
+}
+
+func TestLimiterUnlimited(t *testing.T) {
+	var nilLimiter *Limiter
+	for _, l := range []*Limiter{nilLimiter, New(0), nilLimiter.Derive()} {
+		if d := l.reserve(1 << 30); d != 0 {
+			t.Fatalf("Unlimited limiter waited %v", d)
+		}
+		if err := l.WaitN(context.Background(), 1<<30); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLimiterSetRate(t *testing.T) {
+	l := New(1000)
+	l.reserve(1000)
+	l.SetRate(0)
+	if d := l.reserve(1 << 20); d != 0 {
+		t.Fatalf("Waited %v once the limit was lifted", d)
+	}
+	// the bucket starts empty once limited again
+	l.SetRate(2000)
+	if d := l.reserve(1000); !near(d, 500*time.Millisecond) {
+		t.Fatalf("Waited %v for 1000 bytes at 2000 B/s, want 500ms", d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.WaitN(ctx, 1000); err != context.Canceled {
+		t.Fatalf("Got %v waiting with a cancelled context, want %v", err, context.Canceled)
+	}
+}
+
+func TestLimiterDerive(t *testing.T) {
+	parent := New(1000)
+	a, b := parent.Derive(), parent.Derive()
+	if a.Rate() != 1000 {
+		t.Fatalf("Derived limiter has rate %d, want 1000", a.Rate())
+	}
+	parent.SetRate(2000)
+	if a.Rate() != 2000 || b.Rate() != 2000 {
+		t.Fatalf("Derived limiters have rates %d and %d after the parent changed to 2000", a.Rate(), b.Rate())
+	}
+	a.SetRate(4000)
+	if parent.Rate() != 4000 || b.Rate() != 4000 {
+		t.Fatalf("Setting the rate of a derived limiter gave rates %d and %d, want 4000", parent.Rate(), b.Rate())
+	}
+
+	// every derived limiter has a bucket of its own
+	a.reserve(4000)
+	if d := b.reserve(4000); d != 0 {
+		t.Fatalf("Derived limiter waited %v for the bytes of another one", d)
+	}
+	if d := parent.reserve(4000); d != 0 {
+		t.Fatalf("Parent waited %v for the bytes of a derived limiter", d)
+	}
+	if d := a.reserve(2000); !near(d, 500*time.Millisecond) {
+		t.Fatalf("Waited %v for 2000 bytes over the burst at 4000 B/s, want 500ms", d)
+	}
+}
+
+func TestReader(t *testing.T) {
+	data := make([]byte, 3*chunk)
+	l := New(2 * chunk)
+	start := time.Now()
+	got, err := ioutil.ReadAll(Reader(context.Background(), bytes.NewReader(data), nil, l))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(data) {
+		t.Fatalf("Read %d bytes, want %d", len(got), len(data))
+	}
+	// the first two chunks are the burst, the third one takes half a second
+	if d := time.Since(start); d < 400*time.Millisecond {
+		t.Fatalf("Read %d bytes at %d B/s in %v", len(data), l.Rate(), d)
+	}
+}
+
+func TestConnClosed(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	go io.Copy(ioutil.Discard, b)
+
+	c := Conn(a, nil, []*Limiter{New(chunk)})
+	if _, err := c.Write(make([]byte, chunk)); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Write(make([]byte, 10*chunk))
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Got %v from a write blocked when the connection closed, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Write still blocked after the connection closed")
+	}
+}
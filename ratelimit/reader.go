@@ -0,0 +1,36 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+)
+
+type reader struct {
+	r      io.Reader
+	ctx    context.Context
+	limits []*Limiter
+}
+
+// Reader wraps r so that reads wait on every limiter in limiters, reading at most one chunk at once.
+// Reads blocked on the limiters return the error of ctx once it is done.
+func Reader(ctx context.Context, r io.Reader, limiters ...*Limiter) io.Reader {
+	limiters = compact(limiters)
+	if len(limiters) == 0 {
+		return r
+	}
+	return &reader{r: r, ctx: ctx, limits: limiters}
+}
+
+func (r *reader) Read(b []byte) (int, error) {
+	if len(b) > chunk {
+		b = b[:chunk]
+	}
+	n, err := r.r.Read(b)
+	if n > 0 {
+		werr := WaitAll(r.ctx, n, r.limits...)
+		if err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
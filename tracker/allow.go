@@ -0,0 +1,75 @@
+package tracker
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// AllowList is a set of infohashes, safe for concurrent use
+type AllowList struct {
+	mu         sync.RWMutex
+	infoHashes map[[20]byte]bool
+}
+
+// NewAllowList creates an allow-list holding infoHashes
+func NewAllowList(infoHashes ...[20]byte) *AllowList {
+	a := &AllowList{infoHashes: make(map[[20]byte]bool)}
+	a.Add(infoHashes...)
+	return a
+}
+
+// LoadAllowList reads an allow-list from a file with one hex encoded infohash per line.
+// Blank lines and lines starting with # are skipped.
+func LoadAllowList(path string) (*AllowList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	a := NewAllowList()
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		s := strings.TrimSpace(sc.Text())
+		if s == "" || strings.HasPrefix(s, "#") {
+			continue
+		}
+		var ih [20]byte
+		b, err := hex.DecodeString(s)
+		if err != nil || len(b) != len(ih) {
+			return nil, fmt.Errorf("%s:%d: Invalid infohash %q", path, line, s)
+		}
+		copy(ih[:], b)
+		a.Add(ih)
+	}
+	return a, sc.Err()
+}
+
+// Add allows infoHashes
+func (a *AllowList) Add(infoHashes ...[20]byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, ih := range infoHashes {
+		a.infoHashes[ih] = true
+	}
+}
+
+// Remove stops allowing infoHashes
+func (a *AllowList) Remove(infoHashes ...[20]byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, ih := range infoHashes {
+		delete(a.infoHashes, ih)
+	}
+}
+
+// Contains tells if infoHash is allowed
+func (a *AllowList) Contains(infoHash [20]byte) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.infoHashes[infoHash]
+}
@@ -0,0 +1,193 @@
+package tracker
+
+import (
+	bencode "github.com/adityameharia/gotor/bencode"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type httpPeer struct {
+	ID   string `bencode:"peer id,omitempty"`
+	IP   string `bencode:"ip"`
+	Port int    `bencode:"port"`
+}
+
+type httpAnnounce struct {
+	Interval   int `bencode:"interval"`
+	Complete   int `bencode:"complete"`
+	Incomplete int `bencode:"incomplete"`
+	// Peers is a compact string of IPv4 peers or a list of httpPeer
+	Peers  interface{} `bencode:"peers"`
+	Peers6 string      `bencode:"peers6,omitempty"`
+}
+
+type httpStats struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+type httpScrape struct {
+	Files map[string]httpStats `bencode:"files"`
+}
+
+type httpFailure struct {
+	Reason string `bencode:"failure reason"`
+}
+
+// ServeHTTP answers announces on a path ending in /announce and scrapes on a path ending in /scrape
+func (t *Tracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/announce"):
+		t.serveAnnounce(w, r)
+	case strings.HasSuffix(r.URL.Path, "/scrape"):
+		t.serveScrape(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (t *Tracker) serveAnnounce(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	req := &AnnounceRequest{}
+
+	if !copyParam(req.InfoHash[:], q.Get("info_hash")) {
+		writeFailure(w, "Invalid info_hash")
+		return
+	}
+	if !copyParam(req.PeerID[:], q.Get("peer_id")) {
+		writeFailure(w, "Invalid peer_id")
+		return
+	}
+	port, err := strconv.ParseUint(q.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		writeFailure(w, "Invalid port")
+		return
+	}
+	req.Port = uint16(port)
+
+	// the address the request comes from is used rather than the ip parameter, which anyone could spoof
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		writeFailure(w, "Invalid remote address")
+		return
+	}
+	req.IP = net.ParseIP(host)
+
+	for name, v := range map[string]*int64{"uploaded": &req.Uploaded, "downloaded": &req.Downloaded, "left": &req.Left} {
+		*v, err = strconv.ParseInt(q.Get(name), 10, 64)
+		if err != nil || *v < 0 {
+			writeFailure(w, "Invalid "+name)
+			return
+		}
+	}
+
+	switch q.Get("event") {
+	case "", "empty":
+	case "started":
+		req.Event = Started
+	case "completed":
+		req.Event = Completed
+	case "stopped":
+		req.Event = Stopped
+	default:
+		writeFailure(w, "Invalid event")
+		return
+	}
+	if s := q.Get("numwant"); s != "" {
+		req.NumWant, err = strconv.Atoi(s)
+		if err != nil {
+			writeFailure(w, "Invalid numwant")
+			return
+		}
+	}
+
+	resp, err := t.Announce(req)
+	if err != nil {
+		writeFailure(w, err.Error())
+		return
+	}
+
+	res := httpAnnounce{
+		Interval:   int(resp.Interval.Seconds()),
+		Complete:   resp.Complete,
+		Incomplete: resp.Incomplete,
+	}
+	if q.Get("compact") != "0" {
+		// BEP 23 peers, IPv6 ones going in peers6 as in BEP 7
+		var peers, peers6 []byte
+		for _, p := range resp.Peers {
+			if ip4 := p.IP.To4(); ip4 != nil {
+				peers = appendPeer(peers, ip4, p.Port)
+			} else {
+				peers6 = appendPeer(peers6, p.IP.To16(), p.Port)
+			}
+		}
+		res.Peers = string(peers)
+		res.Peers6 = string(peers6)
+	} else {
+		noPeerID := q.Get("no_peer_id") == "1"
+		peers := make([]httpPeer, len(resp.Peers))
+		for i, p := range resp.Peers {
+			peers[i] = httpPeer{IP: p.IP.String(), Port: int(p.Port)}
+			if !noPeerID {
+				peers[i].ID = string(p.ID[:])
+			}
+		}
+		res.Peers = peers
+	}
+	writeBencode(w, res)
+}
+
+func (t *Tracker) serveScrape(w http.ResponseWriter, r *http.Request) {
+	var infoHashes [][20]byte
+	for _, v := range r.URL.Query()["info_hash"] {
+		var ih [20]byte
+		if !copyParam(ih[:], v) {
+			writeFailure(w, "Invalid info_hash")
+			return
+		}
+		infoHashes = append(infoHashes, ih)
+	}
+
+	res := httpScrape{Files: make(map[string]httpStats)}
+	for ih, s := range t.Scrape(infoHashes) {
+		res.Files[string(ih[:])] = httpStats{Complete: s.Complete, Downloaded: s.Downloaded, Incomplete: s.Incomplete}
+	}
+	writeBencode(w, res)
+}
+
+//copyParam copies a raw 20 byte parameter such as info_hash into dst, returning false if it has the wrong length
+func copyParam(dst []byte, v string) bool {
+	if len(v) != len(dst) {
+		return false
+	}
+	copy(dst, v)
+	return true
+}
+
+func appendPeer(b []byte, ip net.IP, port uint16) []byte {
+	b = append(b, ip...)
+	return append(b, byte(port>>8), byte(port))
+}
+
+//writeFailure answers with a failure reason, which trackers send with a 200 status for clients to read it
+func writeFailure(w http.ResponseWriter, reason string) {
+	writeBencode(w, httpFailure{Reason: reason})
+}
+
+func writeBencode(w http.ResponseWriter, v interface{}) {
+	b, err := bencode.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(b)
+}
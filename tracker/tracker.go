@@ -0,0 +1,242 @@
+//Package tracker implements a BitTorrent tracker: the HTTP announce and scrape endpoints (BEP 3, 23, 48 and 7 for IPv6)
+//and the UDP tracker protocol (BEP 15), both backed by an in-memory swarm store
+package tracker
+
+import (
+	"fmt"
+	logger "github.com/adityameharia/gotor/logger"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultInterval is the announce interval told to clients when Tracker.Interval is 0
+	DefaultInterval = 15 * time.Minute
+	// DefaultNumWant is the number of peers returned when the client does not ask for a number
+	DefaultNumWant = 50
+	// MaxNumWant is the largest number of peers returned by one announce
+	MaxNumWant = 200
+)
+
+// Event is the event of an announce, numbered as in the UDP tracker protocol
+type Event int
+
+// Events of an announce
+const (
+	None Event = iota
+	Completed
+	Started
+	Stopped
+)
+
+// ErrNotAllowed is returned when announcing or scraping a torrent which is not on the allow-list
+var ErrNotAllowed = fmt.Errorf("Torrent is not tracked here")
+
+// AnnounceRequest is what a client tells the tracker when announcing
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	IP         net.IP
+	Port       uint16
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      Event
+	// NumWant is the number of peers asked for, DefaultNumWant if 0 or less
+	NumWant int
+}
+
+// AnnounceResponse is the answer of the tracker to an announce
+type AnnounceResponse struct {
+	Interval time.Duration
+	// Complete is the number of seeders and Incomplete the number of leechers of the torrent
+	Complete   int
+	Incomplete int
+	Peers      []Peer
+}
+
+// Peer is a member of a swarm
+type Peer struct {
+	ID   [20]byte
+	IP   net.IP
+	Port uint16
+}
+
+// Stats are the scrape statistics of a torrent
+type Stats struct {
+	// Complete is the number of seeders, Incomplete the number of leechers,
+	// and Downloaded the number of times the torrent was completed
+	Complete   int
+	Downloaded int
+	Incomplete int
+}
+
+type swarmPeer struct {
+	Peer
+	seeder  bool
+	expires time.Time
+}
+
+type swarm struct {
+	peers      map[[20]byte]*swarmPeer
+	downloaded int
+}
+
+// Tracker keeps the swarms of the torrents announced to it in memory.
+// Serve it over HTTP with ServeHTTP and over UDP with ServeUDP, the two sharing the same swarms.
+type Tracker struct {
+	// Interval is the announce interval told to clients, DefaultInterval is used if 0
+	Interval time.Duration
+	// PeerTTL is how long a peer stays in a swarm after its last announce, twice the interval if 0
+	PeerTTL time.Duration
+	// AllowList, if set, holds the only torrents tracked
+	AllowList *AllowList
+	// Logger receives the log entries of the tracker, nothing is logged if it is nil
+	Logger *logger.Logger
+
+	mu     sync.Mutex
+	swarms map[[20]byte]*swarm
+	udp    *udpSecret
+}
+
+func (t *Tracker) interval() time.Duration {
+	if t.Interval <= 0 {
+		return DefaultInterval
+	}
+	return t.Interval
+}
+
+func (t *Tracker) peerTTL() time.Duration {
+	if t.PeerTTL <= 0 {
+		return 2 * t.interval()
+	}
+	return t.PeerTTL
+}
+
+// Announce records the peer announcing and returns other peers of its swarm, picked at random
+func (t *Tracker) Announce(req *AnnounceRequest) (*AnnounceResponse, error) {
+	if t.AllowList != nil && !t.AllowList.Contains(req.InfoHash) {
+		return nil, ErrNotAllowed
+	}
+	ip := req.IP
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	now := time.Now()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.swarm(req.InfoHash, now)
+
+	if req.Event == Stopped {
+		delete(s.peers, req.PeerID)
+	} else {
+		p := s.peers[req.PeerID]
+		if p == nil {
+			p = &swarmPeer{}
+			s.peers[req.PeerID] = p
+		}
+		if req.Event == Completed && !p.seeder {
+			s.downloaded++
+		}
+		p.Peer = Peer{ID: req.PeerID, IP: ip, Port: req.Port}
+		p.seeder = req.Left == 0
+		p.expires = now.Add(t.peerTTL())
+	}
+
+	resp := &AnnounceResponse{Interval: t.interval()}
+	numWant := req.NumWant
+	if numWant <= 0 {
+		numWant = DefaultNumWant
+	}
+	if numWant > MaxNumWant {
+		numWant = MaxNumWant
+	}
+	for id, p := range s.peers {
+		if p.seeder {
+			resp.Complete++
+		} else {
+			resp.Incomplete++
+		}
+		// seeders have no use for each other
+		if id == req.PeerID || (p.seeder && req.Left == 0) {
+			continue
+		}
+		resp.Peers = append(resp.Peers, p.Peer)
+	}
+	rand.Shuffle(len(resp.Peers), func(i, j int) {
+		resp.Peers[i], resp.Peers[j] = resp.Peers[j], resp.Peers[i]
+	})
+	if len(resp.Peers) > numWant {
+		resp.Peers = resp.Peers[:numWant]
+	}
+
+	t.Logger.Debugf("Announce of %x by %s:%d, %d seeders and %d leechers", req.InfoHash, ip, req.Port, resp.Complete, resp.Incomplete)
+	return resp, nil
+}
+
+// Scrape returns the statistics of the torrents, leaving out those which are not allowed
+func (t *Tracker) Scrape(infoHashes [][20]byte) map[[20]byte]Stats {
+	now := time.Now()
+	res := make(map[[20]byte]Stats, len(infoHashes))
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, ih := range infoHashes {
+		if t.AllowList != nil && !t.AllowList.Contains(ih) {
+			continue
+		}
+		var stats Stats
+		if s := t.swarms[ih]; s != nil {
+			t.expire(s, now)
+			stats.Downloaded = s.downloaded
+			for _, p := range s.peers {
+				if p.seeder {
+					stats.Complete++
+				} else {
+					stats.Incomplete++
+				}
+			}
+		}
+		res[ih] = stats
+	}
+	return res
+}
+
+// Prune drops the peers which stopped announcing from every swarm.
+// Swarms are also pruned when announced to, Prune frees the memory of those nobody announces to anymore.
+func (t *Tracker) Prune() {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for ih, s := range t.swarms {
+		t.expire(s, now)
+		if len(s.peers) == 0 && s.downloaded == 0 {
+			delete(t.swarms, ih)
+		}
+	}
+}
+
+//swarm returns the swarm of infoHash without its expired peers, creating it if needed. t.mu must be held.
+func (t *Tracker) swarm(infoHash [20]byte, now time.Time) *swarm {
+	if t.swarms == nil {
+		t.swarms = make(map[[20]byte]*swarm)
+	}
+	s := t.swarms[infoHash]
+	if s == nil {
+		s = &swarm{peers: make(map[[20]byte]*swarmPeer)}
+		t.swarms[infoHash] = s
+	}
+	t.expire(s, now)
+	return s
+}
+
+func (t *Tracker) expire(s *swarm, now time.Time) {
+	for id, p := range s.peers {
+		if now.After(p.expires) {
+			delete(s.peers, id)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package tracker
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15)
+const (
+	udpProtocolID = 0x41727101980
+
+	actionConnect  = 0
+	actionAnnounce = 1
+	actionScrape   = 2
+	actionError    = 3
+
+	// connectionIDLifetime is how long a connection ID is accepted at least after being handed out, and at most twice as long
+	connectionIDLifetime = 2 * time.Minute
+	// maxScrape is the number of torrents scraped in one request, keeping the answer in one datagram
+	maxScrape = 74
+)
+
+//udpSecret signs the connection IDs, so that they can be checked without remembering them
+type udpSecret struct {
+	key []byte
+}
+
+//connectionID derives the ID given to addr during the window epoch
+func (s *udpSecret) connectionID(addr *net.UDPAddr, epoch int64) uint64 {
+	mac := hmac.New(sha256.New, s.key)
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(epoch))
+	mac.Write(b[:])
+	mac.Write(addr.IP.To16())
+	binary.BigEndian.PutUint16(b[:2], uint16(addr.Port))
+	mac.Write(b[:2])
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+//epoch numbers the windows of connectionIDLifetime connection IDs are derived for.
+//The ID of the previous window is accepted too, so that an ID handed out at the end of a window lasts a whole lifetime.
+func epoch(now time.Time) int64 {
+	return now.Unix() / int64(connectionIDLifetime/time.Second)
+}
+
+func (s *udpSecret) valid(addr *net.UDPAddr, id uint64, now time.Time) bool {
+	e := epoch(now)
+	return id == s.connectionID(addr, e) || id == s.connectionID(addr, e-1)
+}
+
+// ServeUDP answers the UDP tracker protocol on pc until it is closed, returning the error which stopped it
+func (t *Tracker) ServeUDP(pc net.PacketConn) error {
+	t.mu.Lock()
+	if t.udp == nil {
+		key := make([]byte, 32)
+		_, err := rand.Read(key)
+		if err != nil {
+			t.mu.Unlock()
+			return err
+		}
+		t.udp = &udpSecret{key: key}
+	}
+	secret := t.udp
+	t.mu.Unlock()
+
+	buf := make([]byte, 2048)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		from, ok := addr.(*net.UDPAddr)
+		if !ok || n < 16 {
+			continue
+		}
+		resp := t.handleUDP(secret, buf[:n], from)
+		if resp != nil {
+			pc.WriteTo(resp, addr)
+		}
+	}
+}
+
+//handleUDP returns the answer to the packet, nil if it deserves none
+func (t *Tracker) handleUDP(secret *udpSecret, pkt []byte, from *net.UDPAddr) []byte {
+	connID := binary.BigEndian.Uint64(pkt[0:8])
+	action := binary.BigEndian.Uint32(pkt[8:12])
+	tid := pkt[12:16]
+	now := time.Now()
+
+	if action == actionConnect {
+		if connID != udpProtocolID {
+			return nil
+		}
+		resp := udpHeader(actionConnect, tid)
+		return appendUint64(resp, secret.connectionID(from, epoch(now)))
+	}
+	if !secret.valid(from, connID, now) {
+		return udpError(tid, "Invalid connection ID")
+	}
+
+	switch action {
+	case actionAnnounce:
+		return t.udpAnnounce(pkt, tid, from)
+	case actionScrape:
+		return t.udpScrape(pkt, tid)
+	default:
+		return udpError(tid, "Unknown action")
+	}
+}
+
+func (t *Tracker) udpAnnounce(pkt []byte, tid []byte, from *net.UDPAddr) []byte {
+	if len(pkt) < 98 {
+		return udpError(tid, "Announce too short")
+	}
+	req := &AnnounceRequest{
+		IP:         from.IP,
+		Downloaded: int64(binary.BigEndian.Uint64(pkt[56:64])),
+		Left:       int64(binary.BigEndian.Uint64(pkt[64:72])),
+		Uploaded:   int64(binary.BigEndian.Uint64(pkt[72:80])),
+		Event:      Event(binary.BigEndian.Uint32(pkt[80:84])),
+		// the ip field at 84 is ignored like the ip parameter of HTTP announces, and key at 88 is not used
+		NumWant: int(int32(binary.BigEndian.Uint32(pkt[92:96]))),
+		Port:    binary.BigEndian.Uint16(pkt[96:98]),
+	}
+	copy(req.InfoHash[:], pkt[16:36])
+	copy(req.PeerID[:], pkt[36:56])
+	if req.Event < None || req.Event > Stopped {
+		return udpError(tid, "Invalid event")
+	}
+
+	resp, err := t.Announce(req)
+	if err != nil {
+		return udpError(tid, err.Error())
+	}
+
+	res := udpHeader(actionAnnounce, tid)
+	res = appendUint32(res, uint32(resp.Interval.Seconds()))
+	res = appendUint32(res, uint32(resp.Incomplete))
+	res = appendUint32(res, uint32(resp.Complete))
+	// the peers are of the address family of the socket the announce came over
+	ipv4 := from.IP.To4() != nil
+	for _, p := range resp.Peers {
+		ip4 := p.IP.To4()
+		if ipv4 && ip4 != nil {
+			res = appendPeer(res, ip4, p.Port)
+		} else if !ipv4 && ip4 == nil {
+			res = appendPeer(res, p.IP.To16(), p.Port)
+		}
+	}
+	return res
+}
+
+func (t *Tracker) udpScrape(pkt []byte, tid []byte) []byte {
+	var infoHashes [][20]byte
+	for b := pkt[16:]; len(b) >= 20 && len(infoHashes) < maxScrape; b = b[20:] {
+		var ih [20]byte
+		copy(ih[:], b)
+		infoHashes = append(infoHashes, ih)
+	}
+
+	stats := t.Scrape(infoHashes)
+	res := udpHeader(actionScrape, tid)
+	for _, ih := range infoHashes {
+		// torrents which are not allowed are answered with zeros, as the answer has to follow the order of the request
+		s := stats[ih]
+		res = appendUint32(res, uint32(s.Complete))
+		res = appendUint32(res, uint32(s.Downloaded))
+		res = appendUint32(res, uint32(s.Incomplete))
+	}
+	return res
+}
+
+func udpHeader(action uint32, tid []byte) []byte {
+	b := appendUint32(make([]byte, 0, 20), action)
+	return append(b, tid...)
+}
+
+func udpError(tid []byte, msg string) []byte {
+	return append(udpHeader(actionError, tid), msg...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
@@ -0,0 +1,162 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnectionIDLifetime(t *testing.T) {
+	s := &udpSecret{key: []byte("key")}
+	addr := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6881}
+	other := &net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 6882}
+
+	// handed out at the start, in the middle and at the very end of a window
+	start := time.Unix(10*int64(connectionIDLifetime/time.Second), 0)
+	for _, at := range []time.Time{start, start.Add(connectionIDLifetime / 2), start.Add(connectionIDLifetime - time.Second)} {
+		id := s.connectionID(addr, epoch(at))
+		if !s.valid(addr, id, at.Add(connectionIDLifetime)) {
+			t.Errorf("ID handed out at %v refused before its lifetime passed", at.Sub(start))
+		}
+		if s.valid(addr, id, at.Add(2*connectionIDLifetime)) {
+			t.Errorf("ID handed out at %v accepted after twice its lifetime", at.Sub(start))
+		}
+		if s.valid(other, id, at) {
+			t.Errorf("ID accepted from another address")
+		}
+	}
+}
+
+//udpClient sends packets to a tracker served over the loopback interface
+type udpClient struct {
+	t    *testing.T
+	conn net.Conn
+	tid  uint32
+}
+
+//request sends the packet for action and returns the answer, with its header checked and removed
+func (c *udpClient) request(connID uint64, action uint32, body []byte) []byte {
+	c.tid++
+	pkt := appendUint64(nil, connID)
+	pkt = appendUint32(pkt, action)
+	pkt = appendUint32(pkt, c.tid)
+	pkt = append(pkt, body...)
+	if _, err := c.conn.Write(pkt); err != nil {
+		c.t.Fatal(err)
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, err := c.conn.Read(buf)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if n < 8 {
+		c.t.Fatalf("Got %d bytes, want a header", n)
+	}
+	if got := binary.BigEndian.Uint32(buf[4:8]); got != c.tid {
+		c.t.Fatalf("Got transaction ID %d, want %d", got, c.tid)
+	}
+	if got := binary.BigEndian.Uint32(buf[0:4]); got != action {
+		c.t.Fatalf("Got action %d (%q), want %d", got, buf[8:n], action)
+	}
+	return buf[8:n]
+}
+
+func (c *udpClient) announce(connID uint64, infoHash [20]byte, id byte, port uint16, left int64, event Event) []byte {
+	body := append([]byte(nil), infoHash[:]...)
+	var pid [20]byte
+	pid[19] = id
+	body = append(body, pid[:]...)
+	body = appendUint64(body, 0)
+	body = appendUint64(body, uint64(left))
+	body = appendUint64(body, 0)
+	body = appendUint32(body, uint32(event))
+	body = appendUint32(body, 0)
+	body = appendUint32(body, 0)
+	body = appendUint32(body, 50)
+	body = append(body, byte(port>>8), byte(port))
+	return c.request(connID, actionAnnounce, body)
+}
+
+func TestUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := &Tracker{Interval: 30 * time.Minute}
+	served := make(chan error, 1)
+	go func() {
+		served <- tr.ServeUDP(pc)
+	}()
+	defer func() {
+		pc.Close()
+		<-served
+	}()
+
+	conn, err := net.Dial("udp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &udpClient{t: t, conn: conn}
+
+	// announcing before connecting is refused
+	c.tid++
+	pkt := appendUint64(nil, 1234)
+	pkt = appendUint32(pkt, actionAnnounce)
+	pkt = appendUint32(pkt, c.tid)
+	pkt = append(pkt, make([]byte, 82)...)
+	conn.Write(pkt)
+	buf := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if binary.BigEndian.Uint32(buf[0:4]) != actionError {
+		t.Fatalf("Announce with an invalid connection ID got action %d, want an error", binary.BigEndian.Uint32(buf[0:4]))
+	}
+	if string(buf[8:n]) != "Invalid connection ID" {
+		t.Errorf("Got error %q", buf[8:n])
+	}
+
+	res := c.request(udpProtocolID, actionConnect, nil)
+	if len(res) != 8 {
+		t.Fatalf("Got a connect answer of %d bytes, want 8", len(res))
+	}
+	connID := binary.BigEndian.Uint64(res)
+
+	infoHash := [20]byte{1, 2, 3}
+	res = c.announce(connID, infoHash, 1, 6881, 0, Started)
+	if len(res) != 12 {
+		t.Fatalf("Got an announce answer of %d bytes, want 12 for no peers", len(res))
+	}
+	if interval := binary.BigEndian.Uint32(res[0:4]); interval != 30*60 {
+		t.Errorf("Got interval %d, want %d", interval, 30*60)
+	}
+
+	res = c.announce(connID, infoHash, 2, 6882, 100, Started)
+	if len(res) != 18 {
+		t.Fatalf("Got an announce answer of %d bytes, want 18 for one peer", len(res))
+	}
+	if leechers, seeders := binary.BigEndian.Uint32(res[4:8]), binary.BigEndian.Uint32(res[8:12]); leechers != 1 || seeders != 1 {
+		t.Errorf("Got %d leechers and %d seeders, want 1 and 1", leechers, seeders)
+	}
+	if ip, port := net.IP(res[12:16]), binary.BigEndian.Uint16(res[16:18]); !ip.Equal(net.IPv4(127, 0, 0, 1)) || port != 6881 {
+		t.Errorf("Got peer %v:%d, want 127.0.0.1:6881", ip, port)
+	}
+
+	other := [20]byte{4, 5, 6}
+	res = c.request(connID, actionScrape, append(infoHash[:], other[:]...))
+	want := []uint32{1, 0, 1, 0, 0, 0}
+	if len(res) != 4*len(want) {
+		t.Fatalf("Got a scrape answer of %d bytes, want %d", len(res), 4*len(want))
+	}
+	for i, w := range want {
+		if got := binary.BigEndian.Uint32(res[4*i:]); got != w {
+			t.Errorf("Got %d for scrape field %d, want %d", got, i, w)
+		}
+	}
+}
@@ -0,0 +1,584 @@
+package utp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// recvWindow is how many bytes we buffer for the reader before the peer has to stop sending
+	recvWindow = 1024 * 1024
+
+	initialTimeout = time.Second
+	minTimeout     = 500 * time.Millisecond
+	maxTimeout     = 8 * time.Second
+	// maxRetries is how many retransmission timeouts in a row kill the connection
+	maxRetries = 6
+)
+
+// connection states
+const (
+	stateSynSent = iota
+	stateConnected
+	stateClosed
+)
+
+// ErrConnReset is returned once the peer reset the connection
+var ErrConnReset = errors.New("uTP connection reset by peer")
+
+var errClosed = errors.New("use of closed uTP connection")
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "uTP i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+//outPacket is a packet we sent which was not acknowledged yet
+type outPacket struct {
+	typ           byte
+	seq           uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	sacked        bool
+}
+
+//inPacket is a packet received out of order, waiting for the gap before it to be filled
+type inPacket struct {
+	payload []byte
+	fin     bool
+}
+
+// Conn is a uTP connection, a reliable ordered byte stream over UDP using LEDBAT congestion control
+type Conn struct {
+	s      *Socket
+	remote net.Addr
+	recvID uint16
+	sendID uint16
+
+	mu sync.Mutex
+	// notify is closed and replaced on every change of state, waking up blocked readers and writers
+	notify chan struct{}
+	state  int
+	err    error
+	closed bool
+
+	// sending side
+	seq      uint16
+	inflight []*outPacket
+	flight   int
+	lastAck  uint16
+	dupAcks  int
+	lastCut  time.Time
+	peerWnd  uint32
+	cc       *ledbat
+	rtt      time.Duration
+	rttVar   time.Duration
+	rto      time.Duration
+	retries  int
+	timer    *time.Timer
+	replyDif uint32
+
+	// receiving side
+	ack      uint16
+	ooo      map[uint16]inPacket
+	oooBytes int
+	buf      bytes.Buffer
+	eof      bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+}
+
+func newConn(s *Socket, remote net.Addr, recvID, sendID uint16) *Conn {
+	return &Conn{
+		s:       s,
+		remote:  remote,
+		recvID:  recvID,
+		sendID:  sendID,
+		notify:  make(chan struct{}),
+		peerWnd: recvWindow,
+		cc:      newLedbat(),
+		rto:     initialTimeout,
+		ooo:     make(map[uint16]inPacket),
+	}
+}
+
+//changed wakes up everyone waiting on the connection, c.mu must be held
+func (c *Conn) changed() {
+	close(c.notify)
+	c.notify = make(chan struct{})
+}
+
+//wait releases c.mu until the state changes or the deadline passes, c.mu must be held
+func (c *Conn) wait(deadline time.Time) error {
+	ch := c.notify
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return timeoutError{}
+		}
+		t := time.NewTimer(d)
+		defer t.Stop()
+		timeout = t.C
+	}
+	c.mu.Unlock()
+	select {
+	case <-ch:
+	case <-timeout:
+	}
+	c.mu.Lock()
+	if !deadline.IsZero() && !time.Now().Before(deadline) {
+		return timeoutError{}
+	}
+	return nil
+}
+
+//window returns how many bytes may be in flight
+func (c *Conn) window() int {
+	w := int(c.cc.window)
+	if int(c.peerWnd) < w {
+		w = int(c.peerWnd)
+	}
+	return w
+}
+
+//advertised returns the receive window to put in our packets
+func (c *Conn) advertised() uint32 {
+	used := c.buf.Len() + c.oooBytes
+	if used >= recvWindow {
+		return 0
+	}
+	return uint32(recvWindow - used)
+}
+
+//sendPacket writes a packet to the socket, c.mu must be held
+func (c *Conn) sendPacket(typ byte, seq uint16, payload []byte) {
+	h := header{
+		typ:           typ,
+		connID:        c.sendID,
+		timestamp:     timestamp(time.Now()),
+		timestampDiff: c.replyDif,
+		wnd:           c.advertised(),
+		seq:           seq,
+		ack:           c.ack,
+		sack:          c.sackMask(),
+	}
+	if typ == stSyn {
+		h.connID = c.recvID
+	}
+	c.s.pc.WriteTo(h.marshal(payload), c.remote)
+}
+
+//sackMask returns the selective ack of the packets received out of order, c.mu must be held
+func (c *Conn) sackMask() []byte {
+	if len(c.ooo) == 0 {
+		return nil
+	}
+	var mask []byte
+	for seq := range c.ooo {
+		off := int(seq - c.ack - 2)
+		if off < 0 || off >= maxSack*8 {
+			continue
+		}
+		for len(mask) <= off/8 {
+			// the bitmask length is a multiple of 4 bytes
+			mask = append(mask, 0, 0, 0, 0)
+		}
+		mask[off/8] |= 1 << uint(off%8)
+	}
+	return mask
+}
+
+//sendState acknowledges everything received in order so far, c.mu must be held
+func (c *Conn) sendState() {
+	c.sendPacket(stState, c.seq, nil)
+}
+
+//queue sends a packet which has to be acknowledged, retransmitting it until it is, c.mu must be held
+func (c *Conn) queue(typ byte, payload []byte) {
+	p := &outPacket{typ: typ, seq: c.seq, payload: payload}
+	c.seq++
+	c.inflight = append(c.inflight, p)
+	c.flight += len(payload)
+	c.transmit(p)
+	if len(c.inflight) == 1 {
+		c.armTimer()
+	}
+}
+
+func (c *Conn) transmit(p *outPacket) {
+	p.sentAt = time.Now()
+	p.transmissions++
+	c.sendPacket(p.typ, p.seq, p.payload)
+}
+
+func (c *Conn) armTimer() {
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.rto, c.onTimeout)
+		return
+	}
+	c.timer.Reset(c.rto)
+}
+
+//onTimeout retransmits the oldest packet in flight and shrinks the window to a single packet
+func (c *Conn) onTimeout() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed || len(c.inflight) == 0 {
+		return
+	}
+	c.retries++
+	if c.retries > maxRetries {
+		c.fail(timeoutError{})
+		return
+	}
+	c.cc.onTimeout()
+	c.rto *= 2
+	if c.rto > maxTimeout {
+		c.rto = maxTimeout
+	}
+	c.transmit(c.inflight[0])
+	c.armTimer()
+	c.changed()
+}
+
+//handle processes a packet received for this connection
+func (c *Conn) handle(h header, payload []byte, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.state == stateClosed {
+		return
+	}
+	if h.typ == stReset {
+		c.fail(ErrConnReset)
+		return
+	}
+
+	c.replyDif = timestamp(now) - h.timestamp
+	c.peerWnd = h.wnd
+
+	if c.state == stateSynSent {
+		if h.typ != stState {
+			return
+		}
+		c.state = stateConnected
+		c.ack = h.seq - 1
+		c.lastAck = h.ack
+	}
+
+	c.processAck(h, now)
+
+	switch h.typ {
+	case stData, stFin:
+		c.receive(h.seq, payload, h.typ == stFin)
+		c.sendState()
+	}
+	c.changed()
+	c.maybeRelease()
+}
+
+//processAck drops the packets acknowledged by h, retransmits the ones reported lost and adjusts the window, c.mu must be held
+func (c *Conn) processAck(h header, now time.Time) {
+	acked, popped := 0, 0
+	for len(c.inflight) > 0 && !seqLess(h.ack, c.inflight[0].seq) {
+		p := c.inflight[0]
+		c.inflight = c.inflight[1:]
+		popped++
+		if !p.sacked {
+			c.flight -= len(p.payload)
+			acked += len(p.payload)
+		}
+		// Karn's algorithm, retransmitted packets tell nothing about the round trip
+		if p.transmissions == 1 {
+			c.updateRTT(now.Sub(p.sentAt))
+		}
+	}
+	acked += c.processSack(h)
+
+	if acked > 0 {
+		c.cc.onAck(acked, h.timestampDiff, c.flight, now)
+	}
+	if popped > 0 {
+		c.dupAcks = 0
+		c.retries = 0
+		if len(c.inflight) > 0 {
+			c.armTimer()
+		} else if c.timer != nil {
+			c.timer.Stop()
+		}
+	} else if h.typ == stState && h.ack == c.lastAck && len(c.inflight) > 0 {
+		c.dupAcks++
+		if c.dupAcks == 3 && h.sack == nil {
+			c.lost(c.inflight[0], now)
+		}
+	}
+	c.lastAck = h.ack
+	c.resendLost(now)
+}
+
+//processSack marks the packets in the selective ack of h and returns how many bytes they add up to, c.mu must be held
+func (c *Conn) processSack(h header) int {
+	if len(h.sack) == 0 || len(c.inflight) == 0 {
+		return 0
+	}
+	acked := 0
+	first := c.inflight[0].seq
+	for i := 0; i < len(h.sack)*8; i++ {
+		if h.sack[i/8]&(1<<uint(i%8)) == 0 {
+			continue
+		}
+		idx := int(h.ack + 2 + uint16(i) - first)
+		if idx < 0 || idx >= len(c.inflight) {
+			continue
+		}
+		p := c.inflight[idx]
+		if !p.sacked {
+			p.sacked = true
+			c.flight -= len(p.payload)
+			acked += len(p.payload)
+		}
+	}
+	return acked
+}
+
+//resendLost retransmits the packets which were passed by at least 3 selectively acked ones, or by
+//a single one if they are late by more than a quarter of the round trip, which spares a timeout when
+//only a few packets are in flight. Each packet is resent at most once per round trip, c.mu must be held.
+func (c *Conn) resendLost(now time.Time) {
+	after := 0
+	for i := len(c.inflight) - 1; i >= 0; i-- {
+		p := c.inflight[i]
+		if p.sacked {
+			after++
+			continue
+		}
+		age := now.Sub(p.sentAt)
+		if after >= 3 && age > c.rtt || after > 0 && age > c.rtt+c.rtt/4 {
+			c.lost(p, now)
+		}
+	}
+}
+
+//lost retransmits p and halves the window, once per round trip, c.mu must be held
+func (c *Conn) lost(p *outPacket, now time.Time) {
+	if now.Sub(c.lastCut) > c.rtt {
+		c.cc.onLoss()
+		c.lastCut = now
+	}
+	c.transmit(p)
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minTimeout {
+		c.rto = minTimeout
+	}
+	if c.rto > maxTimeout {
+		c.rto = maxTimeout
+	}
+}
+
+//receive stores an incoming data or fin packet, delivering whatever became contiguous, c.mu must be held
+func (c *Conn) receive(seq uint16, payload []byte, fin bool) {
+	if c.eof || !seqLess(c.ack, seq) {
+		return // duplicate
+	}
+	if seq != c.ack+1 {
+		// out of order, keep it unless it is way ahead of the window
+		if _, ok := c.ooo[seq]; !ok && int(seq-c.ack) < recvWindow/maxPayload*2 {
+			c.ooo[seq] = inPacket{payload: append([]byte(nil), payload...), fin: fin}
+			c.oooBytes += len(payload)
+		}
+		return
+	}
+
+	c.deliver(payload, fin)
+	for {
+		p, ok := c.ooo[c.ack+1]
+		if !ok {
+			break
+		}
+		delete(c.ooo, c.ack+1)
+		c.oooBytes -= len(p.payload)
+		c.deliver(p.payload, p.fin)
+	}
+}
+
+func (c *Conn) deliver(payload []byte, fin bool) {
+	c.ack++
+	c.buf.Write(payload)
+	if fin {
+		c.eof = true
+	}
+}
+
+//fail ends the connection with err, c.mu must be held
+func (c *Conn) fail(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.release()
+}
+
+//refuse resets an incoming connection which is not accepted
+func (c *Conn) refuse() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.sendPacket(stReset, c.seq, nil)
+	c.release()
+}
+
+//release forgets the connection once nothing will be read or sent anymore, c.mu must be held
+func (c *Conn) release() {
+	if c.state == stateClosed {
+		return
+	}
+	c.state = stateClosed
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.s.remove(c)
+	c.changed()
+}
+
+//maybeRelease releases a closed connection once everything it sent was acknowledged, c.mu must be held
+func (c *Conn) maybeRelease() {
+	if c.closed && len(c.inflight) == 0 {
+		c.release()
+	}
+}
+
+// Read reads data in order, returning io.EOF once the peer closed the connection
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if c.closed {
+			return 0, errClosed
+		}
+		if c.buf.Len() > 0 {
+			wasFull := c.advertised() < maxPayload
+			n, _ := c.buf.Read(b)
+			// let the peer know it can send again
+			if wasFull && c.state == stateConnected {
+				c.sendState()
+			}
+			return n, nil
+		}
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.err != nil {
+			return 0, c.err
+		}
+		err := c.wait(c.readDeadline)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends b, blocking while the congestion or receive window is full
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for n < len(b) {
+		if c.closed {
+			return n, errClosed
+		}
+		if c.err != nil {
+			return n, c.err
+		}
+		size := len(b) - n
+		if size > maxPayload {
+			size = maxPayload
+		}
+		// always allow a single packet so a zero window gets probed
+		if c.state != stateConnected || (c.flight > 0 && c.flight+size > c.window()) {
+			err := c.wait(c.writeDeadline)
+			if err != nil {
+				return n, err
+			}
+			continue
+		}
+		c.queue(stData, append([]byte(nil), b[n:n+size]...))
+		n += size
+	}
+	return n, nil
+}
+
+// Close sends a FIN to the peer. Data already written keeps being retransmitted until it is acknowledged.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errClosed
+	}
+	c.closed = true
+	if c.state == stateConnected {
+		c.queue(stFin, nil)
+	}
+	if c.state == stateSynSent {
+		c.release()
+	}
+	c.maybeRelease()
+	c.changed()
+	return nil
+}
+
+// LocalAddr returns the address of the socket
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.pc.LocalAddr()
+}
+
+// RemoteAddr returns the address of the peer
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline sets the read and write deadlines
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.changed()
+	return nil
+}
+
+// SetReadDeadline sets the deadline for Read
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.changed()
+	return nil
+}
+
+// SetWriteDeadline sets the deadline for Write
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.changed()
+	return nil
+}
@@ -0,0 +1,220 @@
+package utp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//lossyConn drops, delays and reorders the packets written to it.
+//Each packet is delayed at random by up to delay, so that the later ones may overtake it.
+type lossyConn struct {
+	net.PacketConn
+	loss  float64
+	delay time.Duration
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+	// drop, if set, tells whether to drop a packet regardless of loss
+	drop func(h header, payload []byte) bool
+	// sent records the time every packet was written by its type and sequence number
+	sent map[[2]int][]time.Time
+	// sacks counts the packets carrying a selective ack
+	sacks int
+}
+
+func newLossyConn(t *testing.T, loss float64, delay time.Duration, seed int64) *lossyConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &lossyConn{PacketConn: pc, loss: loss, delay: delay, rnd: rand.New(rand.NewSource(seed)), sent: make(map[[2]int][]time.Time)}
+}
+
+func (l *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	h, payload, err := unmarshal(b)
+	if err != nil {
+		return 0, err
+	}
+	l.mu.Lock()
+	key := [2]int{int(h.typ), int(h.seq)}
+	l.sent[key] = append(l.sent[key], time.Now())
+	if h.sack != nil {
+		l.sacks++
+	}
+	drop := l.rnd.Float64() < l.loss || (l.drop != nil && l.drop(h, payload))
+	delay := time.Duration(l.rnd.Int63n(int64(l.delay) + 1))
+	l.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	if delay == 0 {
+		return l.PacketConn.WriteTo(b, addr)
+	}
+	pkt := append([]byte(nil), b...)
+	time.AfterFunc(delay, func() {
+		l.PacketConn.WriteTo(pkt, addr)
+	})
+	return len(b), nil
+}
+
+//sends returns the times a packet of type typ with sequence number seq was written
+func (l *lossyConn) sends(typ byte, seq uint16) []time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sent[[2]int{int(typ), int(seq)}]
+}
+
+//sacked tells if any of the packets written carried a selective ack
+func (l *lossyConn) sacked() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.sacks > 0
+}
+
+//transfer sends data from a socket over sender to a socket over receiver, and returns what was received
+func transfer(t *testing.T, sender, receiver *lossyConn, data []byte) []byte {
+	a := NewSocket(sender)
+	defer a.Close()
+	b := NewSocket(receiver)
+	defer b.Close()
+	l, err := b.Listener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Error(err)
+			received <- nil
+			return
+		}
+		defer c.Close()
+		c.SetReadDeadline(time.Now().Add(30 * time.Second))
+		got, err := ioutil.ReadAll(c)
+		if err != nil {
+			t.Error(err)
+		}
+		received <- got
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	c, err := a.Dial(ctx, b.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	_, err = c.Write(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	return <-received
+}
+
+func TestConnLossy(t *testing.T) {
+	data := make([]byte, 512*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+	sender := newLossyConn(t, 0.05, 20*time.Millisecond, 2)
+	receiver := newLossyConn(t, 0.05, 20*time.Millisecond, 3)
+
+	got := transfer(t, sender, receiver, data)
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Received %d bytes which differ from the %d sent", len(got), len(data))
+	}
+	if !receiver.sacked() {
+		t.Error("Packets received out of order were never selectively acked")
+	}
+}
+
+func TestConnFastRetransmit(t *testing.T) {
+	data := make([]byte, 32*maxPayload)
+	rand.New(rand.NewSource(4)).Read(data)
+	sender := newLossyConn(t, 0, 0, 5)
+	receiver := newLossyConn(t, 0, 0, 6)
+
+	// drop the first transmission of the third data packet
+	var first uint16
+	dataPackets := 0
+	sender.drop = func(h header, payload []byte) bool {
+		if h.typ != stData {
+			return false
+		}
+		dataPackets++
+		if dataPackets == 1 {
+			first = h.seq
+		}
+		return dataPackets == 3
+	}
+
+	got := transfer(t, sender, receiver, data)
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Received %d bytes which differ from the %d sent", len(got), len(data))
+	}
+	sends := sender.sends(stData, first+2)
+	if len(sends) < 2 {
+		t.Fatalf("Dropped packet was sent %d times", len(sends))
+	}
+	// a retransmission timeout would take at least minTimeout
+	if d := sends[1].Sub(sends[0]); d >= minTimeout {
+		t.Errorf("Dropped packet was resent after %v, not fast retransmitted", d)
+	}
+	if !receiver.sacked() {
+		t.Error("Packets after the dropped one were not selectively acked")
+	}
+}
+
+func TestSocketRefusesWithoutListener(t *testing.T) {
+	a := NewSocket(newLossyConn(t, 0, 0, 7))
+	defer a.Close()
+	b := NewSocket(newLossyConn(t, 0, 0, 8))
+	defer b.Close()
+
+	dial := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		c, err := a.Dial(ctx, b.Addr().String())
+		if err == nil {
+			c.Close()
+		}
+		return err
+	}
+	if err := dial(); err != ErrConnReset {
+		t.Fatalf("Got %v dialing a socket which doesn't listen, want %v", err, ErrConnReset)
+	}
+
+	l, err := b.Listener()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Listener(); err != ErrListening {
+		t.Fatalf("Got %v opening a second listener, want %v", err, ErrListening)
+	}
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			io.Copy(ioutil.Discard, c)
+		}
+	}()
+	if err := dial(); err != nil {
+		t.Fatal(err)
+	}
+
+	l.Close()
+	if _, err := l.Accept(); err != ErrListenerClosed {
+		t.Fatalf("Got %v accepting on a closed listener, want %v", err, ErrListenerClosed)
+	}
+	if err := dial(); err != ErrConnReset {
+		t.Fatalf("Got %v dialing a socket which stopped listening, want %v", err, ErrConnReset)
+	}
+}
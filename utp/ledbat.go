@@ -0,0 +1,96 @@
+package utp
+
+import (
+	"time"
+)
+
+// LEDBAT congestion control parameters, see BEP 29 and RFC 6817
+const (
+	// targetDelay is the queuing delay in microseconds LEDBAT aims for
+	targetDelay = 100000
+	// maxWindowIncrease is the most the window grows per round trip, in bytes
+	maxWindowIncrease = 3000
+	minWindow         = maxPayload
+	initialWindow     = 4 * maxPayload
+	maxWindow         = 4 * 1024 * 1024
+
+	// the base delay is the lowest delay seen over the last two baseDelayInterval
+	baseDelayInterval = time.Minute
+)
+
+//ledbat is a delay based congestion controller: it grows the window while the one way delay
+//of our packets stays close to the lowest seen, and backs off as soon as queues build up
+type ledbat struct {
+	window float64
+
+	// lowest delay samples of the current and the previous interval
+	base        [2]uint32
+	baseValid   [2]bool
+	baseStarted time.Time
+}
+
+func newLedbat() *ledbat {
+	return &ledbat{window: initialWindow}
+}
+
+//onAck updates the window after bytesAcked bytes were acknowledged.
+//delay is the one way delay of our packets measured by the peer, in microseconds, 0 if unknown.
+//flight is the number of bytes still in flight.
+func (l *ledbat) onAck(bytesAcked int, delay uint32, flight int, now time.Time) {
+	if delay == 0 {
+		return
+	}
+	base := l.updateBase(delay, now)
+	ourDelay := float64(delay - base)
+
+	offTarget := (targetDelay - ourDelay) / targetDelay
+	windowFactor := float64(bytesAcked) / l.window
+	if windowFactor > 1 {
+		windowFactor = 1
+	}
+	gain := maxWindowIncrease * offTarget * windowFactor
+
+	// don't grow a window which isn't being used
+	if gain > 0 && float64(flight+bytesAcked) < l.window/2 {
+		return
+	}
+	l.window += gain
+	l.clamp()
+}
+
+//onLoss halves the window after a packet was lost and recovered by fast retransmit
+func (l *ledbat) onLoss() {
+	l.window /= 2
+	l.clamp()
+}
+
+//onTimeout shrinks the window to a single packet after a retransmission timeout
+func (l *ledbat) onTimeout() {
+	l.window = minWindow
+}
+
+func (l *ledbat) clamp() {
+	if l.window < minWindow {
+		l.window = minWindow
+	}
+	if l.window > maxWindow {
+		l.window = maxWindow
+	}
+}
+
+//updateBase records a delay sample and returns the base delay
+func (l *ledbat) updateBase(delay uint32, now time.Time) uint32 {
+	if l.baseStarted.IsZero() || now.Sub(l.baseStarted) > baseDelayInterval {
+		l.base[1], l.baseValid[1] = l.base[0], l.baseValid[0]
+		l.baseValid[0] = false
+		l.baseStarted = now
+	}
+	if !l.baseValid[0] || delay < l.base[0] {
+		l.base[0], l.baseValid[0] = delay, true
+	}
+	base := l.base[0]
+	if l.baseValid[1] && l.base[1] < base {
+		base = l.base[1]
+	}
+	return base
+}
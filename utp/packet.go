@@ -0,0 +1,114 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// packet types
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version    = 1
+	headerSize = 20
+
+	extSelectiveAck = 1
+	// maxSack bounds the selective ack bitmask, which covers 8 packets per byte
+	maxSack = 128
+
+	// maxPayload keeps packets well below the usual MTU, even with a SOCKS5 UDP header in front
+	maxPayload = 1200
+)
+
+var errShortPacket = errors.New("uTP packet too short")
+
+//header is the fixed 20 byte header of every uTP packet.
+//The only extension understood is the selective ack, others are skipped.
+type header struct {
+	typ           byte
+	connID        uint16
+	timestamp     uint32
+	timestampDiff uint32
+	wnd           uint32
+	seq           uint16
+	ack           uint16
+
+	// sack has a bit set for every packet received after ack+1, starting at ack+2
+	sack []byte
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	ext := 0
+	if len(h.sack) > 0 {
+		ext = 2 + len(h.sack)
+	}
+	b := make([]byte, headerSize+ext+len(payload))
+	b[0] = h.typ<<4 | version
+	if ext > 0 {
+		b[1] = extSelectiveAck
+		b[headerSize] = 0 // last extension
+		b[headerSize+1] = byte(len(h.sack))
+		copy(b[headerSize+2:], h.sack)
+	}
+	binary.BigEndian.PutUint16(b[2:4], h.connID)
+	binary.BigEndian.PutUint32(b[4:8], h.timestamp)
+	binary.BigEndian.PutUint32(b[8:12], h.timestampDiff)
+	binary.BigEndian.PutUint32(b[12:16], h.wnd)
+	binary.BigEndian.PutUint16(b[16:18], h.seq)
+	binary.BigEndian.PutUint16(b[18:20], h.ack)
+	copy(b[headerSize+ext:], payload)
+	return b
+}
+
+//unmarshal parses a packet and returns its header and payload
+func unmarshal(b []byte) (header, []byte, error) {
+	var h header
+	if len(b) < headerSize {
+		return h, nil, errShortPacket
+	}
+	if b[0]&0xf != version {
+		return h, nil, errors.New("Unknown uTP version")
+	}
+	h.typ = b[0] >> 4
+	if h.typ > stSyn {
+		return h, nil, errors.New("Unknown uTP packet type")
+	}
+	h.connID = binary.BigEndian.Uint16(b[2:4])
+	h.timestamp = binary.BigEndian.Uint32(b[4:8])
+	h.timestampDiff = binary.BigEndian.Uint32(b[8:12])
+	h.wnd = binary.BigEndian.Uint32(b[12:16])
+	h.seq = binary.BigEndian.Uint16(b[16:18])
+	h.ack = binary.BigEndian.Uint16(b[18:20])
+
+	// skip the extension chain: next extension type, length, data
+	ext := b[1]
+	rest := b[headerSize:]
+	for ext != 0 {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return h, nil, errShortPacket
+		}
+		if ext == extSelectiveAck {
+			h.sack = rest[2 : 2+int(rest[1])]
+		}
+		ext = rest[0]
+		rest = rest[2+int(rest[1]):]
+	}
+	return h, rest, nil
+}
+
+//timestamp returns the current time in microseconds, as found in the packet headers
+func timestamp(now time.Time) uint32 {
+	return uint32(now.UnixNano() / int64(time.Microsecond))
+}
+
+//seqLess tells if sequence number a comes before b, taking wrap around into account
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
@@ -0,0 +1,318 @@
+//Package utp implements the Micro Transport Protocol (BEP 29), a TCP like stream over UDP whose
+//LEDBAT congestion control backs off as soon as it adds delay, leaving room to other traffic
+package utp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// acceptBacklog is how many incoming connections wait for Accept before new ones are refused
+const acceptBacklog = 32
+
+// ErrSocketClosed is returned by Accept and Dial once the socket is closed
+var ErrSocketClosed = errors.New("uTP socket closed")
+
+// ErrListenerClosed is returned by Accept once the listener is closed
+var ErrListenerClosed = errors.New("uTP listener closed")
+
+// ErrListening is returned by Listener while another listener of the socket is open
+var ErrListening = errors.New("uTP socket is already listening")
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket multiplexes uTP connections over a single UDP socket.
+// Incoming connections are refused with a reset unless a listener of the socket accepts them.
+type Socket struct {
+	pc net.PacketConn
+
+	mu    sync.Mutex
+	conns map[connKey]*Conn
+	// accept takes the incoming connections while a listener is open, nil otherwise
+	accept chan *Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+// NewSocket runs uTP over pc, which is owned by the socket from then on.
+// Any net.PacketConn works, such as a UDP socket relayed by a proxy or one simulating loss and delay.
+func NewSocket(pc net.PacketConn) *Socket {
+	s := &Socket{
+		pc:     pc,
+		conns:  make(map[connKey]*Conn),
+		closed: make(chan struct{}),
+	}
+	go s.readLoop()
+	return s
+}
+
+// Listen opens a UDP socket on address and runs uTP over it
+func Listen(address string) (*Socket, error) {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(pc), nil
+}
+
+func (s *Socket) readLoop() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := s.pc.ReadFrom(buf)
+		if err != nil {
+			s.Close()
+			return
+		}
+		h, payload, err := unmarshal(buf[:n])
+		if err != nil {
+			continue
+		}
+		now := time.Now()
+
+		if h.typ == stSyn {
+			s.handleSyn(h, addr, now)
+			continue
+		}
+		c := s.lookup(h, addr)
+		if c == nil {
+			if h.typ != stReset {
+				s.reset(h, addr)
+			}
+			continue
+		}
+		c.handle(h, payload, now)
+	}
+}
+
+//lookup finds the connection a packet belongs to. Resets carry the id of the connection they answer,
+//which may be our send id rather than our receive id.
+func (s *Socket) lookup(h header, addr net.Addr) *Conn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.conns[connKey{addr.String(), h.connID}]; ok {
+		return c
+	}
+	if h.typ != stReset {
+		return nil
+	}
+	for _, id := range []uint16{h.connID - 1, h.connID + 1} {
+		if c, ok := s.conns[connKey{addr.String(), id}]; ok && c.sendID == h.connID {
+			return c
+		}
+	}
+	return nil
+}
+
+//handleSyn creates the connection for an incoming SYN, or acknowledges it again if it is a retransmission.
+//The SYN is answered with a reset if nobody listens or the accept backlog is full.
+func (s *Socket) handleSyn(h header, addr net.Addr, now time.Time) {
+	key := connKey{addr.String(), h.connID + 1}
+	s.mu.Lock()
+	c, ok := s.conns[key]
+	accept := s.accept
+	if !ok && accept == nil {
+		s.mu.Unlock()
+		s.reset(h, addr)
+		return
+	}
+	if !ok {
+		c = newConn(s, addr, h.connID+1, h.connID)
+		c.state = stateConnected
+		c.seq = randomID()
+		c.ack = h.seq
+		c.lastAck = c.seq - 1
+		s.conns[key] = c
+	}
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.replyDif = timestamp(now) - h.timestamp
+	c.peerWnd = h.wnd
+	c.sendState()
+	c.mu.Unlock()
+	if ok {
+		return
+	}
+
+	// the listener may have been closed meanwhile, after which nothing must be queued for it
+	s.mu.Lock()
+	queued := false
+	if s.accept == accept {
+		select {
+		case accept <- c:
+			queued = true
+		default:
+		}
+	}
+	s.mu.Unlock()
+	if !queued {
+		c.refuse()
+	}
+}
+
+//reset tells the sender of a packet for an unknown connection that there is no such connection
+func (s *Socket) reset(h header, addr net.Addr) {
+	r := header{typ: stReset, connID: h.connID, timestamp: timestamp(time.Now()), seq: randomID(), ack: h.seq}
+	s.pc.WriteTo(r.marshal(nil), addr)
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{c.remote.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+// Dial connects to the uTP peer at address
+func (s *Socket) Dial(ctx context.Context, address string) (*Conn, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	select {
+	case <-s.closed:
+		s.mu.Unlock()
+		return nil, ErrSocketClosed
+	default:
+	}
+	// pick a receive id which is free for this peer, the peer sends with it and we send with id+1
+	var c *Conn
+	for c == nil {
+		id := randomID()
+		if _, ok := s.conns[connKey{addr.String(), id}]; !ok {
+			c = newConn(s, addr, id, id+1)
+			s.conns[connKey{addr.String(), id}] = c
+		}
+	}
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.seq = randomID()
+	c.queue(stSyn, nil)
+	for c.state == stateSynSent {
+		ch := c.notify
+		c.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+		}
+		c.mu.Lock()
+		if ctx.Err() != nil && c.state == stateSynSent {
+			c.release()
+			return nil, ctx.Err()
+		}
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c, nil
+}
+
+// Listener starts accepting incoming connections until the returned listener is closed,
+// which leaves the socket and its connections open. There is one listener at a time.
+func (s *Socket) Listener() (net.Listener, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-s.closed:
+		return nil, ErrSocketClosed
+	default:
+	}
+	if s.accept != nil {
+		return nil, ErrListening
+	}
+	s.accept = make(chan *Conn, acceptBacklog)
+	return &listener{s: s, accept: s.accept, closed: make(chan struct{})}, nil
+}
+
+//listener accepts the incoming connections of a socket
+type listener struct {
+	s      *Socket
+	accept chan *Conn
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Accept waits for the next incoming connection
+func (l *listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.accept:
+		return c, nil
+	case <-l.closed:
+		return nil, ErrListenerClosed
+	case <-l.s.closed:
+		return nil, ErrSocketClosed
+	}
+}
+
+// Close stops accepting connections, resetting the ones which were not accepted yet
+func (l *listener) Close() error {
+	l.once.Do(func() {
+		l.s.mu.Lock()
+		if l.s.accept == l.accept {
+			l.s.accept = nil
+		}
+		l.s.mu.Unlock()
+		close(l.closed)
+		for {
+			select {
+			case c := <-l.accept:
+				c.refuse()
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
+
+// Addr returns the local address of the socket
+func (l *listener) Addr() net.Addr {
+	return l.s.Addr()
+}
+
+// Addr returns the local address of the socket
+func (s *Socket) Addr() net.Addr {
+	return s.pc.LocalAddr()
+}
+
+// Close closes the UDP socket, ending every connection on it
+func (s *Socket) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.closed)
+		err = s.pc.Close()
+
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.mu.Lock()
+			c.fail(ErrSocketClosed)
+			c.mu.Unlock()
+		}
+	})
+	return err
+}
+
+func randomID() uint16 {
+	b := make([]byte, 2)
+	rand.Read(b)
+	return binary.BigEndian.Uint16(b)
+}
@@ -0,0 +1,91 @@
+package webseed
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileSet reads the files of a multi file torrent as the single stream pieces are cut from.
+// Padding files are read as zeros.
+type FileSet struct {
+	files   []*os.File
+	lengths []int64
+}
+
+// OpenFiles opens the files of a torrent stored under dir
+func OpenFiles(dir string, files []File) (*FileSet, error) {
+	fs := &FileSet{}
+	for _, f := range files {
+		if f.Padding {
+			fs.files = append(fs.files, nil)
+			fs.lengths = append(fs.lengths, f.Length)
+			continue
+		}
+		osf, err := os.Open(filepath.Join(dir, filepath.FromSlash(f.Path)))
+		if err != nil {
+			fs.Close()
+			return nil, err
+		}
+		fs.files = append(fs.files, osf)
+		fs.lengths = append(fs.lengths, f.Length)
+	}
+	return fs, nil
+}
+
+// ReadAt reads len(b) bytes at offset off of the concatenated files
+func (fs *FileSet) ReadAt(b []byte, off int64) (int, error) {
+	n := 0
+	var start int64
+	for i, f := range fs.files {
+		end := start + fs.lengths[i]
+		if len(b) > 0 && off < end {
+			chunk := b
+			if int64(len(chunk)) > end-off {
+				chunk = chunk[:end-off]
+			}
+			var m int
+			var err error
+			if f == nil {
+				for i := range chunk {
+					chunk[i] = 0
+				}
+				m = len(chunk)
+			} else {
+				m, err = f.ReadAt(chunk, off-start)
+			}
+			n += m
+			if err != nil {
+				return n, err
+			}
+			b = b[m:]
+			off += int64(m)
+		}
+		start = end
+	}
+	if len(b) > 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close closes every file
+func (fs *FileSet) Close() error {
+	var err error
+	for _, f := range fs.files {
+		if f == nil {
+			continue
+		}
+		cerr := f.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Path joins the components of a file path of the metainfo with slashes, as File expects
+func Path(parts []string) string {
+	return strings.Join(parts, "/")
+}
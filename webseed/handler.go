@@ -0,0 +1,163 @@
+package webseed
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultRetryAfter is how long busy clients are told to wait when Handler.RetryAfter is 0
+const DefaultRetryAfter = 10 * time.Second
+
+// Handler is a reference BEP 17 seed script, serving the pieces of one or more torrents over HTTP.
+// Requests carry the info_hash and piece parameters, and optionally ranges within the piece.
+type Handler struct {
+	// MaxRequests is the number of requests served at once, the others being told to retry later. 0 means no limit.
+	MaxRequests int
+	// RetryAfter is how long busy clients are told to wait, DefaultRetryAfter is used if 0
+	RetryAfter time.Duration
+
+	mu       sync.RWMutex
+	torrents map[[20]byte]*servedTorrent
+	active   int
+}
+
+type servedTorrent struct {
+	data        io.ReaderAt
+	pieceLength int64
+	length      int64
+}
+
+// Add serves the torrent infoHash, whose content of length bytes is read from data
+func (h *Handler) Add(infoHash [20]byte, pieceLength int, length int64, data io.ReaderAt) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.torrents == nil {
+		h.torrents = make(map[[20]byte]*servedTorrent)
+	}
+	h.torrents[infoHash] = &servedTorrent{data: data, pieceLength: int64(pieceLength), length: length}
+}
+
+// Remove stops serving the torrent infoHash
+func (h *Handler) Remove(infoHash [20]byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.torrents, infoHash)
+}
+
+//acquire takes one of the MaxRequests slots, returning false if they are all in use
+func (h *Handler) acquire() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.MaxRequests > 0 && h.active >= h.MaxRequests {
+		return false
+	}
+	h.active++
+	return true
+}
+
+func (h *Handler) release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.active--
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+
+	var infoHash [20]byte
+	ih := q.Get("info_hash")
+	if len(ih) != len(infoHash) {
+		http.Error(w, "Invalid info_hash", http.StatusBadRequest)
+		return
+	}
+	copy(infoHash[:], ih)
+	h.mu.RLock()
+	t := h.torrents[infoHash]
+	h.mu.RUnlock()
+	if t == nil {
+		http.Error(w, "Unknown info_hash", http.StatusNotFound)
+		return
+	}
+
+	index, err := strconv.ParseInt(q.Get("piece"), 10, 64)
+	if err != nil || index < 0 || index*t.pieceLength >= t.length {
+		http.Error(w, "Invalid piece", http.StatusBadRequest)
+		return
+	}
+	begin := index * t.pieceLength
+	size := t.pieceLength
+	if begin+size > t.length {
+		size = t.length - begin
+	}
+
+	ranges, err := parseRanges(q.Get("ranges"), size)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !h.acquire() {
+		retry := h.RetryAfter
+		if retry <= 0 {
+			retry = DefaultRetryAfter
+		}
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry/time.Second)))
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, int(retry/time.Second))
+		return
+	}
+	defer h.release()
+
+	var total int64
+	for _, rg := range ranges {
+		total += rg[1] - rg[0]
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(total, 10))
+	if r.Method == http.MethodHead {
+		return
+	}
+	for _, rg := range ranges {
+		_, err = io.Copy(w, io.NewSectionReader(t.data, begin+rg[0], rg[1]-rg[0]))
+		if err != nil {
+			return
+		}
+	}
+}
+
+//parseRanges parses the ranges parameter, a comma separated list of inclusive byte ranges such as 0-16383,32768-49151,
+//into half open intervals within a piece of size bytes. No ranges means the whole piece.
+func parseRanges(s string, size int64) ([][2]int64, error) {
+	if s == "" {
+		return [][2]int64{{0, size}}, nil
+	}
+	var res [][2]int64
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("Invalid range %q", part)
+		}
+		start, err := strconv.ParseInt(bounds[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid range %q", part)
+		}
+		end, err := strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid range %q", part)
+		}
+		if start < 0 || end < start || end >= size {
+			return nil, fmt.Errorf("Range %q is outside of the piece", part)
+		}
+		res = append(res, [2]int64{start, end + 1})
+	}
+	return res, nil
+}
@@ -0,0 +1,109 @@
+package webseed
+
+import (
+	"context"
+	"fmt"
+	ratelimit "github.com/adityameharia/gotor/ratelimit"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxRetryAfter caps how long an HTTP seed can ask us to wait before trying again
+const MaxRetryAfter = time.Hour
+
+// RetryError is returned when an HTTP seed is busy and asks to try again later
+type RetryError struct {
+	URL   string
+	After time.Duration
+}
+
+func (e *RetryError) Error() string {
+	return fmt.Sprintf("%s is busy, retry after %v", e.URL, e.After)
+}
+
+// HTTPSeed is a seed script serving the pieces of a torrent (BEP 17), listed in the httpseeds key of the metainfo
+type HTTPSeed struct {
+	URL      string
+	InfoHash [20]byte
+
+	// Client makes the requests, http.DefaultClient is used if nil
+	Client *http.Client
+	// Limiters throttle the responses of the seed as they are read
+	Limiters []*ratelimit.Limiter
+}
+
+func (s *HTTPSeed) String() string {
+	return s.URL
+}
+
+func (s *HTTPSeed) client() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+//pieceURL returns the URL requesting the whole of piece index, which is length bytes long
+func (s *HTTPSeed) pieceURL(index, length int) string {
+	params := url.Values{
+		"info_hash": []string{string(s.InfoHash[:])},
+		"piece":     []string{strconv.Itoa(index)},
+		"ranges":    []string{fmt.Sprintf("0-%d", length-1)},
+	}
+	sep := "?"
+	if strings.Contains(s.URL, "?") {
+		sep = "&"
+	}
+	return s.URL + sep + params.Encode()
+}
+
+// ReadPiece fills buf with piece index.
+// If the seed is busy it returns a *RetryError telling how long to wait before asking again.
+func (s *HTTPSeed) ReadPiece(ctx context.Context, index int, buf []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.pieceURL(index, len(buf)), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusServiceUnavailable:
+		return &RetryError{URL: s.URL, After: retryAfter(resp)}
+	default:
+		return fmt.Errorf("%s: %s", s.URL, resp.Status)
+	}
+
+	_, err = io.ReadFull(ratelimit.Reader(ctx, resp.Body, s.Limiters...), buf)
+	if err != nil {
+		return fmt.Errorf("%s: %v", s.URL, err)
+	}
+	return nil
+}
+
+//retryAfter reads the number of seconds to wait from the body of a 503 response, as BEP 17 has it,
+//or from the Retry-After header which some seeds send instead. DefaultRetryAfter is used if neither is valid.
+func retryAfter(resp *http.Response) time.Duration {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 32))
+	secs, err := strconv.Atoi(strings.TrimSpace(string(body)))
+	if err != nil {
+		secs, err = strconv.Atoi(strings.TrimSpace(resp.Header.Get("Retry-After")))
+	}
+	if err != nil || secs < 0 {
+		return DefaultRetryAfter
+	}
+	d := time.Duration(secs) * time.Second
+	if d > MaxRetryAfter {
+		d = MaxRetryAfter
+	}
+	return d
+}
@@ -0,0 +1,164 @@
+package webseed
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//blockingReader reads from data once unblock is closed, telling it started reading on started
+type blockingReader struct {
+	data    []byte
+	started chan struct{}
+	unblock chan struct{}
+}
+
+func (r *blockingReader) ReadAt(b []byte, off int64) (int, error) {
+	select {
+	case r.started <- struct{}{}:
+	default:
+	}
+	<-r.unblock
+	return bytes.NewReader(r.data).ReadAt(b, off)
+}
+
+func TestHTTPSeed(t *testing.T) {
+	data := make([]byte, 2*1024+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	infoHash := [20]byte{1, 2, 3}
+	h := &Handler{}
+	h.Add(infoHash, 1024, int64(len(data)), bytes.NewReader(data))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	s := &HTTPSeed{URL: srv.URL + "/seed?key=value", InfoHash: infoHash}
+	for index, length := range []int{1024, 1024, 100} {
+		buf := make([]byte, length)
+		if err := s.ReadPiece(context.Background(), index, buf); err != nil {
+			t.Fatalf("Reading piece #%d: %v", index, err)
+		}
+		if !bytes.Equal(buf, data[index*1024:index*1024+length]) {
+			t.Errorf("Piece #%d differs from the served data", index)
+		}
+	}
+
+	for _, bad := range []*HTTPSeed{{URL: srv.URL, InfoHash: [20]byte{4}}, s} {
+		err := bad.ReadPiece(context.Background(), 3, make([]byte, 10))
+		var retry *RetryError
+		if err == nil || errors.As(err, &retry) {
+			t.Errorf("Reading an unknown piece got %v", err)
+		}
+	}
+}
+
+func TestHTTPSeedBusy(t *testing.T) {
+	data := []byte("some data of a piece")
+	r := &blockingReader{data: data, started: make(chan struct{}, 1), unblock: make(chan struct{})}
+	infoHash := [20]byte{1, 2, 3}
+	h := &Handler{MaxRequests: 1, RetryAfter: 30 * time.Second}
+	h.Add(infoHash, len(data), int64(len(data)), r)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	s := &HTTPSeed{URL: srv.URL, InfoHash: infoHash}
+
+	// the first request takes the only slot until the data can be read
+	first := make(chan error, 1)
+	go func() {
+		first <- s.ReadPiece(context.Background(), 0, make([]byte, len(data)))
+	}()
+	<-r.started
+
+	err := s.ReadPiece(context.Background(), 0, make([]byte, len(data)))
+	var retry *RetryError
+	if !errors.As(err, &retry) {
+		t.Fatalf("Reading from a busy seed got %v, want a *RetryError", err)
+	}
+	if retry.After != 30*time.Second {
+		t.Errorf("Got told to retry after %v, want %v", retry.After, 30*time.Second)
+	}
+
+	close(r.unblock)
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(data))
+	if err := s.ReadPiece(context.Background(), 0, buf); err != nil {
+		t.Fatalf("Reading once the seed is not busy anymore: %v", err)
+	}
+	if !bytes.Equal(buf, data) {
+		t.Error("Piece differs from the served data")
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		body   string
+		header string
+		want   time.Duration
+	}{
+		{"20", "", 20 * time.Second},
+		{" 20\n", "", 20 * time.Second},
+		{"", "30", 30 * time.Second},
+		{"Busy", "30", 30 * time.Second},
+		{"20", "30", 20 * time.Second},
+		{"0", "", 0},
+		{"", "", DefaultRetryAfter},
+		{"Busy", "Tomorrow", DefaultRetryAfter},
+		{"-5", "", DefaultRetryAfter},
+		{"7200", "", MaxRetryAfter},
+		{"", "86400", MaxRetryAfter},
+	}
+	for _, tt := range tests {
+		resp := &http.Response{
+			StatusCode: http.StatusServiceUnavailable,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader(tt.body)),
+		}
+		if tt.header != "" {
+			resp.Header.Set("Retry-After", tt.header)
+		}
+		if got := retryAfter(resp); got != tt.want {
+			t.Errorf("retryAfter with body %q and header %q = %v, want %v", tt.body, tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestParseRanges(t *testing.T) {
+	tests := []struct {
+		s     string
+		size  int64
+		want  [][2]int64
+		fails bool
+	}{
+		{"", 100, [][2]int64{{0, 100}}, false},
+		{"0-99", 100, [][2]int64{{0, 100}}, false},
+		{"0-9,50-59", 100, [][2]int64{{0, 10}, {50, 60}}, false},
+		{"5-5", 100, [][2]int64{{5, 6}}, false},
+		{"0-100", 100, nil, true},
+		{"10-5", 100, nil, true},
+		{"-1-5", 100, nil, true},
+		{"5", 100, nil, true},
+		{"a-b", 100, nil, true},
+		{"0-9,", 100, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := parseRanges(tt.s, tt.size)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("parseRanges(%q, %d) = %v, want an error", tt.s, tt.size, got)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRanges(%q, %d) = %v, %v, want %v", tt.s, tt.size, got, err, tt.want)
+		}
+	}
+}
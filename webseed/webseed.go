@@ -0,0 +1,177 @@
+//Package webseed downloads pieces from HTTP servers hosting the files of a torrent, as listed in its url-list (BEP 19)
+package webseed
+
+import (
+	"context"
+	"fmt"
+	ratelimit "github.com/adityameharia/gotor/ratelimit"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// File is one of the files of a torrent, Path being relative to the torrent name and separated by slashes
+type File struct {
+	Path   string
+	Length int64
+	// Padding files (BEP 47) are zeros which servers don't have
+	Padding bool
+}
+
+// Seed is an HTTP server hosting the files of a torrent
+type Seed struct {
+	// URL is the entry of the url-list
+	URL string
+	// Name is the name of the torrent, Files its files or nil for a single file torrent
+	Name  string
+	Files []File
+
+	// Client makes the requests, http.DefaultClient is used if nil
+	Client *http.Client
+	// Limiters throttle the responses of the server as they are read
+	Limiters []*ratelimit.Limiter
+}
+
+func (s *Seed) String() string {
+	return s.URL
+}
+
+func (s *Seed) client() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+//fileURL returns the URL of a file of the torrent, path being empty for a single file torrent.
+//A URL ending with a slash is a directory to which the name of the torrent is appended,
+//and for multi file torrents it is always taken as one.
+func (s *Seed) fileURL(path string) string {
+	u := s.URL
+	if s.Files == nil && !strings.HasSuffix(u, "/") {
+		return u
+	}
+	if !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	u += url.PathEscape(s.Name)
+	if path == "" {
+		return u
+	}
+	for _, part := range strings.Split(path, "/") {
+		u += "/" + url.PathEscape(part)
+	}
+	return u
+}
+
+//span is the part of a file covering some bytes of the torrent
+type span struct {
+	path    string
+	offset  int64
+	length  int64
+	padding bool
+}
+
+//spans maps length bytes at offset in the torrent to the files they are stored in
+func (s *Seed) spans(offset, length int64) []span {
+	if s.Files == nil {
+		return []span{{offset: offset, length: length}}
+	}
+	var res []span
+	var start int64
+	for _, f := range s.Files {
+		end := start + f.Length
+		if length > 0 && offset < end && f.Length > 0 {
+			n := end - offset
+			if n > length {
+				n = length
+			}
+			res = append(res, span{path: f.Path, offset: offset - start, length: n, padding: f.Padding})
+			offset += n
+			length -= n
+		}
+		start = end
+	}
+	return res
+}
+
+// ReadAt fills buf with the bytes of the torrent starting at offset, with one Range request per file they span
+func (s *Seed) ReadAt(ctx context.Context, buf []byte, offset int64) error {
+	spans := s.spans(offset, int64(len(buf)))
+	for _, sp := range spans {
+		if sp.padding {
+			for i := range buf[:sp.length] {
+				buf[i] = 0
+			}
+			buf = buf[sp.length:]
+			continue
+		}
+		err := s.get(ctx, sp, buf[:sp.length])
+		if err != nil {
+			return err
+		}
+		buf = buf[sp.length:]
+	}
+	if len(buf) > 0 {
+		return fmt.Errorf("%d bytes at %d are past the end of the torrent", len(buf), offset)
+	}
+	return nil
+}
+
+func (s *Seed) get(ctx context.Context, sp span, buf []byte) error {
+	u := s.fileURL(sp.path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", sp.offset, sp.offset+sp.length-1))
+
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body := ratelimit.Reader(ctx, resp.Body, s.Limiters...)
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		start, err := contentRangeStart(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return fmt.Errorf("%s: %v", u, err)
+		}
+		if start != sp.offset {
+			return fmt.Errorf("%s: Asked for bytes from %d but got them from %d", u, sp.offset, start)
+		}
+	case http.StatusOK:
+		// the server ignored the range and sends the whole file
+		_, err = io.CopyN(ioutil.Discard, body, sp.offset)
+		if err != nil {
+			return fmt.Errorf("%s: %v", u, err)
+		}
+	default:
+		return fmt.Errorf("%s: %s", u, resp.Status)
+	}
+
+	_, err = io.ReadFull(body, buf)
+	if err != nil {
+		return fmt.Errorf("%s: %v", u, err)
+	}
+	return nil
+}
+
+//contentRangeStart returns the first byte of a Content-Range header such as "bytes 100-199/1000"
+func contentRangeStart(h string) (int64, error) {
+	rg := strings.TrimPrefix(h, "bytes ")
+	dash := strings.IndexByte(rg, '-')
+	if rg == h || dash < 0 {
+		return 0, fmt.Errorf("Invalid Content-Range %q", h)
+	}
+	start, err := strconv.ParseInt(rg[:dash], 10, 64)
+	if err != nil || start < 0 {
+		return 0, fmt.Errorf("Invalid Content-Range %q", h)
+	}
+	return start, nil
+}
@@ -0,0 +1,162 @@
+package webseed
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSpans(t *testing.T) {
+	files := []File{
+		{Path: "a", Length: 100},
+		{Path: "empty", Length: 0},
+		{Path: ".pad/28", Length: 28, Padding: true},
+		{Path: "dir/b", Length: 128},
+		{Path: "c", Length: 10},
+	}
+	tests := []struct {
+		name           string
+		files          []File
+		offset, length int64
+		want           []span
+	}{
+		{"single file", nil, 10, 20, []span{{offset: 10, length: 20}}},
+		{"within a file", files, 10, 20, []span{{path: "a", offset: 10, length: 20}}},
+		{"whole file", files, 0, 100, []span{{path: "a", offset: 0, length: 100}}},
+		{"into padding", files, 90, 20, []span{{path: "a", offset: 90, length: 10}, {path: ".pad/28", offset: 0, length: 10, padding: true}}},
+		{"across padding", files, 90, 50, []span{
+			{path: "a", offset: 90, length: 10},
+			{path: ".pad/28", offset: 0, length: 28, padding: true},
+			{path: "dir/b", offset: 0, length: 12},
+		}},
+		{"aligned after padding", files, 128, 128, []span{{path: "dir/b", offset: 0, length: 128}}},
+		{"last file", files, 250, 16, []span{{path: "dir/b", offset: 122, length: 6}, {path: "c", offset: 0, length: 10}}},
+		{"past the end", files, 260, 16, []span{{path: "c", offset: 4, length: 6}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &Seed{Name: "torrent", Files: tt.files}
+			got := s.spans(tt.offset, tt.length)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("spans(%d, %d) = %+v, want %+v", tt.offset, tt.length, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSeedReadAt(t *testing.T) {
+	files := []File{
+		{Path: "a", Length: 100},
+		{Path: ".pad/28", Length: 28, Padding: true},
+		{Path: "dir/b c", Length: 128},
+	}
+	content := map[string][]byte{}
+	var torrent []byte
+	rnd := rand.New(rand.NewSource(1))
+	for _, f := range files {
+		data := make([]byte, f.Length)
+		if !f.Padding {
+			rnd.Read(data)
+			content["/files/torrent/"+f.Path] = data
+		}
+		torrent = append(torrent, data...)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := content[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer srv.Close()
+
+	s := &Seed{URL: srv.URL + "/files/", Name: "torrent", Files: files}
+	for _, rg := range [][2]int64{{0, 256}, {90, 50}, {100, 28}, {255, 1}} {
+		buf := make([]byte, rg[1])
+		if err := s.ReadAt(context.Background(), buf, rg[0]); err != nil {
+			t.Fatalf("Reading %d bytes at %d: %v", rg[1], rg[0], err)
+		}
+		if !bytes.Equal(buf, torrent[rg[0]:rg[0]+rg[1]]) {
+			t.Errorf("%d bytes at %d differ from the torrent", rg[1], rg[0])
+		}
+	}
+	if err := s.ReadAt(context.Background(), make([]byte, 10), 250); err == nil {
+		t.Error("Read past the end of the torrent")
+	}
+}
+
+func TestSeedContentRange(t *testing.T) {
+	data := []byte("0123456789")
+	tests := []struct {
+		name  string
+		serve func(w http.ResponseWriter, r *http.Request)
+		fails bool
+	}{
+		{"range ignored", func(w http.ResponseWriter, r *http.Request) {
+			w.Write(data)
+		}, false},
+		{"matching range", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", "bytes 4-6/10")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[4:7])
+		}, false},
+		{"other range", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Range", "bytes 0-2/10")
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[0:3])
+		}, true},
+		{"no Content-Range", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[4:7])
+		}, true},
+		{"not found", http.NotFound, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(tt.serve))
+			defer srv.Close()
+			s := &Seed{URL: srv.URL + "/file"}
+			buf := make([]byte, 3)
+			err := s.ReadAt(context.Background(), buf, 4)
+			if tt.fails {
+				if err == nil {
+					t.Fatalf("Read %q", buf)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != "456" {
+				t.Errorf("Read %q, want %q", buf, "456")
+			}
+		})
+	}
+}
+
+func TestContentRangeStart(t *testing.T) {
+	tests := []struct {
+		h     string
+		want  int64
+		fails bool
+	}{
+		{"bytes 100-199/1000", 100, false},
+		{"bytes 0-0/*", 0, false},
+		{"bytes */1000", 0, true},
+		{"100-199/1000", 0, true},
+		{"bytes -5-10/20", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := contentRangeStart(tt.h)
+		if (err != nil) != tt.fails || got != tt.want {
+			t.Errorf("contentRangeStart(%q) = %d, %v", tt.h, got, err)
+		}
+	}
+}